@@ -1,5 +1,7 @@
 package conf
 
+import "time"
+
 var App = &Config{}
 
 type Config struct {
@@ -7,4 +9,73 @@ type Config struct {
 	ListenPort string
 	LogLevel   string
 	FilePath   string
+	// 多后端路由文件, 设置后忽略RemoteDb和ListenPort
+	RouteFile string
+	// 所有监听都只读
+	ReadOnly bool
+	// 记录文件格式 text jsonl
+	RecordFormat string
+	// 事务结束时额外记录一条事务汇总
+	RecordTransaction bool
+	// 脱敏规则文件, 只记录语句指纹时所有字面量替换为?
+	MaskFile          string
+	RecordFingerprint bool
+
+	// 审计库, 为空时不入库
+	AuditDsn           string
+	AuditQueueSize     int
+	AuditBatchSize     int
+	AuditFlushInterval time.Duration
+	// 队列满时的处理策略 drop block
+	AuditQueuePolicy  string
+	AuditBlockTimeout time.Duration
+
+	// 后台sql注释标记, CommentRegex不为空时优先使用
+	CommentMarker string
+	CommentRegex  string
+
+	// 客户端连接代理使用的证书, 为空时不支持ssl
+	ClientTlsCert string
+	ClientTlsKey  string
+	// 拒绝没有使用ssl的客户端
+	RequireSecureTransport bool
+
+	// 代理连接服务端的ssl disabled preferred required verify_ca verify_identity
+	ServerTlsMode       string
+	ServerTlsCa         string
+	ServerTlsCert       string
+	ServerTlsKey        string
+	ServerTlsServerName string
+
+	// 是否允许客户端使用压缩协议
+	ClientCompress bool
+	// 代理连接服务端使用的压缩 none zlib zstd
+	ServerCompress  string
+	ServerZstdLevel int
+
+	// 代理用户文件, 设置后由代理完成客户端认证, 再用映射的服务账号登录服务端
+	AuthUserFile string
+	// 防火墙规则文件, 为空时不检查
+	FirewallFile string
+	// 结果集脱敏规则文件, 为空时不改写结果集
+	ResultMaskFile string
+
+	// 后端健康检查间隔, 为0时不检查
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+	// 健康检查账号, 为空时不检查, 只连接不登录会被服务端计入max_connect_errors
+	HealthCheckUser     string
+	HealthCheckPassword string
+	// 连接后端失败时的重试次数和首次退避时间
+	ConnectRetries int
+	ConnectBackoff time.Duration
+	ConnectTimeout time.Duration
+
+	// 每个后端的连接池大小, 为0时不使用连接池, 每个客户端独占一个服务端连接
+	PoolSize        int
+	PoolIdleTimeout time.Duration
+	PoolMaxLifetime time.Duration
+
+	// 合并后逻辑包的最大长度, 需要不小于服务端的max_allowed_packet
+	MaxAllowedPacket int
 }
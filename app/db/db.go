@@ -10,9 +10,8 @@ var (
 	db *gorm.DB
 )
 
-func InitAdminDb() {
-	dsn := "root:123456@tcp(127.0.0.1:3306)/test?loc=Local&charset=utf8mb4&parseTime=true"
-
+// InitAdminDb 初始化审计库, dsn 例如 root:123456@tcp(127.0.0.1:3306)/test?loc=Local&charset=utf8mb4&parseTime=true
+func InitAdminDb(dsn string) {
 	var err error
 	db, err = gorm.Open(mysql.Open(dsn))
 	if err != nil {
@@ -60,3 +59,22 @@ func initTable() {
 		panic(err)
 	}
 }
+
+type SqlQueryLog struct {
+	Id            int64
+	AdminId       int64
+	AdminName     string
+	AdminRealName string
+	QueryGameId   int32
+	HeaderGameId  int32
+	Ip            string
+	RequestPath   string
+	RequestInfo   string
+	UnixMilli     int64
+	Query         string
+	CreateTime    time.Time
+}
+
+func (SqlQueryLog) TableName() string {
+	return "sql_query_log"
+}
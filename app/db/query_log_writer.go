@@ -0,0 +1,138 @@
+package db
+
+import (
+	"fmt"
+	"proxymysql/app/zlog"
+	"sync/atomic"
+	"time"
+)
+
+// 队列满时的处理策略
+const (
+	// QueuePolicyDrop 直接丢弃新日志
+	QueuePolicyDrop = "drop"
+	// QueuePolicyBlock 最多等待BlockTimeout, 超时后丢弃
+	QueuePolicyBlock = "block"
+)
+
+var queryLogWriter *QueryLogWriter
+
+type QueryLogWriterConfig struct {
+	QueueSize     int
+	BatchSize     int
+	FlushInterval time.Duration
+	QueuePolicy   string
+	BlockTimeout  time.Duration
+}
+
+// QueryLogWriter 异步批量写入sql_query_log, 审计库变慢时只会丢日志, 不会阻塞代理的流量
+type QueryLogWriter struct {
+	cfg     *QueryLogWriterConfig
+	queue   chan *SqlQueryLog
+	dropped uint64
+}
+
+// InitQueryLogWriter 需要先调用InitAdminDb
+func InitQueryLogWriter(cfg *QueryLogWriterConfig) error {
+	switch cfg.QueuePolicy {
+	case QueuePolicyDrop:
+	case QueuePolicyBlock:
+		if cfg.BlockTimeout <= 0 {
+			return fmt.Errorf("invalid audit block timeout: %s", cfg.BlockTimeout)
+		}
+	default:
+		return fmt.Errorf("unsupported audit queue policy: %s", cfg.QueuePolicy)
+	}
+
+	queryLogWriter = NewQueryLogWriter(cfg)
+
+	return nil
+}
+
+// SaveQueryLog 没有配置审计库时直接忽略
+func SaveQueryLog(log *SqlQueryLog) {
+	if queryLogWriter == nil {
+		return
+	}
+
+	queryLogWriter.Write(log)
+}
+
+func NewQueryLogWriter(cfg *QueryLogWriterConfig) *QueryLogWriter {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 10000
+	}
+
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 200
+	}
+
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+
+	w := &QueryLogWriter{
+		cfg:   cfg,
+		queue: make(chan *SqlQueryLog, cfg.QueueSize),
+	}
+
+	go w.run()
+
+	return w
+}
+
+func (w *QueryLogWriter) Write(log *SqlQueryLog) {
+	select {
+	case w.queue <- log:
+		return
+	default:
+	}
+
+	if w.cfg.QueuePolicy == QueuePolicyBlock && w.cfg.BlockTimeout > 0 {
+		timer := time.NewTimer(w.cfg.BlockTimeout)
+		defer timer.Stop()
+
+		select {
+		case w.queue <- log:
+			return
+		case <-timer.C:
+		}
+	}
+
+	dropped := atomic.AddUint64(&w.dropped, 1)
+	if dropped%1000 == 1 {
+		zlog.Warnf("sql query log queue is full, dropped: %d", dropped)
+	}
+}
+
+func (w *QueryLogWriter) run() {
+	ticker := time.NewTicker(w.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*SqlQueryLog, 0, w.cfg.BatchSize)
+
+	for {
+		select {
+		case log := <-w.queue:
+			batch = append(batch, log)
+			if len(batch) < w.cfg.BatchSize {
+				continue
+			}
+
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		w.flush(batch)
+		batch = make([]*SqlQueryLog, 0, w.cfg.BatchSize)
+	}
+}
+
+func (w *QueryLogWriter) flush(batch []*SqlQueryLog) {
+	err := db.CreateInBatches(batch, len(batch)).Error
+	if err != nil {
+		zlog.Errorf("save sql query log err: %s, lost: %d", err, len(batch))
+	}
+}
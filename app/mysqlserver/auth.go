@@ -0,0 +1,293 @@
+package mysqlserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"proxymysql/app/zlog"
+	"sync"
+)
+
+// caching_sha2_password 完整认证时客户端请求服务端公钥
+const cachingSha2RequestPublicKey = 0x02
+
+// 认证方式, 记录到会话里
+const (
+	// 插件直接用scramble认证, 如 mysql_native_password
+	AuthPathScramble = "scramble"
+	// caching_sha2_password 命中服务端缓存
+	AuthPathFastAuth = "fast_auth"
+	// 两边都是ssl, 明文密码直接转发
+	AuthPathFullAuthTls = "full_auth_tls"
+	// 两边都不是ssl, 客户端与服务端直接交换RSA公钥
+	AuthPathFullAuthRsa = "full_auth_rsa"
+	// 客户端ssl服务端明文, 代理用服务端公钥加密客户端的明文密码
+	AuthPathProxyEncrypt = "full_auth_proxy_encrypt"
+	// 客户端明文服务端ssl, 代理用自己的公钥解密客户端密码后转发明文
+	AuthPathProxyDecrypt = "full_auth_proxy_decrypt"
+)
+
+var (
+	proxyRsaKeyOnce sync.Once
+	proxyRsaKey     *rsa.PrivateKey
+	proxyRsaKeyPem  []byte
+	proxyRsaKeyErr  error
+)
+
+// getProxyRsaKey 代理自己的RSA密钥, 客户端明文连接而服务端是ssl时提供给客户端加密密码
+func getProxyRsaKey() (*rsa.PrivateKey, []byte, error) {
+	proxyRsaKeyOnce.Do(func() {
+		proxyRsaKey, proxyRsaKeyErr = rsa.GenerateKey(rand.Reader, 2048)
+		if proxyRsaKeyErr != nil {
+			return
+		}
+
+		der, err := x509.MarshalPKIXPublicKey(&proxyRsaKey.PublicKey)
+		if err != nil {
+			proxyRsaKeyErr = err
+			return
+		}
+
+		proxyRsaKeyPem = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	})
+
+	return proxyRsaKey, proxyRsaKeyPem, proxyRsaKeyErr
+}
+
+func isTlsConn(conn net.Conn) bool {
+	_, ok := conn.(*tls.Conn)
+	return ok
+}
+
+// authSwitch 转发认证阶段的数据包直到服务端返回OK/ERR
+// caching_sha2_password 的完整认证在两边ssl状态不一致时由代理转换密码
+func (p *ProxyConn) authSwitch(serverConn net.Conn) error {
+	var isFinish bool
+
+	if p.session.AuthPath == "" {
+		p.session.AuthPath = AuthPathScramble
+	}
+
+	for {
+		serverResult, err := ReadMysqlPacket(serverConn)
+		if err != nil {
+			return err
+		}
+
+		payload := serverResult.Payload
+		// AuthMoreData后面紧跟服务端的结果, 不需要等待客户端
+		var waitServer bool
+
+		switch {
+		case len(payload) == 0:
+
+		case payload[0] == OKPacket || payload[0] == ErrPacket:
+			isFinish = true
+
+		case payload[0] == AuthSwitchRequestPacket:
+			// plugin_name(NUL) plugin_data(EOF)
+			idx := bytes.IndexByte(payload[1:], 0x00)
+			if idx >= 0 {
+				p.session.AuthPlugin = string(payload[1 : idx+1])
+				p.scramble = bytes.TrimRight(payload[idx+2:], "\x00")
+			}
+
+		case len(payload) == 2 && payload[0] == AuthMoreDataPacket && payload[1] == CachingSha2FastAuth:
+			p.session.AuthPath = AuthPathFastAuth
+			waitServer = true
+
+		case len(payload) == 2 && payload[0] == AuthMoreDataPacket && payload[1] == CachingSha2FullAuth:
+			p.session.AuthPath = AuthPathFullAuthRsa
+			if isTlsConn(p.clientConn) {
+				p.session.AuthPath = AuthPathFullAuthTls
+			}
+		}
+
+		serverResult.SequenceId = serverResult.SequenceId - p.serverSeqOffset + p.clientSeqOffset
+
+		_, err = p.clientConn.Write(serverResult.ToByte())
+		if err != nil {
+			return err
+		}
+
+		if isFinish {
+			p.logAuth(payload)
+			return nil
+		}
+
+		if waitServer {
+			continue
+		}
+
+		clientResult, err := ReadMysqlPacketLimit(p.clientConn, MaxPacketSize)
+		if err != nil {
+			return err
+		}
+
+		if len(payload) == 2 && payload[0] == AuthMoreDataPacket && payload[1] == CachingSha2FullAuth {
+			clientResult, err = p.cachingSha2FullAuth(serverConn, clientResult)
+			if err != nil {
+				return err
+			}
+		}
+
+		clientResult.SequenceId = clientResult.SequenceId - p.clientSeqOffset + p.serverSeqOffset
+
+		_, err = serverConn.Write(clientResult.ToByte())
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// cachingSha2FullAuth 服务端要求完整认证后, 按两边的ssl状态转换客户端发来的密码
+// 返回要发给服务端的包, 代理额外收发的包通过序列号偏移修正
+func (p *ProxyConn) cachingSha2FullAuth(serverConn net.Conn, clientResult *MysqlPacket) (*MysqlPacket, error) {
+	clientTls := isTlsConn(p.clientConn)
+	serverTls := isTlsConn(serverConn)
+
+	switch {
+	case clientTls && !serverTls:
+		// 客户端发来的是明文密码, 服务端需要用它的公钥加密
+		p.session.AuthPath = AuthPathProxyEncrypt
+
+		request := &MysqlPacket{Payload: []byte{cachingSha2RequestPublicKey}}
+		request.SequenceId = clientResult.LastSequenceId() - p.clientSeqOffset + p.serverSeqOffset
+
+		_, err := serverConn.Write(request.ToByte())
+		if err != nil {
+			return nil, err
+		}
+
+		keyResult, err := ReadMysqlPacket(serverConn)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(keyResult.Payload) == 0 || keyResult.Payload[0] != AuthMoreDataPacket {
+			return nil, fmt.Errorf("read server public key err: %+v", keyResult.Payload)
+		}
+
+		encrypted, err := encryptPassword(clientResult.Payload, p.scramble, keyResult.Payload[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		// 请求公钥和返回公钥各占一个服务端序列号
+		p.serverSeqOffset += 2
+
+		clientResult.Payload = encrypted
+
+	case !clientTls && serverTls:
+		// 服务端走ssl只接受明文密码, 客户端用代理的公钥加密后由代理解密
+		p.session.AuthPath = AuthPathProxyDecrypt
+
+		key, keyPem, err := getProxyRsaKey()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(clientResult.Payload) == 1 && clientResult.Payload[0] == cachingSha2RequestPublicKey {
+			keyResult := &MysqlPacket{Payload: append([]byte{AuthMoreDataPacket}, keyPem...)}
+			keyResult.SequenceId = clientResult.LastSequenceId() + 1
+
+			_, err = p.clientConn.Write(keyResult.ToByte())
+			if err != nil {
+				return nil, err
+			}
+
+			clientResult, err = ReadMysqlPacketLimit(p.clientConn, MaxPacketSize)
+			if err != nil {
+				return nil, err
+			}
+
+			p.clientSeqOffset += 2
+		}
+
+		password, err := decryptPassword(clientResult.Payload, p.scramble, key)
+		if err != nil {
+			return nil, err
+		}
+
+		clientResult.Payload = password
+	}
+
+	return clientResult, nil
+}
+
+func (p *ProxyConn) logAuth(payload []byte) {
+	msg := fmt.Sprintf("connection_id:%d user:%s plugin:%s path:%s", p.session.ConnectionId, p.session.User, p.session.AuthPlugin, p.session.AuthPath)
+	if p.session.BackendUser != "" {
+		msg += fmt.Sprintf(" backend_user:%s", p.session.BackendUser)
+	}
+
+	if payload[0] == ErrPacket {
+		zlog.Warnf("auth failed, %s", msg)
+		return
+	}
+
+	zlog.Infof("auth success, %s", msg)
+}
+
+// encryptPassword 明文密码(以0结尾)与scramble异或后用服务端公钥RSA-OAEP加密
+func encryptPassword(password []byte, scramble []byte, keyPem []byte) ([]byte, error) {
+	block, _ := pem.Decode(keyPem)
+	if block == nil {
+		return nil, fmt.Errorf("invalid server public key: %s", keyPem)
+	}
+
+	var pub *rsa.PublicKey
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err == nil {
+		var ok bool
+		pub, ok = key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("server public key is not rsa")
+		}
+	} else {
+		pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse server public key err: %w", err)
+		}
+	}
+
+	plain := make([]byte, len(password))
+	copy(plain, password)
+
+	if len(plain) == 0 || plain[len(plain)-1] != 0x00 {
+		plain = append(plain, 0x00)
+	}
+
+	xorScramble(plain, scramble)
+
+	return rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, plain, nil)
+}
+
+// decryptPassword encryptPassword的逆过程, 返回以0结尾的明文密码
+func decryptPassword(data []byte, scramble []byte, key *rsa.PrivateKey) ([]byte, error) {
+	plain, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, key, data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt client password err: %w", err)
+	}
+
+	xorScramble(plain, scramble)
+
+	return plain, nil
+}
+
+func xorScramble(data []byte, scramble []byte) {
+	if len(scramble) == 0 {
+		return
+	}
+
+	for i := range data {
+		data[i] ^= scramble[i%len(scramble)]
+	}
+}
@@ -0,0 +1,208 @@
+package mysqlserver
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"unicode/utf8"
+)
+
+// ReadBinaryValue 按二进制协议(Binary Protocol Value)从buf中读出一个值
+// 返回值可以直接交给 sqlbuilder.MySQL.Interpolate:
+// 整型/浮点按数值输出, 日期时间/DECIMAL按服务端文本格式输出, 无法作为utf8的二进制数据返回[]byte
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_binary_resultset.html
+func ReadBinaryValue(buf *bytes.Buffer, fieldType uint8, unsigned bool) (interface{}, error) {
+	switch fieldType {
+	case FieldTypeNULL:
+		return nil, nil
+
+	case FieldTypeTiny:
+		data, err := readBinaryN(buf, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		if unsigned {
+			return data[0], nil
+		}
+		return int8(data[0]), nil
+
+	case FieldTypeShort, FieldTypeYear:
+		data, err := readBinaryN(buf, 2)
+		if err != nil {
+			return nil, err
+		}
+
+		val := ReadUint16(data)
+		if unsigned || fieldType == FieldTypeYear {
+			return val, nil
+		}
+		return int16(val), nil
+
+	case FieldTypeInt24, FieldTypeLong:
+		data, err := readBinaryN(buf, 4)
+		if err != nil {
+			return nil, err
+		}
+
+		val := ReadUint32(data)
+		if unsigned {
+			return val, nil
+		}
+		return int32(val), nil
+
+	case FieldTypeLongLong:
+		data, err := readBinaryN(buf, 8)
+		if err != nil {
+			return nil, err
+		}
+
+		val := ReadUint64(data)
+		if unsigned {
+			return val, nil
+		}
+		return int64(val), nil
+
+	case FieldTypeFloat:
+		data, err := readBinaryN(buf, 4)
+		if err != nil {
+			return nil, err
+		}
+
+		return math.Float32frombits(ReadUint32(data)), nil
+
+	case FieldTypeDouble:
+		data, err := readBinaryN(buf, 8)
+		if err != nil {
+			return nil, err
+		}
+
+		return math.Float64frombits(ReadUint64(data)), nil
+
+	case FieldTypeDate, FieldTypeNewDate, FieldTypeDateTime, FieldTypeTimestamp:
+		return readBinaryDateTime(buf, fieldType)
+
+	case FieldTypeTime:
+		return readBinaryTime(buf)
+
+	default:
+		// DECIMAL, VARCHAR, BIT, ENUM, SET, BLOB, JSON, GEOMETRY 等都是 length encoded string
+		data, err := readBinaryLengthEncoded(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if utf8.Valid(data) {
+			return string(data), nil
+		}
+		return data, nil
+	}
+}
+
+// 长度为 0/4/7/11
+// year(2) month(1) day(1) hour(1) minute(1) second(1) microsecond(4)
+func readBinaryDateTime(buf *bytes.Buffer, fieldType uint8) (string, error) {
+	length, err := readBinaryN(buf, 1)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := readBinaryN(buf, int(length[0]))
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		year                 uint16
+		month, day           uint8
+		hour, minute, second uint8
+		microsecond          uint32
+	)
+
+	switch len(data) {
+	case 0:
+	case 4, 7, 11:
+		year = ReadUint16(data[:2])
+		month = data[2]
+		day = data[3]
+
+		if len(data) >= 7 {
+			hour, minute, second = data[4], data[5], data[6]
+		}
+
+		if len(data) == 11 {
+			microsecond = ReadUint32(data[7:11])
+		}
+	default:
+		return "", fmt.Errorf("invalid datetime length: %d", len(data))
+	}
+
+	date := fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+	if fieldType == FieldTypeDate || fieldType == FieldTypeNewDate {
+		return date, nil
+	}
+
+	res := fmt.Sprintf("%s %02d:%02d:%02d", date, hour, minute, second)
+	if microsecond > 0 {
+		res += fmt.Sprintf(".%06d", microsecond)
+	}
+
+	return res, nil
+}
+
+// 长度为 0/8/12
+// is_negative(1) days(4) hour(1) minute(1) second(1) microsecond(4)
+func readBinaryTime(buf *bytes.Buffer) (string, error) {
+	length, err := readBinaryN(buf, 1)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := readBinaryN(buf, int(length[0]))
+	if err != nil {
+		return "", err
+	}
+
+	switch len(data) {
+	case 0:
+		return "00:00:00", nil
+	case 8, 12:
+	default:
+		return "", fmt.Errorf("invalid time length: %d", len(data))
+	}
+
+	sign := ""
+	if data[0] == 1 {
+		sign = "-"
+	}
+
+	hours := ReadUint32(data[1:5])*24 + uint32(data[5])
+
+	res := fmt.Sprintf("%s%02d:%02d:%02d", sign, hours, data[6], data[7])
+	if len(data) == 12 {
+		if microsecond := ReadUint32(data[8:12]); microsecond > 0 {
+			res += fmt.Sprintf(".%06d", microsecond)
+		}
+	}
+
+	return res, nil
+}
+
+func readBinaryLengthEncoded(buf *bytes.Buffer) ([]byte, error) {
+	length, pos, ok := ReadLengthEncodedInt(buf.Bytes())
+	if !ok {
+		return nil, fmt.Errorf("read length encoded int err")
+	}
+
+	buf.Next(pos)
+
+	return readBinaryN(buf, int(length))
+}
+
+func readBinaryN(buf *bytes.Buffer, n int) ([]byte, error) {
+	if n < 0 || buf.Len() < n {
+		return nil, fmt.Errorf("need %d bytes but only %d left", n, buf.Len())
+	}
+
+	return buf.Next(n), nil
+}
@@ -0,0 +1,84 @@
+package mysqlserver
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestReadBinaryValue(t *testing.T) {
+	tests := []struct {
+		name      string
+		fieldType uint8
+		unsigned  bool
+		data      []byte
+		want      interface{}
+		wantErr   bool
+	}{
+		{"null", FieldTypeNULL, false, nil, nil, false},
+
+		{"tiny", FieldTypeTiny, false, []byte{0xff}, int8(-1), false},
+		{"tiny unsigned", FieldTypeTiny, true, []byte{0xff}, uint8(255), false},
+		{"short", FieldTypeShort, false, []byte{0xfe, 0xff}, int16(-2), false},
+		{"short unsigned", FieldTypeShort, true, []byte{0xfe, 0xff}, uint16(65534), false},
+		{"year", FieldTypeYear, false, []byte{0xe8, 0x07}, uint16(2024), false},
+		{"int24", FieldTypeInt24, false, []byte{0xff, 0xff, 0xff, 0xff}, int32(-1), false},
+		{"long", FieldTypeLong, false, []byte{0x00, 0x00, 0x00, 0x80}, int32(math.MinInt32), false},
+		{"long unsigned", FieldTypeLong, true, []byte{0xff, 0xff, 0xff, 0xff}, uint32(math.MaxUint32), false},
+		{"longlong", FieldTypeLongLong, false, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, int64(-1), false},
+		{"longlong unsigned", FieldTypeLongLong, true, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, uint64(math.MaxUint64), false},
+		{"long short", FieldTypeLong, false, []byte{0x01, 0x00}, nil, true},
+
+		{"float", FieldTypeFloat, false, []byte{0x00, 0x00, 0xc0, 0x3f}, float32(1.5), false},
+		{"double", FieldTypeDouble, false, []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf8, 0xbf}, float64(-1.5), false},
+
+		{"datetime length 0", FieldTypeDateTime, false, []byte{0x00}, "0000-00-00 00:00:00", false},
+		{"datetime length 4", FieldTypeDateTime, false, []byte{0x04, 0xe8, 0x07, 0x0a, 0x11}, "2024-10-17 00:00:00", false},
+		{"datetime length 7", FieldTypeDateTime, false, []byte{0x07, 0xe8, 0x07, 0x0a, 0x11, 0x0d, 0x2d, 0x05}, "2024-10-17 13:45:05", false},
+		{"datetime length 11", FieldTypeDateTime, false, []byte{0x0b, 0xe8, 0x07, 0x0a, 0x11, 0x0d, 0x2d, 0x05, 0x40, 0xe2, 0x01, 0x00}, "2024-10-17 13:45:05.123456", false},
+		{"timestamp length 11", FieldTypeTimestamp, false, []byte{0x0b, 0xe8, 0x07, 0x0a, 0x11, 0x0d, 0x2d, 0x05, 0x01, 0x00, 0x00, 0x00}, "2024-10-17 13:45:05.000001", false},
+		{"date length 4", FieldTypeDate, false, []byte{0x04, 0xe8, 0x07, 0x0a, 0x11}, "2024-10-17", false},
+		{"date length 0", FieldTypeDate, false, []byte{0x00}, "0000-00-00", false},
+		{"datetime invalid length", FieldTypeDateTime, false, []byte{0x05, 0xe8, 0x07, 0x0a, 0x11, 0x0d}, nil, true},
+		{"datetime truncated", FieldTypeDateTime, false, []byte{0x07, 0xe8, 0x07, 0x0a}, nil, true},
+
+		{"time length 0", FieldTypeTime, false, []byte{0x00}, "00:00:00", false},
+		{"time length 8", FieldTypeTime, false, []byte{0x08, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02, 0x03, 0x04}, "26:03:04", false},
+		{"time length 8 negative", FieldTypeTime, false, []byte{0x08, 0x01, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x1e, 0x00}, "-12:30:00", false},
+		{"time length 12", FieldTypeTime, false, []byte{0x0c, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x40, 0xe2, 0x01, 0x00}, "01:02:03.123456", false},
+		{"time length 12 negative", FieldTypeTime, false, []byte{0x0c, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00}, "-00:00:01.000001", false},
+		{"time length 12 negative days", FieldTypeTime, false, []byte{0x0c, 0x01, 0x22, 0x00, 0x00, 0x00, 0x16, 0x3b, 0x3b, 0x3f, 0x42, 0x0f, 0x00}, "-838:59:59.999999", false},
+		{"time invalid length", FieldTypeTime, false, []byte{0x05, 0x00, 0x00, 0x00, 0x00, 0x00}, nil, true},
+
+		{"string", FieldTypeVarString, false, []byte{0x03, 'a', 'b', 'c'}, "abc", false},
+		{"decimal", FieldTypeNewDecimal, false, []byte{0x05, '1', '2', '.', '5', '0'}, "12.50", false},
+		{"binary", FieldTypeBLOB, false, []byte{0x02, 0xff, 0xfe}, []byte{0xff, 0xfe}, false},
+		{"empty string", FieldTypeString, false, []byte{0x00}, "", false},
+		{"string truncated", FieldTypeVarString, false, []byte{0x05, 'a', 'b'}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 后面跟一个字节, 确认只读取了值本身
+			buf := bytes.NewBuffer(append(append([]byte{}, tt.data...), 0xaa))
+
+			got, err := ReadBinaryValue(buf, tt.fieldType, tt.unsigned)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadBinaryValue err = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadBinaryValue = %#v, want %#v", got, tt.want)
+			}
+
+			if !bytes.Equal(buf.Bytes(), []byte{0xaa}) {
+				t.Errorf("remaining = %v, want [170]", buf.Bytes())
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package mysqlserver
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ChangeUser COM_CHANGE_USER 中的用户信息
+type ChangeUser struct {
+	Username         string
+	Database         string
+	Charset          uint16
+	AuthPluginMethod string
+	// 客户端用握手时的scramble计算的认证数据
+	AuthResponse []byte
+}
+
+// ParseChangeUser 解析COM_CHANGE_USER
+// command(1) user(NUL) auth_response_len(1) auth_response database(NUL) [character_set(2)] [auth_plugin_name(NUL)] [connection_attributes]
+// 没有CLIENT_SECURE_CONNECTION时auth_response以NUL结尾
+func ParseChangeUser(payload []byte, capability uint32) (*ChangeUser, error) {
+	if len(payload) == 0 || payload[0] != ComChangeUser {
+		return nil, fmt.Errorf("invalid change user packet: %+v", payload)
+	}
+
+	buf := bytes.NewBuffer(payload[1:])
+
+	username, err := buf.ReadBytes(0x00)
+	if err != nil {
+		return nil, fmt.Errorf("read user err: %w", err)
+	}
+
+	res := &ChangeUser{
+		Username: ReadStringNull(username),
+	}
+
+	if capability&CapabilityClientSecureConnection > 0 {
+		length, err := readBinaryN(buf, 1)
+		if err != nil {
+			return nil, fmt.Errorf("read auth response err: %w", err)
+		}
+
+		authResponse, err := readBinaryN(buf, int(length[0]))
+		if err != nil {
+			return nil, fmt.Errorf("read auth response err: %w", err)
+		}
+		res.AuthResponse = authResponse
+	} else {
+		authResponse, err := buf.ReadBytes(0x00)
+		if err != nil {
+			return nil, fmt.Errorf("read auth response err: %w", err)
+		}
+		res.AuthResponse = authResponse[:len(authResponse)-1]
+	}
+
+	database, err := buf.ReadBytes(0x00)
+	if err != nil {
+		return nil, fmt.Errorf("read database err: %w", err)
+	}
+
+	res.Database = ReadStringNull(database)
+
+	if buf.Len() >= 2 {
+		res.Charset = ReadUint16(buf.Next(2))
+	}
+
+	if capability&CapabilityClientPluginAuth > 0 && buf.Len() > 0 {
+		plugin, err := buf.ReadBytes(0x00)
+		if err == nil {
+			res.AuthPluginMethod = ReadStringNull(plugin)
+		}
+	}
+
+	return res, nil
+}
+
+func setOptionName(option uint16) string {
+	switch option {
+	case MysqlOptionMultiStatementsOn:
+		return "MYSQL_OPTION_MULTI_STATEMENTS_ON"
+	case MysqlOptionMultiStatementsOff:
+		return "MYSQL_OPTION_MULTI_STATEMENTS_OFF"
+	}
+
+	return fmt.Sprintf("MYSQL_OPTION_UNKNOWN_%d", option)
+}
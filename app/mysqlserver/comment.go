@@ -0,0 +1,209 @@
+package mysqlserver
+
+import (
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"net/url"
+	"proxymysql/app/zlog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SqlCommentVersion 当前支持的注释版本, 注释里不带Version时按1处理
+const SqlCommentVersion = 1
+
+// SqlComment 业务方通过sql注释附带的请求信息
+// 后台格式: /* TzAdmin-{"Version":1,"AdminId":1,...}-TzAdmin */
+// sqlcommenter格式: /*admin_id='1',request_path='%2Fapi%2Fuser',route='...'*/
+type SqlComment struct {
+	Version       int
+	AdminId       int64
+	AdminName     string
+	AdminRealName string
+	QueryGameId   int32
+	HeaderGameId  int32
+	Ip            string
+	RequestPath   string
+	RequestInfo   string
+	UnixMilli     int64
+	Query         string
+	CallInfo      string
+	CreateTime    string
+	// sqlcommenter中没有对应字段的key
+	Tags map[string]string
+}
+
+// GetRequestInfo 没有RequestInfo时把其它tag序列化后保存
+func (sc *SqlComment) GetRequestInfo() string {
+	if sc.RequestInfo != "" || len(sc.Tags) == 0 {
+		return sc.RequestInfo
+	}
+
+	data, err := jsoniter.Marshal(sc.Tags)
+	if err != nil {
+		return ""
+	}
+
+	return string(data)
+}
+
+var (
+	adminCommentMarker = "TzAdmin"
+	adminCommentReg    = regexp.MustCompile(`/\*\s+TzAdmin-([\s\S]+)-TzAdmin\s+\*/`)
+
+	// https://google.github.io/sqlcommenter/spec/
+	sqlCommenterReg   = regexp.MustCompile(`/\*\s*([\w.\-]+='(?:[^'\\]|\\.)*'(?:\s*,\s*[\w.\-]+='(?:[^'\\]|\\.)*')*)\s*\*/`)
+	sqlCommenterKvReg = regexp.MustCompile(`([\w.\-]+)='((?:[^'\\]|\\.)*)'`)
+)
+
+// InitSqlComment 设置后台注释的标记, pattern不为空时直接使用pattern, 第一个分组为json内容
+func InitSqlComment(marker string, pattern string) error {
+	if pattern != "" {
+		reg, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+
+		if reg.NumSubexp() < 1 {
+			return fmt.Errorf("comment regex need a group for json: %s", pattern)
+		}
+
+		adminCommentMarker = ""
+		adminCommentReg = reg
+		return nil
+	}
+
+	if marker == "" {
+		return fmt.Errorf("comment marker is empty")
+	}
+
+	quoted := regexp.QuoteMeta(marker)
+	adminCommentMarker = marker
+	adminCommentReg = regexp.MustCompile(`/\*\s+` + quoted + `-([\s\S]+)-` + quoted + `\s+\*/`)
+
+	return nil
+}
+
+func (r *RecordQuery) parseSqlComment(query string) (sc *SqlComment) {
+	sc = &SqlComment{}
+	sc.Query = query
+	if sc.UnixMilli == 0 {
+		sc.UnixMilli = time.Now().UnixMilli()
+	}
+
+	sc.CreateTime = time.Now().Format("2006-01-02 15:04:05.000")
+
+	if !strings.Contains(query, "/*") {
+		return
+	}
+
+	if adminCommentMarker == "" || strings.Contains(query, adminCommentMarker+"-") {
+		if r.parseAdminComment(sc) {
+			return
+		}
+	}
+
+	r.parseSqlCommenter(sc)
+
+	return
+}
+
+func (r *RecordQuery) parseAdminComment(sc *SqlComment) bool {
+	subMatch := adminCommentReg.FindStringSubmatch(sc.Query)
+
+	if len(subMatch) < 2 {
+		return false
+	}
+
+	query := sc.Query
+
+	err := jsoniter.Unmarshal([]byte(subMatch[1]), sc)
+	if err != nil {
+		zlog.Warnf("解析sql admin信息失败 %s [%s]", err, subMatch[1])
+		return false
+	}
+
+	if sc.Version == 0 {
+		sc.Version = 1
+	}
+
+	if sc.Version > SqlCommentVersion {
+		zlog.Warnf("sql admin信息版本 %d 高于当前支持的版本 %d, 只解析已知字段", sc.Version, SqlCommentVersion)
+	}
+
+	_sql := strings.TrimSpace(adminCommentReg.ReplaceAllString(query, ""))
+	sc.Query = _sql
+	//zlog.Infof("%+v\n", sc)
+
+	return true
+}
+
+func (r *RecordQuery) parseSqlCommenter(sc *SqlComment) bool {
+	subMatch := sqlCommenterReg.FindStringSubmatch(sc.Query)
+
+	if len(subMatch) < 2 {
+		return false
+	}
+
+	for _, kv := range sqlCommenterKvReg.FindAllStringSubmatch(subMatch[1], -1) {
+		key, err := url.QueryUnescape(kv[1])
+		if err != nil {
+			key = kv[1]
+		}
+
+		// 值中的 ' 会被转义成 \'
+		value, err := url.QueryUnescape(strings.ReplaceAll(kv[2], `\'`, `'`))
+		if err != nil {
+			value = kv[2]
+		}
+
+		sc.setSqlCommenterTag(key, value)
+	}
+
+	if sc.Version == 0 {
+		sc.Version = 1
+	}
+
+	sc.Query = strings.TrimSpace(sqlCommenterReg.ReplaceAllString(sc.Query, ""))
+
+	return true
+}
+
+func (sc *SqlComment) setSqlCommenterTag(key string, value string) {
+	switch key {
+	case "version":
+		sc.Version, _ = strconv.Atoi(value)
+	case "admin_id":
+		sc.AdminId, _ = strconv.ParseInt(value, 10, 64)
+	case "admin_name":
+		sc.AdminName = value
+	case "admin_real_name":
+		sc.AdminRealName = value
+	case "query_game_id":
+		id, _ := strconv.ParseInt(value, 10, 32)
+		sc.QueryGameId = int32(id)
+	case "header_game_id":
+		id, _ := strconv.ParseInt(value, 10, 32)
+		sc.HeaderGameId = int32(id)
+	case "ip":
+		sc.Ip = value
+	case "request_path":
+		sc.RequestPath = value
+	case "request_info":
+		sc.RequestInfo = value
+	case "call_info":
+		sc.CallInfo = value
+	default:
+		if sc.Tags == nil {
+			sc.Tags = make(map[string]string)
+		}
+		sc.Tags[key] = value
+
+		// sqlcommenter 标准字段 route 等同于请求路径
+		if key == "route" && sc.RequestPath == "" {
+			sc.RequestPath = value
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package mysqlserver
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net"
+	"sync"
+)
+
+// 压缩算法
+const (
+	CompressNone = "none"
+	CompressZlib = "zlib"
+	CompressZstd = "zstd"
+)
+
+const (
+	// 压缩包头 compressed_length(3) compressed_sequence_id(1) uncompressed_length(3)
+	compressedHeaderSize = 7
+
+	// 小于这个长度的数据不压缩, 与mysql的MIN_COMPRESS_LENGTH一致
+	minCompressLength = 50
+
+	// DefaultZstdLevel 与mysql的zstd_compression_level默认值一致
+	DefaultZstdLevel = 3
+)
+
+var (
+	// 是否允许客户端与代理之间使用压缩
+	clientCompress bool
+	// 代理与服务端之间使用的压缩算法
+	serverCompress  = CompressNone
+	serverZstdLevel = DefaultZstdLevel
+)
+
+// InitCompress 客户端一侧和服务端一侧的压缩分别协商
+func InitCompress(allowClient bool, server string, zstdLevel int) error {
+	switch server {
+	case "", CompressNone:
+		server = CompressNone
+	case CompressZlib, CompressZstd:
+	default:
+		return fmt.Errorf("unsupported compress algorithm: %s", server)
+	}
+
+	if zstdLevel < 1 || zstdLevel > 22 {
+		return fmt.Errorf("zstd level must between 1 and 22: %d", zstdLevel)
+	}
+
+	clientCompress = allowClient
+	serverCompress = server
+	serverZstdLevel = zstdLevel
+
+	return nil
+}
+
+// negotiateCompress 根据capability确定使用的压缩算法
+func negotiateCompress(capability uint32) string {
+	if capability&CapabilityClientZstdCompressionAlgorithm > 0 {
+		return CompressZstd
+	}
+
+	if capability&CapabilityClientCanUseCompress > 0 {
+		return CompressZlib
+	}
+
+	return CompressNone
+}
+
+// setServerCompress 转发给服务端前按服务端一侧的配置重新设置压缩标记
+func setServerCompress(resp *HandshakeResponse, serverCapability uint32) {
+	resp.ClientFlag &^= CapabilityClientCanUseCompress | CapabilityClientZstdCompressionAlgorithm
+	resp.ZstdCompressionLevel = 0
+
+	switch serverCompress {
+	case CompressZstd:
+		if serverCapability&CapabilityClientZstdCompressionAlgorithm > 0 {
+			resp.ClientFlag |= CapabilityClientZstdCompressionAlgorithm
+			resp.ZstdCompressionLevel = uint8(serverZstdLevel)
+			return
+		}
+
+		// 服务端不支持zstd时退回zlib
+		fallthrough
+
+	case CompressZlib:
+		if serverCapability&CapabilityClientCanUseCompress > 0 {
+			resp.ClientFlag |= CapabilityClientCanUseCompress
+		}
+	}
+}
+
+// CompressConn 压缩协议的读写, Read返回解压后的mysql包, Write把mysql包压缩后发送
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_basic_compression.html
+type CompressConn struct {
+	net.Conn
+
+	algorithm string
+
+	zlibWriter  *zlib.Writer
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+
+	// 已解压未读取的数据
+	readBuf bytes.Buffer
+
+	mu sync.Mutex
+	// 压缩包的序列号, 与mysql包的序列号独立, 每条新命令从0开始
+	sequenceId uint8
+	// 上一次操作是否是读
+	lastRead bool
+	// 上一个写入的mysql包的序列号, 序列号从255回绕到0时不是新命令
+	lastWriteSeq uint8
+	// 当前写入的mysql包还剩余的长度
+	writeRemain int
+	// 跨Write调用的不完整包头
+	writeHeader []byte
+}
+
+func NewCompressConn(conn net.Conn, algorithm string, zstdLevel int) (*CompressConn, error) {
+	c := &CompressConn{
+		Conn:      conn,
+		algorithm: algorithm,
+		lastRead:  true,
+	}
+
+	switch algorithm {
+	case CompressZlib:
+		c.zlibWriter = zlib.NewWriter(nil)
+
+	case CompressZstd:
+		var err error
+		c.zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(zstdLevel)))
+		if err != nil {
+			return nil, err
+		}
+
+		// 只使用DecodeAll, 不会启动后台goroutine, 不需要Close
+		c.zstdDecoder, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported compress algorithm: %s", algorithm)
+	}
+
+	return c, nil
+}
+
+func (c *CompressConn) Read(p []byte) (int, error) {
+	if c.readBuf.Len() == 0 {
+		err := c.readCompressedPacket()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return c.readBuf.Read(p)
+}
+
+func (c *CompressConn) readCompressedPacket() error {
+	header := make([]byte, compressedHeaderSize)
+
+	_, err := io.ReadFull(c.Conn, header)
+	if err != nil {
+		return err
+	}
+
+	compressedLength := ReadUint24(header[:3])
+	uncompressedLength := ReadUint24(header[4:7])
+
+	payload := make([]byte, compressedLength)
+
+	_, err = io.ReadFull(c.Conn, payload)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.sequenceId = header[3] + 1
+	c.lastRead = true
+	c.mu.Unlock()
+
+	// uncompressed_length为0表示没有压缩
+	if uncompressedLength == 0 {
+		c.readBuf.Write(payload)
+		return nil
+	}
+
+	data, err := c.decompress(payload, int(uncompressedLength))
+	if err != nil {
+		return err
+	}
+
+	if len(data) != int(uncompressedLength) {
+		return fmt.Errorf("uncompressed length mismatch: %d != %d", len(data), uncompressedLength)
+	}
+
+	c.readBuf.Write(data)
+
+	return nil
+}
+
+func (c *CompressConn) decompress(payload []byte, uncompressedLength int) ([]byte, error) {
+	if c.algorithm == CompressZstd {
+		return c.zstdDecoder.DecodeAll(payload, make([]byte, 0, uncompressedLength))
+	}
+
+	reader, err := zlib.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data := make([]byte, uncompressedLength)
+
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (c *CompressConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// 每条新命令的压缩包序列号从0开始, 新命令之前的数据单独压缩
+	starts := c.trackPacket(p)
+
+	written := 0
+	for k := 0; k <= len(starts); k++ {
+		end := len(p)
+		if k < len(starts) {
+			end = starts[k]
+		}
+
+		for written < end {
+			chunkEnd := written + MaxPacketSize
+			if chunkEnd > end {
+				chunkEnd = end
+			}
+
+			err := c.writeCompressedPacket(p[written:chunkEnd])
+			if err != nil {
+				return written, err
+			}
+
+			written = chunkEnd
+		}
+
+		if k < len(starts) {
+			c.sequenceId = 0
+		}
+	}
+
+	return written, nil
+}
+
+// trackPacket 记录写入数据中mysql包的边界, 返回p中新命令开始的位置
+// 序列号为0的包是新命令, 除非是上一个包序列号255之后的回绕(大结果集 LOAD DATA的文件内容),
+// 不论之前是读还是写, 如COM_STMT_CLOSE没有响应, 下一条命令紧接着写入
+func (c *CompressConn) trackPacket(p []byte) []int {
+	var starts []int
+
+	for i := 0; i < len(p); {
+		if c.writeRemain > 0 {
+			n := c.writeRemain
+			if n > len(p)-i {
+				n = len(p) - i
+			}
+
+			c.writeRemain -= n
+			i += n
+			continue
+		}
+
+		headerStart := i - len(c.writeHeader)
+
+		n := 4 - len(c.writeHeader)
+		if n > len(p)-i {
+			n = len(p) - i
+		}
+
+		c.writeHeader = append(c.writeHeader, p[i:i+n]...)
+		i += n
+
+		if len(c.writeHeader) < 4 {
+			continue
+		}
+
+		seq := c.writeHeader[3]
+
+		if seq == 0 && (c.lastRead || c.lastWriteSeq != 255) {
+			if headerStart > 0 {
+				starts = append(starts, headerStart)
+			} else {
+				// 包头在本次Write开头(或跨越了两次Write, 已经发送的部分无法再拆分)
+				c.sequenceId = 0
+			}
+		}
+
+		c.lastRead = false
+		c.lastWriteSeq = seq
+		c.writeRemain = int(ReadUint24(c.writeHeader[:3]))
+		c.writeHeader = c.writeHeader[:0]
+	}
+
+	return starts
+}
+
+func (c *CompressConn) writeCompressedPacket(data []byte) error {
+	payload := data
+	uncompressedLength := 0
+
+	if len(data) >= minCompressLength {
+		compressed, err := c.compress(data)
+		if err != nil {
+			return err
+		}
+
+		// 压缩后更大时直接发送原始数据
+		if len(compressed) < len(data) {
+			payload = compressed
+			uncompressedLength = len(data)
+		}
+	}
+
+	packet := make([]byte, 0, compressedHeaderSize+len(payload))
+	packet = append(packet, WriteUint24(uint32(len(payload)))...)
+	packet = append(packet, c.sequenceId)
+	packet = append(packet, WriteUint24(uint32(uncompressedLength))...)
+	packet = append(packet, payload...)
+
+	c.sequenceId++
+
+	_, err := c.Conn.Write(packet)
+
+	return err
+}
+
+func (c *CompressConn) compress(data []byte) ([]byte, error) {
+	if c.algorithm == CompressZstd {
+		return c.zstdEncoder.EncodeAll(data, nil), nil
+	}
+
+	buf := &bytes.Buffer{}
+	c.zlibWriter.Reset(buf)
+
+	_, err := c.zlibWriter.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.zlibWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,171 @@
+package mysqlserver
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+// bufferConn 读写都在内存里的连接
+type bufferConn struct {
+	net.Conn
+	in  bytes.Buffer
+	out bytes.Buffer
+}
+
+func (c *bufferConn) Read(p []byte) (int, error) {
+	return c.in.Read(p)
+}
+
+func (c *bufferConn) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+// compressedSequenceIds 返回压缩包的序列号
+func compressedSequenceIds(t *testing.T, data []byte) []uint8 {
+	t.Helper()
+
+	var res []uint8
+	for len(data) > 0 {
+		if len(data) < compressedHeaderSize {
+			t.Fatalf("short compressed header: %d", len(data))
+		}
+
+		length := int(ReadUint24(data[:3]))
+		res = append(res, data[3])
+		data = data[compressedHeaderSize+length:]
+	}
+
+	return res
+}
+
+func newTestCompressConn(t *testing.T, algorithm string) (*CompressConn, *bufferConn) {
+	t.Helper()
+
+	raw := &bufferConn{}
+
+	c, err := NewCompressConn(raw, algorithm, 3)
+	if err != nil {
+		t.Fatalf("new compress conn: %s", err)
+	}
+
+	return c, raw
+}
+
+// readBack 用另一个CompressConn解压写入的数据, 返回其中的mysql包
+func readBack(t *testing.T, algorithm string, data []byte) []*MysqlPacket {
+	t.Helper()
+
+	reader, raw := newTestCompressConn(t, algorithm)
+	raw.in.Write(data)
+
+	var res []*MysqlPacket
+	for raw.in.Len() > 0 || reader.readBuf.Len() > 0 {
+		packet, err := ReadMysqlPacket(reader)
+		if err != nil {
+			t.Fatalf("read packet: %s", err)
+		}
+
+		res = append(res, packet)
+	}
+
+	return res
+}
+
+func TestCompressConnCommandSequence(t *testing.T) {
+	stmtClose := WithHeaderPacket([]byte{ComStmtClose, 1, 0, 0, 0}, 0)
+	query := WithHeaderPacket(append([]byte{ComQuery}, "select "+strings.Repeat("a, ", 40)+"1"...), 0)
+
+	tests := []struct {
+		name   string
+		writes [][]byte
+	}{
+		{"separate writes", [][]byte{stmtClose, query}},
+		{"one write", [][]byte{append(append([]byte{}, stmtClose...), query...)}},
+		{"two queries", [][]byte{query, query}},
+	}
+
+	for _, algorithm := range []string{CompressZlib, CompressZstd} {
+		for _, tt := range tests {
+			t.Run(algorithm+" "+tt.name, func(t *testing.T) {
+				c, raw := newTestCompressConn(t, algorithm)
+
+				var want [][]byte
+				for _, data := range tt.writes {
+					if _, err := c.Write(data); err != nil {
+						t.Fatalf("write: %s", err)
+					}
+
+					for len(data) > 0 {
+						length := 4 + int(ReadUint24(data[:3]))
+						want = append(want, data[:length])
+						data = data[length:]
+					}
+				}
+
+				// 没有响应的命令之后, 下一条命令的压缩序列号也要从0开始
+				seqs := compressedSequenceIds(t, raw.out.Bytes())
+				if len(seqs) != 2 || seqs[0] != 0 || seqs[1] != 0 {
+					t.Errorf("compressed sequence = %v, want [0 0]", seqs)
+				}
+
+				packets := readBack(t, algorithm, raw.out.Bytes())
+				if len(packets) != len(want) {
+					t.Fatalf("read %d packets, want %d", len(packets), len(want))
+				}
+
+				for i, packet := range packets {
+					if !bytes.Equal(packet.ToByte(), want[i]) {
+						t.Errorf("packet %d = %v, want %v", i, packet.ToByte(), want[i])
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestCompressConnResponseSequence(t *testing.T) {
+	for _, algorithm := range []string{CompressZlib, CompressZstd} {
+		t.Run(algorithm, func(t *testing.T) {
+			c, raw := newTestCompressConn(t, algorithm)
+
+			// 客户端发来压缩序列号为5的命令, 响应的压缩序列号从6开始
+			raw.in.Write([]byte{5, 0, 0, 5, 0, 0, 0})
+			raw.in.Write(WithHeaderPacket([]byte{ComPing}, 0))
+
+			if _, err := ReadMysqlPacket(c); err != nil {
+				t.Fatalf("read command: %s", err)
+			}
+
+			// 超过255个包的响应, mysql序列号回绕到0不是新命令
+			var want [][]byte
+			for i := 1; i <= 300; i++ {
+				packet := WithHeaderPacket([]byte("row "+strings.Repeat("x", i%80)), uint8(i))
+				want = append(want, packet)
+
+				if _, err := c.Write(packet); err != nil {
+					t.Fatalf("write: %s", err)
+				}
+			}
+
+			seqs := compressedSequenceIds(t, raw.out.Bytes())
+			for i, seq := range seqs {
+				if seq != uint8(6+i) {
+					t.Fatalf("compressed sequence %d = %d, want %d", i, seq, uint8(6+i))
+				}
+			}
+
+			packets := readBack(t, algorithm, raw.out.Bytes())
+			if len(packets) != len(want) {
+				t.Fatalf("read %d packets, want %d", len(packets), len(want))
+			}
+
+			for i, packet := range packets {
+				if !bytes.Equal(packet.ToByte(), want[i]) {
+					t.Errorf("packet %d = %v, want %v", i, packet.ToByte(), want[i])
+				}
+			}
+		})
+	}
+}
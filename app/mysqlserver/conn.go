@@ -1,9 +1,8 @@
 package mysqlserver
 
 import (
-	"io"
+	"fmt"
 	"net"
-	"proxymysql/app/conf"
 	"proxymysql/app/zlog"
 	"sync"
 	"sync/atomic"
@@ -25,25 +24,34 @@ type MysqlPacket struct {
 	Payload []byte
 }
 
+// ToByte 超过MaxPacketSize的payload会拆成多个包, 序列号依次递增
 func (pd *MysqlPacket) ToByte() []byte {
-	res := make([]byte, len(pd.Payload)+4)
-
-	copy(res[:3], WriteUint24(pd.Length))
-	res[3] = pd.SequenceId
-
-	copy(res[4:], pd.Payload)
+	return WithHeaderPacket(pd.Payload, pd.SequenceId)
+}
 
-	return res
+// LastSequenceId 逻辑包拆分后最后一个包的序列号, 对端的下一个包从它加1开始
+func (pd *MysqlPacket) LastSequenceId() uint8 {
+	return pd.SequenceId + uint8(len(pd.Payload)/MaxPacketSize)
 }
 
 type ProxyConn struct {
 	clientConn net.Conn
 	serverConn net.Conn
-	dirPath    string
+	listener   *Listener
+	backend    *Backend
+	session    *Session
+	// 使用ssl时SSLRequest多占用了一个序列号, 认证阶段转发时需要修正
+	clientSeqOffset uint8
+	serverSeqOffset uint8
+	// 当前认证插件使用的scramble, caching_sha2_password 加解密密码时使用
+	scramble []byte
+	// 代理认证的用户和发给主库的HandshakeResponse, 读写分离和连接池用来登录新的连接
+	proxyUser  *ProxyUser
+	serverResp *HandshakeResponse
 }
 
-func NewProxyConn(clientConn net.Conn, dirPath string) *ProxyConn {
-	return &ProxyConn{clientConn: clientConn, dirPath: dirPath}
+func NewProxyConn(clientConn net.Conn, listener *Listener) *ProxyConn {
+	return &ProxyConn{clientConn: clientConn, listener: listener, backend: listener.backend}
 }
 
 func (p *ProxyConn) getConnectionId() uint32 {
@@ -69,32 +77,129 @@ func (p *ProxyConn) Handle() error {
 		return err
 	}
 
+	serverCapability := hk.CapabilityFlag
+	serverAuthPlugin := hk.AuthPluginMethod
+	p.scramble = hk.AuthPluginData[:20]
+
+	// 代理认证时客户端使用代理生成的scramble
+	if proxyAuthEnabled() {
+		hk.AuthPluginData = GetAuthPluginData()
+	}
+
 	hk.ConnectionId = p.getConnectionId()
 	hk.ServerVersion = serverVersion
-	// 暂时去掉ssl
-	hk.CapabilityFlag &^= uint32(CapabilityClientSSL)
+	// 代理配置了证书时由代理终止客户端的ssl
+	if clientTlsConfig != nil {
+		hk.CapabilityFlag |= uint32(CapabilityClientSSL)
+	} else {
+		hk.CapabilityFlag &^= uint32(CapabilityClientSSL)
+	}
 
-	// 去掉压缩
-	hk.CapabilityFlag &^= uint32(CapabilityClientCanUseCompress)
+	// 客户端一侧的压缩由代理处理, 与服务端一侧分开协商
+	hk.CapabilityFlag &^= uint32(CapabilityClientCanUseCompress | CapabilityClientZstdCompressionAlgorithm)
+	if clientCompress {
+		hk.CapabilityFlag |= uint32(CapabilityClientCanUseCompress | CapabilityClientZstdCompressionAlgorithm)
+	}
 
 	_, err = p.clientConn.Write(hk.ToByte())
 	if err != nil {
 		return err
 	}
 
-	resp, err := ReadHandshakeResponse(p.clientConn)
+	pk, err := ReadMysqlPacketLimit(p.clientConn, MaxPacketSize)
+	if err != nil {
+		return err
+	}
+
+	if IsSslRequest(pk) {
+		err = p.upgradeClientTls()
+		if err != nil {
+			return err
+		}
+
+		p.clientSeqOffset = 1
+
+		pk, err = ReadMysqlPacketLimit(p.clientConn, MaxPacketSize)
+		if err != nil {
+			return err
+		}
+	} else if requireSecureTransport {
+		errPacket := NewErrPacket(ErSecureTransportRequired, "HY000",
+			"Connections using insecure transport are prohibited while --require_secure_transport=ON.")
+		_, _ = p.clientConn.Write(errPacket.ToByte(pk.LastSequenceId() + 1))
+
+		return fmt.Errorf("reject insecure client: %s", p.clientConn.RemoteAddr())
+	}
+
+	resp, err := ParseHandshakeResponse(pk)
+	if err != nil {
+		return err
+	}
+
+	p.session = NewSession(hk.ConnectionId, p.clientConn.RemoteAddr().String(), resp, hk.CapabilityFlag)
+
+	// 按用户名和库路由到其他后端时改连该后端
+	if backend := p.listener.route(resp); backend != p.listener.backend {
+		serverHk, err := p.switchBackend(backend, resp)
+		if err != nil {
+			return err
+		}
+
+		serverCapability = serverHk.CapabilityFlag
+		serverAuthPlugin = serverHk.AuthPluginMethod
+	}
+
+	p.session.Backend = p.backend.Name
+
+	var (
+		proxyUser *ProxyUser
+		clientSeq uint8
+	)
+
+	if proxyAuthEnabled() {
+		proxyUser, clientSeq, err = p.authenticateClient(resp, hk.AuthPluginData[:20])
+		if err != nil {
+			return err
+		}
+
+		proxyUser.mapHandshakeResponse(resp, serverAuthPlugin, p.scramble)
+	}
+
+	// 代理到服务端这一段不使用客户端的ssl
+	resp.ClientFlag &^= CapabilityClientSSL
+	if proxyUser == nil {
+		resp.SequenceId -= p.clientSeqOffset
+	}
+
+	clientZstdLevel := int(resp.ZstdCompressionLevel)
+	setServerCompress(resp, serverCapability)
+
+	err = p.upgradeServerTls(p.backend.Addr, serverCapability, resp)
 	if err != nil {
 		return err
 	}
 
 	respByte := resp.ToByte()
 
-	_, err = serverConn.Write(respByte)
+	_, err = p.serverConn.Write(respByte)
+	if err != nil {
+		return err
+	}
+
+	p.proxyUser = proxyUser
+	p.serverResp = resp
+
+	if proxyUser != nil {
+		err = p.authenticateBackend(proxyUser, clientSeq)
+	} else {
+		err = p.authSwitch(p.serverConn)
+	}
 	if err != nil {
 		return err
 	}
 
-	err = p.authSwitch(p.serverConn)
+	// 认证完成后两边开始使用压缩协议
+	err = p.enableCompress(p.session.Capability, clientZstdLevel, resp.ClientFlag)
 	if err != nil {
 		return err
 	}
@@ -105,6 +210,25 @@ func (p *ProxyConn) Handle() error {
 }
 
 func (p *ProxyConn) copyStream() {
+	rq := NewRecordQuery(p.session, p.backend.dirPath)
+
+	// 代理认证(拦截COM_CHANGE_USER) 读写分离 连接池 防火墙 只读监听和结果集脱敏需要按命令转发
+	if p.proxyUser != nil || backendPool != nil || firewall != nil || p.listener.ReadOnly || resultMasker != nil {
+		err := p.commandLoop(rq)
+		if err != nil {
+			zlog.Errorf("command loop err: %s", err)
+		}
+
+		p.clientConn.Close()
+		// 连接池模式下登录的连接已经交给连接池
+		if backendPool == nil {
+			p.serverConn.Close()
+		}
+		rq.Close()
+
+		return
+	}
+
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
 
@@ -114,7 +238,7 @@ func (p *ProxyConn) copyStream() {
 			p.serverConn.Close()
 			wg.Done()
 		}()
-		_, err := io.Copy(p.clientConn, p.serverConn)
+		err := ForwardMysqlPacket(p.clientConn, p.serverConn, rq.ReadServerPacket)
 		if err != nil {
 			zlog.Errorf("serverConn -> clientConn err: %s", err)
 			//errMsg := err.Error()
@@ -125,17 +249,13 @@ func (p *ProxyConn) copyStream() {
 	}()
 
 	go func() {
-		rq := NewRecordQuery(p.clientConn.RemoteAddr().String(), p.dirPath)
-
 		defer func() {
 			p.clientConn.Close()
 			p.serverConn.Close()
-			rq.Close()
 			wg.Done()
 		}()
 
-		_, err := io.Copy(p.serverConn, io.TeeReader(p.clientConn, rq))
-
+		err := ForwardMysqlPacket(p.serverConn, p.clientConn, rq.ReadClientPacket)
 		if err != nil {
 			zlog.Errorf("clientConn -> serverConn err: %s", err)
 			//errMsg := err.Error()
@@ -147,50 +267,44 @@ func (p *ProxyConn) copyStream() {
 	}()
 
 	wg.Wait()
+	rq.Close()
 
 	zlog.Debug("copy stream stop")
 
 }
 
-func (p *ProxyConn) authSwitch(serverConn net.Conn) error {
-	var isFinish bool
-
-	for {
-		serverResult, err := ReadMysqlPacket(serverConn)
-		if err != nil {
-			return err
-		}
-
-		//fmt.Printf("serverResult: %+v\n", serverResult)
-
-		if len(serverResult.Payload) > 0 && (serverResult.Payload[0] == OKPacket || serverResult.Payload[0] == ErrPacket) {
-			//fmt.Println("ok ----")
-			isFinish = true
-			//return nil
-		}
-
-		_, err = p.clientConn.Write(serverResult.ToByte())
+func (p *ProxyConn) enableCompress(clientCapability uint32, clientZstdLevel int, serverCapability uint32) error {
+	if algorithm := negotiateCompress(clientCapability); algorithm != CompressNone {
+		conn, err := NewCompressConn(p.clientConn, algorithm, clientZstdLevel)
 		if err != nil {
 			return err
 		}
 
-		if isFinish {
-			return nil
-		}
+		p.clientConn = conn
+		zlog.Debugf("client compress: %s", algorithm)
+	}
 
-		clientResult, err := ReadMysqlPacket(p.clientConn)
+	if algorithm := negotiateCompress(serverCapability); algorithm != CompressNone {
+		conn, err := NewCompressConn(p.serverConn, algorithm, serverZstdLevel)
 		if err != nil {
 			return err
 		}
 
-		_, err = serverConn.Write(clientResult.ToByte())
-		if err != nil {
-			return err
-		}
+		p.serverConn = conn
+		zlog.Debugf("server compress: %s", algorithm)
 	}
 
+	return nil
 }
 
+// getServerConn 后端不可用时连接故障转移的后端, p.backend 改为实际连上的后端
 func (p *ProxyConn) getServerConn() (net.Conn, error) {
-	return net.Dial("tcp", conf.App.RemoteDb)
+	backend, conn, err := dialFailover(p.backend)
+	if err != nil {
+		return nil, err
+	}
+
+	p.backend = backend
+
+	return conn, nil
 }
@@ -77,7 +77,7 @@ const (
 	// Do not permit database.table.column. We do permit it.
 
 	CapabilityClientCanUseCompress = 1 << 5
-	// We do not support compression. CPU is usually our bottleneck.
+	// Compression is negotiated separately for the client and the server side.
 
 	// CLIENT_ODBC 1 << 6
 	// No special behavior since 3.22.
@@ -149,6 +149,10 @@ const (
 	// Expects an OK (instead of EOF) after the resultset rows of a Text Resultset.
 	CapabilityClientDeprecateEOF = 1 << 24
 
+	// CapabilityClientZstdCompressionAlgorithm is CLIENT_ZSTD_COMPRESSION_ALGORITHM
+	// Compression protocol extended to support zstd compression method.
+	CapabilityClientZstdCompressionAlgorithm = 1 << 26
+
 	CapabilityClientQueryAttributes = 1 << 27
 )
 
@@ -211,6 +215,9 @@ const (
 	// ComPing is COM_PING.
 	ComPing = 0x0e
 
+	// ComChangeUser is COM_CHANGE_USER.
+	ComChangeUser = 0x11
+
 	// ComBinlogDump is COM_BINLOG_DUMP.
 	ComBinlogDump = 0x12
 
@@ -261,6 +268,24 @@ const (
 	NullValue = 0xfb
 )
 
+// COM_STMT_EXECUTE flags
+const (
+	CursorTypeNoCursor   uint8 = 0x00
+	CursorTypeReadOnly   uint8 = 0x01
+	CursorTypeForUpdate  uint8 = 0x02
+	CursorTypeScrollable uint8 = 0x04
+
+	// ParameterCountAvailable parameter_count is sent even if the statement has no parameters.
+	// Only used with CLIENT_QUERY_ATTRIBUTES.
+	ParameterCountAvailable uint8 = 0x08
+)
+
+// COM_SET_OPTION options
+const (
+	MysqlOptionMultiStatementsOn  uint16 = 0
+	MysqlOptionMultiStatementsOff uint16 = 1
+)
+
 // Auth packet types
 const (
 	// AuthMoreDataPacket is sent when server requires more data to authenticate
@@ -0,0 +1,326 @@
+package mysqlserver
+
+import (
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"net"
+	"os"
+	"proxymysql/app/zlog"
+	"regexp"
+	"strings"
+)
+
+// 防火墙规则的动作
+const (
+	FirewallAllow = "allow"
+	// 只记录日志, 照常转发
+	FirewallLog    = "log"
+	FirewallReject = "reject"
+)
+
+// 规则中的语句类型, 其余语句类型使用语句开头的关键字, 如 drop truncate alter
+const (
+	StatementDeleteWithoutWhere = "delete_without_where"
+	StatementUpdateWithoutWhere = "update_without_where"
+)
+
+// ErSpecificAccessDenied ER_SPECIFIC_ACCESS_DENIED_ERROR, 防火墙拒绝语句时返回给客户端
+const ErSpecificAccessDenied = 1227
+
+const firewallIdent = "(?:`[^`]*`|[a-z0-9_$]+)"
+
+var (
+	// 语句中的表名, 只识别常见的写法
+	tableNameReg = regexp.MustCompile(`\b(?:from|join|into|update|truncate(?:\s+table)?|table(?:\s+if(?:\s+not)?\s+exists)?)\s+(` +
+		firewallIdent + `(?:\s*\.\s*` + firewallIdent + `)?)`)
+	whereReg = regexp.MustCompile(`\bwhere\b`)
+)
+
+// 为nil时不启用防火墙
+var firewall *Firewall
+
+// FirewallRule 条件都满足时规则匹配, 为空的条件不参与匹配
+type FirewallRule struct {
+	Name string `json:"name"`
+	User string `json:"user"`
+	// ip 或 cidr
+	ClientIp string `json:"client_ip"`
+	Schema   string `json:"schema"`
+	// 语句类型, 满足任意一个即可
+	Statements []string `json:"statements"`
+	// 表名 table 或 db.table, 语句中出现任意一个即可
+	Tables []string `json:"tables"`
+	// 匹配原始语句
+	Regex  string `json:"regex"`
+	Action string `json:"action"`
+	// 拒绝时返回给客户端的错误信息
+	Message string `json:"message"`
+
+	clientNet *net.IPNet
+	regex     *regexp.Regexp
+}
+
+// Firewall 防火墙规则文件, 对每条语句按顺序匹配规则, 都不匹配时使用DefaultAction
+//
+//	{
+//	  "default_action": "allow",
+//	  "rules": [
+//	    {"name": "no-ddl", "user": "app", "statements": ["drop", "truncate", "alter"], "action": "reject"},
+//	    {"name": "full-table-write", "statements": ["delete_without_where", "update_without_where"], "action": "reject"},
+//	    {"name": "salary", "tables": ["hr.salary"], "action": "log"}
+//	  ]
+//	}
+type Firewall struct {
+	DefaultAction string          `json:"default_action"`
+	Rules         []*FirewallRule `json:"rules"`
+}
+
+// InitFirewall 从json文件加载防火墙规则, 文件为空时不启用
+func InitFirewall(ruleFile string) error {
+	if ruleFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(ruleFile)
+	if err != nil {
+		return err
+	}
+
+	f := &Firewall{}
+
+	err = jsoniter.Unmarshal(data, f)
+	if err != nil {
+		return fmt.Errorf("parse firewall file err: %w", err)
+	}
+
+	if f.DefaultAction == "" {
+		f.DefaultAction = FirewallAllow
+	}
+
+	if !isFirewallAction(f.DefaultAction) {
+		return fmt.Errorf("invalid firewall default action: %s", f.DefaultAction)
+	}
+
+	for i, rule := range f.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+
+		err = rule.init()
+		if err != nil {
+			return fmt.Errorf("firewall rule %s: %w", rule.Name, err)
+		}
+	}
+
+	firewall = f
+
+	zlog.Infof("firewall enabled, rules: %d default action: %s", len(f.Rules), f.DefaultAction)
+
+	return nil
+}
+
+func isFirewallAction(action string) bool {
+	return action == FirewallAllow || action == FirewallLog || action == FirewallReject
+}
+
+func (r *FirewallRule) init() error {
+	if !isFirewallAction(r.Action) {
+		return fmt.Errorf("invalid action: %s", r.Action)
+	}
+
+	if r.ClientIp != "" {
+		_, ipNet, err := net.ParseCIDR(r.ClientIp)
+		if err != nil {
+			ip := net.ParseIP(r.ClientIp)
+			if ip == nil {
+				return fmt.Errorf("invalid client_ip: %s", r.ClientIp)
+			}
+
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		}
+		r.clientNet = ipNet
+	}
+
+	if r.Regex != "" {
+		reg, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid regex: %w", err)
+		}
+		r.regex = reg
+	}
+
+	for i, statement := range r.Statements {
+		r.Statements[i] = strings.ToLower(statement)
+	}
+
+	for i, table := range r.Tables {
+		r.Tables[i] = strings.ToLower(table)
+	}
+
+	return nil
+}
+
+// firewallStatement 规则匹配使用的语句信息
+type firewallStatement struct {
+	query  string
+	kinds  []string
+	tables []string
+}
+
+func newFirewallStatement(stmt string, schema string) *firewallStatement {
+	masked := maskStatement(stmt)
+	keyword := leadingKeyword(masked)
+
+	s := &firewallStatement{query: stmt, kinds: []string{keyword}}
+
+	if !whereReg.MatchString(masked) {
+		switch keyword {
+		case "delete":
+			s.kinds = append(s.kinds, StatementDeleteWithoutWhere)
+		case "update":
+			s.kinds = append(s.kinds, StatementUpdateWithoutWhere)
+		}
+	}
+
+	// 表名在反引号中, 只去掉字符串的内容
+	for _, match := range tableNameReg.FindAllStringSubmatch(maskQuoted(stmt, `'"`), -1) {
+		table := strings.ReplaceAll(match[1], "`", "")
+		table = strings.Join(strings.Fields(table), "")
+
+		if !strings.Contains(table, ".") && schema != "" {
+			table = strings.ToLower(schema) + "." + table
+		}
+
+		s.tables = append(s.tables, table)
+	}
+
+	return s
+}
+
+func (r *FirewallRule) match(session *Session, clientIp net.IP, stmt *firewallStatement) bool {
+	if r.User != "" && r.User != session.User {
+		return false
+	}
+
+	if r.Schema != "" && r.Schema != session.Schema {
+		return false
+	}
+
+	if r.clientNet != nil && (clientIp == nil || !r.clientNet.Contains(clientIp)) {
+		return false
+	}
+
+	if len(r.Statements) > 0 && !containsAny(r.Statements, stmt.kinds) {
+		return false
+	}
+
+	if len(r.Tables) > 0 && !r.matchTable(stmt.tables) {
+		return false
+	}
+
+	if r.regex != nil && !r.regex.MatchString(stmt.query) {
+		return false
+	}
+
+	return true
+}
+
+// matchTable 规则中的 table 匹配任意库的同名表, db.table 只匹配该库的表
+func (r *FirewallRule) matchTable(tables []string) bool {
+	for _, table := range tables {
+		name := table[strings.LastIndexByte(table, '.')+1:]
+
+		for _, ruleTable := range r.Tables {
+			if ruleTable == table || (!strings.Contains(ruleTable, ".") && ruleTable == name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func containsAny(list []string, values []string) bool {
+	for _, value := range values {
+		for _, item := range list {
+			if item == value {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// check 返回命令的动作和匹配的规则, 没有规则匹配时规则为nil
+// 多语句中任意一条被拒绝时拒绝整个命令
+func (f *Firewall) check(session *Session, query string) (string, *FirewallRule) {
+	var clientIp net.IP
+	if host, _, err := net.SplitHostPort(session.ClientAddr); err == nil {
+		clientIp = net.ParseIP(host)
+	}
+
+	statements := executableStatements(query)
+	if len(statements) == 0 {
+		statements = []string{query}
+	}
+
+	action := FirewallAllow
+	var matched *FirewallRule
+
+	for _, stmt := range statements {
+		stmtAction, rule := f.DefaultAction, (*FirewallRule)(nil)
+
+		s := newFirewallStatement(stmt, session.Schema)
+		for _, r := range f.Rules {
+			if r.match(session, clientIp, s) {
+				stmtAction, rule = r.Action, r
+				break
+			}
+		}
+
+		switch {
+		case stmtAction == FirewallReject:
+			return stmtAction, rule
+		case stmtAction == FirewallLog && action == FirewallAllow:
+			action, matched = stmtAction, rule
+		}
+	}
+
+	return action, matched
+}
+
+// checkFirewall 在COM_QUERY和COM_STMT_PREPARE发往服务端之前检查, 返回拒绝时发给客户端的ERR包
+func (p *ProxyConn) checkFirewall(payload []byte) *MysqlErrPacket {
+	if firewall == nil || (payload[0] != ComQuery && payload[0] != ComPrepare) {
+		return nil
+	}
+
+	query := string(payload[1:])
+
+	action, rule := firewall.check(p.session, query)
+
+	ruleName := "default"
+	if rule != nil {
+		ruleName = rule.Name
+	}
+
+	switch action {
+	case FirewallLog:
+		zlog.Warnf("firewall rule:%s action:log connection_id:%d user:%s client:%s query:%s",
+			ruleName, p.session.ConnectionId, p.session.User, p.session.ClientAddr, maskQuery(query))
+
+	case FirewallReject:
+		zlog.Warnf("firewall rule:%s action:reject connection_id:%d user:%s client:%s query:%s",
+			ruleName, p.session.ConnectionId, p.session.User, p.session.ClientAddr, maskQuery(query))
+
+		msg := fmt.Sprintf("Statement was blocked by firewall rule %s", ruleName)
+		if rule != nil && rule.Message != "" {
+			msg = rule.Message
+		}
+
+		return NewErrPacket(ErSpecificAccessDenied, "42000", msg)
+	}
+
+	return nil
+}
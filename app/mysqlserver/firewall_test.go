@@ -0,0 +1,115 @@
+package mysqlserver
+
+import "testing"
+
+func newTestFirewall(t *testing.T, defaultAction string, rules ...*FirewallRule) *Firewall {
+	t.Helper()
+
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = string(rune('a' + i))
+		}
+
+		if err := rule.init(); err != nil {
+			t.Fatalf("init rule %s: %s", rule.Name, err)
+		}
+	}
+
+	return &Firewall{DefaultAction: defaultAction, Rules: rules}
+}
+
+func TestFirewallCheck(t *testing.T) {
+	session := &Session{User: "app", Schema: "shop", ClientAddr: "10.0.0.5:40000"}
+
+	tests := []struct {
+		name    string
+		rule    *FirewallRule
+		session *Session
+		query   string
+		want    string
+	}{
+		{"statement", &FirewallRule{Statements: []string{"drop"}, Action: FirewallReject}, session, "DROP TABLE t", FirewallReject},
+		{"statement other", &FirewallRule{Statements: []string{"drop"}, Action: FirewallReject}, session, "select 1", FirewallAllow},
+		{"statement in string", &FirewallRule{Statements: []string{"drop"}, Action: FirewallReject}, session, "select 'drop table t'", FirewallAllow},
+		{"statement in comment", &FirewallRule{Statements: []string{"drop"}, Action: FirewallReject}, session, "/* drop */ select 1", FirewallAllow},
+		{"executable comment", &FirewallRule{Statements: []string{"drop"}, Action: FirewallReject}, session, "/*!DROP TABLE t*/", FirewallReject},
+		{"versioned comment", &FirewallRule{Statements: []string{"drop"}, Action: FirewallReject}, session, "/*!50000 DROP TABLE t */", FirewallReject},
+		{"multi statement", &FirewallRule{Statements: []string{"truncate"}, Action: FirewallReject}, session, "select 1; truncate t", FirewallReject},
+		{"multi statement in executable comment", &FirewallRule{Statements: []string{"drop"}, Action: FirewallReject}, session, "select 1 /*! ; DROP TABLE t */", FirewallReject},
+
+		{"delete without where", &FirewallRule{Statements: []string{StatementDeleteWithoutWhere}, Action: FirewallReject}, session, "DELETE FROM t", FirewallReject},
+		{"delete with where", &FirewallRule{Statements: []string{StatementDeleteWithoutWhere}, Action: FirewallReject}, session, "DELETE FROM t WHERE id = 1", FirewallAllow},
+		{"delete where in block comment", &FirewallRule{Statements: []string{StatementDeleteWithoutWhere}, Action: FirewallReject}, session, "DELETE FROM t /* where */", FirewallReject},
+		{"delete where in hash comment", &FirewallRule{Statements: []string{StatementDeleteWithoutWhere}, Action: FirewallReject}, session, "DELETE FROM t # where", FirewallReject},
+		{"delete where in dash comment", &FirewallRule{Statements: []string{StatementDeleteWithoutWhere}, Action: FirewallReject}, session, "DELETE FROM t -- where", FirewallReject},
+		{"delete where in executable comment", &FirewallRule{Statements: []string{StatementDeleteWithoutWhere}, Action: FirewallReject}, session, "DELETE FROM t /*!50000 WHERE id = 1 */", FirewallAllow},
+		{"update without where", &FirewallRule{Statements: []string{StatementUpdateWithoutWhere}, Action: FirewallReject}, session, "update t set a='where'", FirewallReject},
+		{"update with where", &FirewallRule{Statements: []string{StatementUpdateWithoutWhere}, Action: FirewallReject}, session, "update t set a=1 where b=2", FirewallAllow},
+
+		{"user", &FirewallRule{User: "app", Action: FirewallReject}, session, "select 1", FirewallReject},
+		{"other user", &FirewallRule{User: "admin", Action: FirewallReject}, session, "select 1", FirewallAllow},
+		{"schema", &FirewallRule{Schema: "shop", Action: FirewallReject}, session, "select 1", FirewallReject},
+		{"other schema", &FirewallRule{Schema: "hr", Action: FirewallReject}, session, "select 1", FirewallAllow},
+		{"client ip", &FirewallRule{ClientIp: "10.0.0.5", Action: FirewallReject}, session, "select 1", FirewallReject},
+		{"client cidr", &FirewallRule{ClientIp: "10.0.0.0/24", Action: FirewallReject}, session, "select 1", FirewallReject},
+		{"other client", &FirewallRule{ClientIp: "192.168.0.0/16", Action: FirewallReject}, session, "select 1", FirewallAllow},
+
+		{"table", &FirewallRule{Tables: []string{"salary"}, Action: FirewallReject}, session, "select * from hr.salary", FirewallReject},
+		{"table with schema", &FirewallRule{Tables: []string{"hr.salary"}, Action: FirewallReject}, session, "select * from `hr`.`salary`", FirewallReject},
+		{"table in current schema", &FirewallRule{Tables: []string{"shop.salary"}, Action: FirewallReject}, session, "select * from salary", FirewallReject},
+		{"table other schema", &FirewallRule{Tables: []string{"hr.salary"}, Action: FirewallReject}, session, "select * from salary", FirewallAllow},
+		{"table in string", &FirewallRule{Tables: []string{"salary"}, Action: FirewallReject}, session, "select 'from salary'", FirewallAllow},
+
+		{"regex", &FirewallRule{Regex: `(?i)sleep\(`, Action: FirewallReject}, session, "select SLEEP(10)", FirewallReject},
+		{"regex no match", &FirewallRule{Regex: `(?i)sleep\(`, Action: FirewallReject}, session, "select 1", FirewallAllow},
+
+		{"log", &FirewallRule{Statements: []string{"select"}, Action: FirewallLog}, session, "select 1", FirewallLog},
+		{"allow", &FirewallRule{Statements: []string{"select"}, Action: FirewallAllow}, session, "select 1", FirewallAllow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFirewall(t, FirewallAllow, tt.rule)
+
+			got, _ := f.check(tt.session, tt.query)
+			if got != tt.want {
+				t.Errorf("check(%q) = %s, want %s", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirewallRuleOrder(t *testing.T) {
+	session := &Session{User: "app", Schema: "shop", ClientAddr: "10.0.0.5:40000"}
+
+	f := newTestFirewall(t, FirewallReject,
+		&FirewallRule{Name: "admin", User: "admin", Action: FirewallAllow},
+		&FirewallRule{Name: "read", Statements: []string{"select", "show"}, Action: FirewallAllow},
+		&FirewallRule{Name: "audit", Tables: []string{"orders"}, Action: FirewallLog},
+	)
+
+	tests := []struct {
+		query    string
+		want     string
+		wantRule string
+	}{
+		{"select 1", FirewallAllow, ""},
+		{"update orders set a=1 where id=1", FirewallLog, "audit"},
+		{"update t set a=1 where id=1", FirewallReject, ""},
+		{"select 1; update orders set a=1 where id=1", FirewallLog, "audit"},
+		{"update orders set a=1 where id=1; drop table t", FirewallReject, ""},
+	}
+
+	for _, tt := range tests {
+		got, rule := f.check(session, tt.query)
+
+		var ruleName string
+		if rule != nil {
+			ruleName = rule.Name
+		}
+
+		if got != tt.want || ruleName != tt.wantRule {
+			t.Errorf("check(%q) = %s %s, want %s %s", tt.query, got, ruleName, tt.want, tt.wantRule)
+		}
+	}
+}
@@ -96,6 +96,8 @@ type HandshakeResponse struct {
 	AuthPluginMethod string
 	ClientAttrLen    uint64
 	ClientAttrs      map[string]string
+	// CLIENT_ZSTD_COMPRESSION_ALGORITHM 时的压缩级别
+	ZstdCompressionLevel uint8
 	MysqlPacketHeader
 }
 
@@ -131,10 +133,12 @@ func (hp *HandshakeResponse) ToByte() []byte {
 		//res = append(res, WriteLengthEncodedInt(resp.ClientAttrLen)...)
 		attrByte := ClientAttrsToByte(hp.ClientAttrs)
 		attrLen := len(attrByte)
-		if attrLen > 0 {
-			res = append(res, WriteLengthEncodedInt(uint64(attrLen))...)
-			res = append(res, attrByte...)
-		}
+		res = append(res, WriteLengthEncodedInt(uint64(attrLen))...)
+		res = append(res, attrByte...)
+	}
+
+	if hp.ClientFlag&CapabilityClientZstdCompressionAlgorithm > 0 {
+		res = append(res, WriteByte(hp.ZstdCompressionLevel)...)
 	}
 
 	//fmt.Printf("%+v\n", buf.Bytes())
@@ -293,11 +297,19 @@ func ReadHandshakeV10(conn io.Reader) (*HandshakeV10, error) {
 }
 
 func ReadHandshakeResponse(conn io.Reader) (*HandshakeResponse, error) {
-	pk, err := ReadMysqlPacket(conn)
+	pk, err := ReadMysqlPacketLimit(conn, MaxPacketSize)
 	if err != nil {
 		return nil, err
 	}
 
+	return ParseHandshakeResponse(pk)
+}
+
+func ParseHandshakeResponse(pk *MysqlPacket) (*HandshakeResponse, error) {
+	if len(pk.Payload) < 32 {
+		return nil, fmt.Errorf("handshake response too short: %d", len(pk.Payload))
+	}
+
 	buf := bytes.NewBuffer(pk.Payload)
 
 	clientFlag := ReadUint32(buf.Next(4))
@@ -386,6 +398,10 @@ func ReadHandshakeResponse(conn io.Reader) (*HandshakeResponse, error) {
 		//fmt.Printf("%+v\n", buf.Bytes())
 	}
 
+	if clientFlag&CapabilityClientZstdCompressionAlgorithm > 0 && buf.Len() > 0 {
+		res.ZstdCompressionLevel = ReadByte(buf.Next(1))
+	}
+
 	//fmt.Printf("%+v\n", buf.Bytes())
 
 	return res, nil
@@ -0,0 +1,404 @@
+package mysqlserver
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"proxymysql/app/zlog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 健康检查登录使用的能力, 与服务端的能力取交集
+const healthCapability = CapabilityClientLongPassword | CapabilityClientLongFlag | CapabilityClientProtocol41 |
+	CapabilityClientTransactions | CapabilityClientSecureConnection | CapabilityClientPluginAuth |
+	CapabilityClientPluginAuthLenencClientData
+
+// 连接后端的重试次数 退避时间 超时
+var (
+	connectRetries int
+	connectBackoff time.Duration
+	connectTimeout = 3 * time.Second
+	// 没有健康检查时, 连接失败的后端过这段时间后重新尝试
+	downRetryInterval = 5 * time.Second
+)
+
+// InitConnectRetry 连接后端失败时按backoff指数退避重试retries次
+func InitConnectRetry(retries int, backoff time.Duration, timeout time.Duration) error {
+	if retries < 0 || backoff < 0 || timeout <= 0 {
+		return fmt.Errorf("invalid connect retry config: retries:%d backoff:%s timeout:%s", retries, backoff, timeout)
+	}
+
+	connectRetries = retries
+	connectBackoff = backoff
+	connectTimeout = timeout
+
+	return nil
+}
+
+func dialTimeout(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, connectTimeout)
+}
+
+// backendHealth 后端的健康状态, 默认可用
+type backendHealth struct {
+	mu   sync.RWMutex
+	down bool
+	// 副本的复制延迟秒数
+	lag int
+	err error
+	// 最近一次检查或连接失败的时间
+	downAt time.Time
+	// 有健康检查协程时由检查结果恢复可用, 否则由下一次连接成功恢复
+	checked bool
+}
+
+// Healthy 健康检查或最近一次连接是否成功, 没有健康检查时失败超过downRetryInterval后重新尝试
+func (b *Backend) Healthy() bool {
+	b.health.mu.RLock()
+	defer b.health.mu.RUnlock()
+
+	if b.health.down && !b.health.checked {
+		return time.Since(b.health.downAt) >= downRetryInterval
+	}
+
+	return !b.health.down
+}
+
+// setHealth 更新健康状态, 状态变化时记录日志
+func (b *Backend) setHealth(err error, lag int) {
+	b.health.mu.Lock()
+	defer b.health.mu.Unlock()
+
+	wasDown := b.health.down
+	b.health.down = err != nil
+	b.health.lag = lag
+	b.health.err = err
+
+	if err != nil {
+		b.health.downAt = time.Now()
+	}
+
+	switch {
+	case err != nil && !wasDown:
+		zlog.Warnf("backend %s %s down: %s", b.Name, b.Addr, err)
+	case err == nil && wasDown:
+		zlog.Infof("backend %s %s up, replication lag:%ds", b.Name, b.Addr, lag)
+	}
+}
+
+// connected 连接后端成功, 没有健康检查时恢复可用
+// 有健康检查时等下一次检查, 避免覆盖复制延迟的检查结果
+func (b *Backend) connected() {
+	b.health.mu.RLock()
+	up := b.health.down && !b.health.checked
+	b.health.mu.RUnlock()
+
+	if up {
+		b.setHealth(nil, 0)
+	}
+}
+
+// orderByHealth 健康的后端在前, 都不健康时仍然按顺序尝试
+func orderByHealth(backends []*Backend) []*Backend {
+	res := make([]*Backend, 0, len(backends))
+	var down []*Backend
+
+	for _, backend := range backends {
+		if backend.Healthy() {
+			res = append(res, backend)
+		} else {
+			down = append(down, backend)
+		}
+	}
+
+	return append(res, down...)
+}
+
+// dialFailover 依次连接后端和它的故障转移后端, 失败时退避重试, 返回连上的后端
+func dialFailover(backend *Backend) (*Backend, net.Conn, error) {
+	candidates := append([]*Backend{backend}, backend.failover...)
+
+	var lastErr error
+
+	for attempt := 0; attempt <= connectRetries; attempt++ {
+		if attempt > 0 {
+			backoff := connectBackoff << (attempt - 1)
+			zlog.Warnf("connect backend %s failed, retry %d after %s", backend.Name, attempt, backoff)
+			time.Sleep(backoff)
+		}
+
+		for _, candidate := range orderByHealth(candidates) {
+			conn, err := dialTimeout(candidate.Addr)
+			if err != nil {
+				candidate.setHealth(err, 0)
+				lastErr = err
+				continue
+			}
+
+			candidate.connected()
+
+			if candidate != backend {
+				zlog.Warnf("backend %s unavailable, failover to %s", backend.Name, candidate.Name)
+			}
+
+			return candidate, conn, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("connect backend %s err: %w", backend.Name, lastErr)
+}
+
+// healthChecker 定时检查后端: 用检查账号登录执行SELECT 1, 配置了最大延迟时检查复制延迟
+type healthChecker struct {
+	interval time.Duration
+	timeout  time.Duration
+	user     *ProxyUser
+}
+
+// StartHealthCheck 每个后端启动一个检查协程, interval为0或没有检查账号时不检查
+// 只连接读取握手包就断开的连接会被服务端计入max_connect_errors, 连续达到上限(默认100)后
+// 代理所在主机会被服务端拒绝连接(Host is blocked), 所以每次检查都要完成登录再COM_QUIT
+func (c *RouteConfig) StartHealthCheck(interval time.Duration, timeout time.Duration, user string, password string) {
+	if interval <= 0 {
+		return
+	}
+
+	if user == "" {
+		zlog.Infof("health check disabled: health_check_user not set")
+		return
+	}
+
+	h := &healthChecker{interval: interval, timeout: timeout, user: &ProxyUser{BackendUser: user, BackendPassword: password}}
+
+	for _, backend := range c.Backends {
+		backend.health.mu.Lock()
+		backend.health.checked = true
+		backend.health.mu.Unlock()
+
+		go h.run(backend)
+	}
+}
+
+func (h *healthChecker) run(backend *Backend) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		lag, err := h.check(backend)
+		backend.setHealth(err, lag)
+
+		<-ticker.C
+	}
+}
+
+// check 返回复制延迟秒数
+func (h *healthChecker) check(backend *Backend) (int, error) {
+	conn, err := net.DialTimeout("tcp", backend.Addr, h.timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(h.timeout))
+
+	hk, err := ReadHandshakeV10(conn)
+	if err != nil {
+		return 0, fmt.Errorf("read handshake err: %w", err)
+	}
+
+	conn, err = h.login(conn, backend, hk)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Write(WithHeaderPacket([]byte{ComQuit}, 0))
+
+	_, err = queryRows(conn, "SELECT 1")
+	if err != nil {
+		return 0, err
+	}
+
+	if backend.MaxReplicationLagS <= 0 {
+		return 0, nil
+	}
+
+	lag, err := replicationLag(conn)
+	if err != nil {
+		return 0, err
+	}
+
+	if lag > backend.MaxReplicationLagS {
+		return lag, fmt.Errorf("replication lag %ds exceeds %ds", lag, backend.MaxReplicationLagS)
+	}
+
+	return lag, nil
+}
+
+func (h *healthChecker) login(conn net.Conn, backend *Backend, hk *HandshakeV10) (net.Conn, error) {
+	scramble := hk.AuthPluginData[:20]
+
+	resp := &HandshakeResponse{
+		ClientFlag:       healthCapability & hk.CapabilityFlag,
+		MaxPacketSize:    MaxPacketSize,
+		Charset:          hk.CharsetCollation,
+		Username:         h.user.BackendUser,
+		AuthPluginMethod: hk.AuthPluginMethod,
+		Password:         scramblePassword(hk.AuthPluginMethod, h.user.BackendPassword, scramble),
+	}
+	resp.SequenceId = 1
+
+	conn, err := startServerTls(conn, backend.Addr, hk.CapabilityFlag, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(resp.ToByte())
+	if err != nil {
+		return nil, err
+	}
+
+	pk, err := authenticateServer(conn, h.user, scramble)
+	if err != nil {
+		return nil, err
+	}
+
+	if pk.Payload[0] == ErrPacket {
+		errPacket, err := ParseErrPacket(pk.Payload)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("health check login err: %w", errPacket)
+	}
+
+	return conn, nil
+}
+
+// replicationLag 不是副本时返回0, 复制未运行时返回错误
+func replicationLag(conn net.Conn) (int, error) {
+	rows, err := queryRows(conn, "SHOW REPLICA STATUS")
+	if err != nil {
+		// 8.0.22之前的版本
+		rows, err = queryRows(conn, "SHOW SLAVE STATUS")
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if len(rows) == 0 {
+		return 0, nil
+	}
+
+	value, ok := rows[0]["Seconds_Behind_Source"]
+	if !ok {
+		value, ok = rows[0]["Seconds_Behind_Master"]
+	}
+
+	if !ok {
+		return 0, fmt.Errorf("replica status has no Seconds_Behind_Source column")
+	}
+
+	if value == nil {
+		return 0, fmt.Errorf("replication is not running")
+	}
+
+	return strconv.Atoi(string(value))
+}
+
+// queryRows 执行查询并按列名返回文本结果集, NULL为nil
+func queryRows(conn net.Conn, query string) ([]map[string][]byte, error) {
+	_, err := conn.Write(WithHeaderPacket(append([]byte{ComQuery}, query...), 0))
+	if err != nil {
+		return nil, err
+	}
+
+	pk, err := ReadMysqlPacket(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch pk.Payload[0] {
+	case ErrPacket:
+		errPacket, err := ParseErrPacket(pk.Payload)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s err: %w", query, errPacket)
+
+	case OKPacket:
+		return nil, nil
+	}
+
+	columnCount, _, ok := ReadLengthEncodedInt(pk.Payload)
+	if !ok {
+		return nil, fmt.Errorf("%s: invalid column count", query)
+	}
+
+	columns := make([]string, columnCount)
+
+	for i := range columns {
+		pk, err := ReadMysqlPacket(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		// catalog schema table org_table name
+		buf := bytes.NewBuffer(pk.Payload)
+		var name []byte
+		for j := 0; j < 5; j++ {
+			name, err = readBinaryLengthEncoded(buf)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid column definition: %w", query, err)
+			}
+		}
+
+		columns[i] = string(name)
+	}
+
+	// 列定义后的EOF
+	_, err = ReadMysqlPacket(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []map[string][]byte
+
+	for {
+		pk, err := ReadMysqlPacket(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		if pk.Payload[0] == ErrPacket {
+			errPacket, err := ParseErrPacket(pk.Payload)
+			if err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%s err: %w", query, errPacket)
+		}
+
+		if isEofPacket(pk.Payload) {
+			return rows, nil
+		}
+
+		buf := bytes.NewBuffer(pk.Payload)
+		row := make(map[string][]byte, len(columns))
+
+		for _, column := range columns {
+			if buf.Len() > 0 && buf.Bytes()[0] == 0xfb {
+				buf.Next(1)
+				row[column] = nil
+				continue
+			}
+
+			value, err := readBinaryLengthEncoded(buf)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid row: %w", query, err)
+			}
+			row[column] = value
+		}
+
+		rows = append(rows, row)
+	}
+}
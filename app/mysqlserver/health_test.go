@@ -0,0 +1,201 @@
+package mysqlserver
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func listenTest(t *testing.T) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	return l
+}
+
+// closedAddr 返回一个没有监听的地址
+func closedAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	return addr
+}
+
+func TestDialFailoverHealth(t *testing.T) {
+	tests := []struct {
+		name    string
+		checked bool
+		// 连接成功后是否可用
+		want bool
+	}{
+		// 没有健康检查时连接成功就恢复可用
+		{"no health check", false, true},
+		// 有健康检查时由检查结果决定
+		{"health check", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := listenTest(t)
+
+			backend := &Backend{Name: "a", Addr: l.Addr().String()}
+			backend.health.checked = tt.checked
+			backend.setHealth(fmt.Errorf("connection refused"), 0)
+
+			got, conn, err := dialFailover(backend)
+			if err != nil {
+				t.Fatalf("dialFailover: %s", err)
+			}
+			_ = conn.Close()
+
+			if got != backend {
+				t.Errorf("dialFailover = %s, want %s", got.Name, backend.Name)
+			}
+
+			if backend.Healthy() != tt.want {
+				t.Errorf("Healthy() = %v, want %v", backend.Healthy(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDialFailoverDown(t *testing.T) {
+	l := listenTest(t)
+
+	failover := &Backend{Name: "b", Addr: l.Addr().String()}
+	backend := &Backend{Name: "a", Addr: closedAddr(t), failover: []*Backend{failover}}
+
+	got, conn, err := dialFailover(backend)
+	if err != nil {
+		t.Fatalf("dialFailover: %s", err)
+	}
+	_ = conn.Close()
+
+	if got != failover {
+		t.Errorf("dialFailover = %s, want %s", got.Name, failover.Name)
+	}
+
+	if backend.Healthy() || !failover.Healthy() {
+		t.Errorf("Healthy() a:%v b:%v, want a:false b:true", backend.Healthy(), failover.Healthy())
+	}
+
+	// 没有健康检查时, 失败的后端过downRetryInterval后重新尝试, 连接成功后恢复可用
+	l2, err := net.Listen("tcp", backend.Addr)
+	if err != nil {
+		t.Skipf("listen %s again: %s", backend.Addr, err)
+	}
+	defer l2.Close()
+
+	got, conn, err = dialFailover(backend)
+	if err != nil {
+		t.Fatalf("dialFailover: %s", err)
+	}
+	_ = conn.Close()
+
+	if got != failover {
+		t.Errorf("dialFailover before retry interval = %s, want %s", got.Name, failover.Name)
+	}
+
+	defer func(interval time.Duration) {
+		downRetryInterval = interval
+	}(downRetryInterval)
+	downRetryInterval = 0
+
+	got, conn, err = dialFailover(backend)
+	if err != nil {
+		t.Fatalf("dialFailover: %s", err)
+	}
+	_ = conn.Close()
+
+	if got != backend {
+		t.Errorf("dialFailover after retry interval = %s, want %s", got.Name, backend.Name)
+	}
+
+	downRetryInterval = time.Hour
+
+	if !backend.Healthy() {
+		t.Errorf("Healthy() = false after connected")
+	}
+}
+
+func TestBackendHealthy(t *testing.T) {
+	defer func(interval time.Duration) {
+		downRetryInterval = interval
+	}(downRetryInterval)
+	downRetryInterval = time.Hour
+
+	tests := []struct {
+		name    string
+		checked bool
+		downAgo time.Duration
+		want    bool
+	}{
+		{"no health check recent failure", false, time.Second, false},
+		{"no health check old failure", false, 2 * time.Hour, true},
+		{"health check recent failure", true, time.Second, false},
+		{"health check old failure", true, 2 * time.Hour, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &Backend{Name: "a"}
+			backend.health.checked = tt.checked
+			backend.setHealth(fmt.Errorf("connection refused"), 0)
+			backend.health.downAt = time.Now().Add(-tt.downAgo)
+
+			if got := backend.Healthy(); got != tt.want {
+				t.Errorf("Healthy() = %v, want %v", got, tt.want)
+			}
+
+			backend.setHealth(nil, 0)
+
+			if !backend.Healthy() {
+				t.Errorf("Healthy() = false after check succeeded")
+			}
+		})
+	}
+}
+
+// 没有检查账号时不启动健康检查, 避免只连接不登录被服务端计入max_connect_errors
+func TestStartHealthCheckWithoutUser(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		user     string
+		want     bool
+	}{
+		{"no interval", 0, "check", false},
+		{"no user", time.Hour, "", false},
+		{"user", time.Hour, "check", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &Backend{Name: "a", Addr: closedAddr(t)}
+			c := &RouteConfig{Backends: []*Backend{backend}}
+
+			c.StartHealthCheck(tt.interval, time.Second, tt.user, "")
+
+			backend.health.mu.RLock()
+			got := backend.health.checked
+			backend.health.mu.RUnlock()
+
+			if got != tt.want {
+				t.Errorf("checked = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,21 +1,32 @@
 package mysqlserver
 
 import (
+	"crypto/rand"
 	"encoding/binary"
-	"math/rand"
 )
 
+// WithHeaderPacket 加上包头, 长度达到MaxPacketSize时拆成多个包,
+// 长度正好是MaxPacketSize整数倍时最后补一个空包
 func WithHeaderPacket(data []byte, sequenceId uint8) []byte {
-	payloadLength := len(data)
+	res := make([]byte, 0, len(data)+4*(len(data)/MaxPacketSize+1))
 
-	header := make([]byte, 4)
+	for {
+		payloadLength := len(data)
+		if payloadLength > MaxPacketSize {
+			payloadLength = MaxPacketSize
+		}
+
+		res = append(res, byte(payloadLength), byte(payloadLength>>8), byte(payloadLength>>16))
+		res = append(res, sequenceId) // 序列号 Sequence ID
+		res = append(res, data[:payloadLength]...)
 
-	header[0] = byte(payloadLength)
-	header[1] = byte(payloadLength >> 8)
-	header[2] = byte(payloadLength >> 16)
-	header[3] = sequenceId // 序列号 Sequence ID
+		data = data[payloadLength:]
+		sequenceId++
 
-	return append(header, data...)
+		if payloadLength < MaxPacketSize {
+			return res
+		}
+	}
 }
 
 func WriteByte(value byte) []byte {
@@ -209,19 +220,21 @@ func WriteLengthEncodedString(strByte []byte) []byte {
 	return data
 }
 
+// GetAuthPluginData 代理认证使用的20字节scramble, 以0x00结尾
 func GetAuthPluginData() []byte {
 	minChar := 30
 	maxChar := 127
 	res := make([]byte, 21)
 
-	for k := range res {
-		if k == 20 {
-			k = 0x00 // 认证字符串以0x00结尾
-			break
-		}
+	_, err := rand.Read(res[:20])
+	if err != nil {
+		panic(err)
+	}
 
-		res[k] = byte(rand.Intn(maxChar-minChar) + minChar)
+	for k := 0; k < 20; k++ {
+		res[k] = byte(minChar + int(res[k])%(maxChar-minChar))
 	}
+	res[20] = 0x00
 
 	return res
 }
@@ -0,0 +1,719 @@
+package mysqlserver
+
+import (
+	"fmt"
+	"github.com/huandu/go-sqlbuilder"
+	jsoniter "github.com/json-iterator/go"
+	"os"
+	"proxymysql/app/zlog"
+	"regexp"
+	"strings"
+)
+
+// 为nil时不脱敏, 记录原始语句
+var masker *Masker
+
+// 语句中的token类型
+const (
+	tokenOther = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	// 预处理语句的占位符 ?
+	tokenParam
+)
+
+// 列名后面的这些运算符, 右边的值需要脱敏
+var maskComparisonOps = map[string]bool{
+	"=": true, "<=>": true, "!=": true, "<>": true, ">": true, "<": true, ">=": true, "<=": true, ":=": true,
+	"like": true, "in": true, "regexp": true, "rlike": true,
+}
+
+// 服务端错误信息中整段带出语句内容的格式, 第2个分组整体脱敏, 其余错误信息脱敏引号中的内容
+var errMsgLiteralRegs = []*regexp.Regexp{
+	// ER_PARSE_ERROR: ... near '%s' at line %d, 片段本身可能带引号
+	regexp.MustCompile(`(?s)(near ')(.*)(' at line \d+)$`),
+	// ER_DUP_ENTRY: Duplicate entry '%s' for key '%s', 保留索引名
+	regexp.MustCompile(`(?s)(Duplicate entry ')(.*)(' for key '[^']*'.*)$`),
+}
+
+// MaskRegex 按正则替换语句和字符串参数中的内容
+type MaskRegex struct {
+	Pattern string `json:"pattern"`
+	// 替换内容, 支持$1, 为空时使用mask
+	Replace string `json:"replace"`
+
+	regex *regexp.Regexp
+}
+
+// MaskParam 指纹相同的语句, 按位置脱敏字面量或预处理语句的参数
+type MaskParam struct {
+	// 字面量替换为?后的语句, 大小写和空白不影响匹配
+	Fingerprint string `json:"fingerprint"`
+	// 从1开始, 对应指纹中第几个?
+	Positions []int `json:"positions"`
+
+	fingerprint string
+}
+
+// Masker 脱敏规则文件, 语句写入记录文件、审计库和日志之前脱敏
+//
+//	{
+//	  "mask": "***",
+//	  "columns": ["password", "phone", "token"],
+//	  "regexes": [{"pattern": "1[3-9][0-9]{9}"}],
+//	  "params": [{"fingerprint": "update user set secret = ? where id = ?", "positions": [1]}]
+//	}
+type Masker struct {
+	// 所有字面量替换为?, 只记录语句指纹
+	FingerprintOnly bool   `json:"fingerprint_only"`
+	Mask            string `json:"mask"`
+	// INSERT/UPDATE的列和WHERE条件中的列, 不区分大小写
+	Columns []string     `json:"columns"`
+	Regexes []*MaskRegex `json:"regexes"`
+	Params  []*MaskParam `json:"params"`
+
+	columns map[string]bool
+}
+
+// InitMasking 从json文件加载脱敏规则, fingerprintOnly时只记录语句指纹, 都为空时不脱敏
+func InitMasking(maskFile string, fingerprintOnly bool) error {
+	if maskFile == "" && !fingerprintOnly {
+		return nil
+	}
+
+	m := &Masker{}
+
+	if maskFile != "" {
+		data, err := os.ReadFile(maskFile)
+		if err != nil {
+			return err
+		}
+
+		err = jsoniter.Unmarshal(data, m)
+		if err != nil {
+			return fmt.Errorf("parse mask file err: %w", err)
+		}
+	}
+
+	if fingerprintOnly {
+		m.FingerprintOnly = true
+	}
+
+	err := m.init()
+	if err != nil {
+		return err
+	}
+
+	masker = m
+
+	zlog.Infof("masking enabled, fingerprint only: %v columns: %d regexes: %d params: %d",
+		m.FingerprintOnly, len(m.Columns), len(m.Regexes), len(m.Params))
+
+	return nil
+}
+
+func (m *Masker) init() error {
+	if m.Mask == "" {
+		m.Mask = "***"
+	}
+
+	m.columns = make(map[string]bool, len(m.Columns))
+	for _, column := range m.Columns {
+		m.columns[strings.ToLower(column)] = true
+	}
+
+	for _, r := range m.Regexes {
+		reg, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid mask regex %s: %w", r.Pattern, err)
+		}
+
+		r.regex = reg
+		if r.Replace == "" {
+			r.Replace = m.Mask
+		}
+	}
+
+	for _, p := range m.Params {
+		if p.Fingerprint == "" || len(p.Positions) == 0 {
+			return fmt.Errorf("mask param requires fingerprint and positions: %+v", p)
+		}
+
+		p.fingerprint = normalizeFingerprint(tokenizeSql(p.Fingerprint))
+	}
+
+	return nil
+}
+
+// maskQuery 脱敏文本协议的语句, 未启用时原样返回
+func maskQuery(query string) string {
+	if masker == nil {
+		return query
+	}
+
+	res, _ := masker.maskSql(query)
+
+	return res
+}
+
+// maskErrMsg 服务端的错误信息会带出语句中的字面量, 如 Duplicate entry '13800138000' for key 'user.phone',
+// 引号中的内容替换为mask再按正则替换, 只记录指纹时不记录错误信息, 只保留错误码和SQLSTATE
+func maskErrMsg(msg string) string {
+	if masker == nil {
+		return msg
+	}
+
+	if masker.FingerprintOnly {
+		return ""
+	}
+
+	return masker.applyRegexes(masker.maskErrLiterals(msg))
+}
+
+func (m *Masker) maskErrLiterals(msg string) string {
+	for _, reg := range errMsgLiteralRegs {
+		if reg.MatchString(msg) {
+			return reg.ReplaceAllString(msg, "${1}"+m.Mask+"${3}")
+		}
+	}
+
+	var buf strings.Builder
+
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c != '\'' && c != '"' {
+			buf.WriteByte(c)
+			continue
+		}
+
+		end := strings.IndexByte(msg[i+1:], c)
+		if end < 0 {
+			// 没有结束的引号, 之后的内容都脱敏
+			buf.WriteByte(c)
+			buf.WriteString(m.Mask)
+			break
+		}
+
+		buf.WriteByte(c)
+		buf.WriteString(m.Mask)
+		buf.WriteByte(c)
+		i += end + 1
+	}
+
+	return buf.String()
+}
+
+// maskCommand 返回记录使用的语句和参数, 不修改cmd, 会话和事务跟踪仍然使用原始语句
+func maskCommand(cmd *QueryCommand) (string, []interface{}) {
+	switch {
+	case masker == nil:
+		return cmd.Query, cmd.Args
+
+	case cmd.Command == ComStmtExecute && cmd.Stmt != nil:
+		return masker.maskStmtExecute(cmd.Stmt.Query, cmd.Args)
+
+	case cmd.Command == ComQuery || cmd.Command == ComPrepare:
+		return maskQuery(cmd.Query), cmd.Args
+
+	case cmd.Stmt != nil && strings.HasPrefix(cmd.Query, cmd.Stmt.Query):
+		// COM_STMT_RESET COM_STMT_FETCH COM_STMT_CLOSE 记录的是预处理语句
+		return maskQuery(cmd.Stmt.Query) + cmd.Query[len(cmd.Stmt.Query):], cmd.Args
+	}
+
+	return cmd.Query, cmd.Args
+}
+
+// maskVariables 脱敏名称与脱敏列相同的会话变量, 只记录指纹时脱敏所有用户变量
+func maskVariables(variables map[string]string) map[string]string {
+	if masker == nil {
+		return variables
+	}
+
+	var res map[string]string
+
+	for name, value := range variables {
+		short := strings.ToLower(strings.TrimLeft(name, "@"))
+		short = short[strings.LastIndexByte(short, '.')+1:]
+
+		userVariable := strings.HasPrefix(name, "@") && !strings.HasPrefix(name, "@@")
+		if !masker.columns[short] && !(masker.FingerprintOnly && userVariable) {
+			continue
+		}
+
+		if res == nil {
+			res = make(map[string]string, len(variables))
+			for k, v := range variables {
+				res[k] = v
+			}
+		}
+
+		if value != "" {
+			res[name] = masker.Mask
+		}
+	}
+
+	if res == nil {
+		return variables
+	}
+
+	return res
+}
+
+// maskStmtExecute 脱敏预处理语句的参数, 返回代入脱敏参数后的语句和脱敏后的参数
+func (m *Masker) maskStmtExecute(query string, args []interface{}) (string, []interface{}) {
+	if m.FingerprintOnly {
+		res, _ := m.maskSql(query)
+		return res, nil
+	}
+
+	_, params := m.maskSql(query)
+
+	masked := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch value := arg.(type) {
+		case nil:
+			masked[i] = nil
+		case string:
+			if params[i] {
+				masked[i] = m.Mask
+			} else {
+				masked[i] = m.applyRegexes(value)
+			}
+		default:
+			if params[i] {
+				masked[i] = m.Mask
+			} else {
+				masked[i] = arg
+			}
+		}
+	}
+
+	fullSql, err := sqlbuilder.MySQL.Interpolate(query, masked)
+	if err != nil {
+		res, _ := m.maskSql(query)
+		return res, masked
+	}
+
+	// 列和正则规则同样作用于代入参数后的语句
+	res, _ := m.maskSql(fullSql)
+
+	return res, masked
+}
+
+// maskSql 返回脱敏后的语句和需要脱敏的占位符位置(从0开始)
+func (m *Masker) maskSql(query string) (string, map[int]bool) {
+	tokens := tokenizeSql(query)
+	marked := make(map[*sqlToken]bool)
+
+	for _, statement := range splitTokens(tokens) {
+		m.markColumns(statement, marked)
+		m.markInsert(statement, marked)
+		m.markParams(statement, marked)
+	}
+
+	var (
+		buf      strings.Builder
+		last     int
+		paramIdx int
+	)
+
+	params := make(map[int]bool)
+	quoted := "'" + m.Mask + "'"
+
+	for _, token := range tokens {
+		if !token.isValue() {
+			continue
+		}
+
+		if token.kind == tokenParam {
+			if marked[token] {
+				params[paramIdx] = true
+			}
+			paramIdx++
+			continue
+		}
+
+		var replace string
+		switch {
+		case m.FingerprintOnly:
+			replace = "?"
+		case marked[token]:
+			replace = quoted
+		default:
+			continue
+		}
+
+		buf.WriteString(query[last:token.start])
+		buf.WriteString(replace)
+		last = token.end
+	}
+
+	buf.WriteString(query[last:])
+
+	return m.applyRegexes(buf.String()), params
+}
+
+func (m *Masker) applyRegexes(s string) string {
+	for _, r := range m.Regexes {
+		s = r.regex.ReplaceAllString(s, r.Replace)
+	}
+
+	return s
+}
+
+// markColumns 标记与脱敏列比较或赋值的值, 如 password = 'x', phone in ('1', '2'), token = md5('x')
+func (m *Masker) markColumns(tokens []*sqlToken, marked map[*sqlToken]bool) {
+	for i, token := range tokens {
+		if token.kind != tokenIdent || !m.columns[token.text] {
+			continue
+		}
+
+		j := i + 1
+		if j < len(tokens) && tokens[j].text == "not" {
+			j++
+		}
+
+		if j >= len(tokens) {
+			continue
+		}
+
+		switch op := tokens[j].text; {
+		case maskComparisonOps[op]:
+			markValue(tokens, j+1, marked)
+
+		case op == "between":
+			k := markValue(tokens, j+1, marked)
+			if k < len(tokens) && tokens[k].text == "and" {
+				markValue(tokens, k+1, marked)
+			}
+		}
+	}
+}
+
+// markInsert INSERT/REPLACE 的列列表和VALUES按位置对应
+func (m *Masker) markInsert(tokens []*sqlToken, marked map[*sqlToken]bool) {
+	if len(tokens) == 0 || (tokens[0].text != "insert" && tokens[0].text != "replace") {
+		return
+	}
+
+	i := 1
+	for i < len(tokens) && tokens[i].text != "(" && tokens[i].text != "values" && tokens[i].text != "value" &&
+		tokens[i].text != "set" && tokens[i].text != "select" {
+		i++
+	}
+
+	if i >= len(tokens) || tokens[i].text != "(" {
+		return
+	}
+
+	var (
+		columns []string
+		column  string
+	)
+
+	for i++; i < len(tokens) && tokens[i].text != ")"; i++ {
+		switch {
+		case tokens[i].kind == tokenIdent:
+			// t.col 取最后的列名
+			column = tokens[i].text
+		case tokens[i].text == ",":
+			columns = append(columns, column)
+			column = ""
+		}
+	}
+	columns = append(columns, column)
+
+	for i < len(tokens) && tokens[i].text != "values" && tokens[i].text != "value" {
+		i++
+	}
+
+	var index, depth int
+
+	for i++; i < len(tokens); i++ {
+		token := tokens[i]
+
+		switch {
+		case token.text == "(":
+			depth++
+			if depth == 1 {
+				index = 0
+				continue
+			}
+
+		case token.text == ")":
+			depth--
+
+		case token.text == "," && depth == 1:
+			index++
+			continue
+
+		case depth == 0 && token.kind == tokenIdent && token.text != "row":
+			// ON DUPLICATE KEY UPDATE 由markColumns处理
+			return
+		}
+
+		if depth >= 1 && token.isValue() && index < len(columns) && m.columns[columns[index]] {
+			marked[token] = true
+		}
+	}
+}
+
+// markParams 按指纹和位置标记值
+func (m *Masker) markParams(tokens []*sqlToken, marked map[*sqlToken]bool) {
+	if len(m.Params) == 0 {
+		return
+	}
+
+	fingerprint := normalizeFingerprint(tokens)
+
+	var values []*sqlToken
+	for _, token := range tokens {
+		if token.isValue() {
+			values = append(values, token)
+		}
+	}
+
+	for _, p := range m.Params {
+		if p.fingerprint != fingerprint {
+			continue
+		}
+
+		for _, position := range p.Positions {
+			if position >= 1 && position <= len(values) {
+				marked[values[position-1]] = true
+			}
+		}
+	}
+}
+
+// markValue 标记从i开始的一个值中的字面量, 返回值之后的位置
+func markValue(tokens []*sqlToken, i int, marked map[*sqlToken]bool) int {
+	for i < len(tokens) && (tokens[i].text == "-" || tokens[i].text == "+") {
+		i++
+	}
+
+	if i >= len(tokens) {
+		return i
+	}
+
+	switch {
+	case tokens[i].isValue():
+		marked[tokens[i]] = true
+		return i + 1
+
+	case tokens[i].text == "(":
+		return markParen(tokens, i, marked)
+
+	case tokens[i].kind == tokenIdent && i+1 < len(tokens) && tokens[i+1].text == "(":
+		// 函数调用
+		return markParen(tokens, i+1, marked)
+
+	case tokens[i].kind == tokenIdent && i+1 < len(tokens) && tokens[i+1].kind == tokenString:
+		// 字符集前缀 _utf8mb4'x'
+		marked[tokens[i+1]] = true
+		return i + 2
+	}
+
+	return i + 1
+}
+
+// markParen 标记括号内所有的字面量, 返回右括号之后的位置
+func markParen(tokens []*sqlToken, i int, marked map[*sqlToken]bool) int {
+	depth := 0
+
+	for ; i < len(tokens); i++ {
+		switch tokens[i].text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+
+		if tokens[i].isValue() {
+			marked[tokens[i]] = true
+		}
+	}
+
+	return i
+}
+
+type sqlToken struct {
+	kind int
+	// 小写, 标识符去掉反引号
+	text  string
+	start int
+	end   int
+}
+
+func (t *sqlToken) isValue() bool {
+	return t.kind == tokenString || t.kind == tokenNumber || t.kind == tokenParam
+}
+
+// normalizeFingerprint 字面量替换为?, token之间用一个空格连接
+func normalizeFingerprint(tokens []*sqlToken) string {
+	words := make([]string, 0, len(tokens))
+
+	for _, token := range tokens {
+		if token.isValue() {
+			words = append(words, "?")
+		} else {
+			words = append(words, token.text)
+		}
+	}
+
+	return strings.Join(words, " ")
+}
+
+// splitTokens 按分号拆分多语句
+func splitTokens(tokens []*sqlToken) [][]*sqlToken {
+	var (
+		res   [][]*sqlToken
+		start int
+	)
+
+	for i, token := range tokens {
+		if token.text == ";" {
+			if i > start {
+				res = append(res, tokens[start:i])
+			}
+			start = i + 1
+		}
+	}
+
+	if start < len(tokens) {
+		res = append(res, tokens[start:])
+	}
+
+	return res
+}
+
+// tokenizeSql 把语句拆分为标识符 字面量 占位符 和其他符号, 跳过空白和注释
+func tokenizeSql(query string) []*sqlToken {
+	var tokens []*sqlToken
+
+	// 可执行注释 /*! ... */ 中的语句会被服务端执行, 和注释外的内容一样切分
+	inExecutable := false
+
+	for i := 0; i < len(query); {
+		c := query[i]
+		start := i
+		kind := tokenOther
+
+		switch {
+		case c <= ' ':
+			i++
+			continue
+
+		case inExecutable && c == '*' && i+1 < len(query) && query[i+1] == '/':
+			inExecutable = false
+			i += 2
+			continue
+
+		case c == '/' && i+2 < len(query) && query[i+1] == '*' && query[i+2] == '!' && !inExecutable:
+			inExecutable = true
+			i += 3 + len(query[i+3:]) - len(executableCommentBody(query[i+3:]))
+			continue
+
+		case c == '#' || (c == '-' && i+1 < len(query) && query[i+1] == '-' && (i+2 == len(query) || query[i+2] <= ' ')):
+			i = skipLine(query, i) + 1
+			continue
+
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += 2 + end + 2
+			}
+			continue
+
+		case c == '\'' || c == '"':
+			i = skipQuoted(query, i, c) + 1
+			kind = tokenString
+
+		case c == '`':
+			i = skipQuoted(query, i, c) + 1
+			kind = tokenIdent
+
+		case c == '?':
+			i++
+			kind = tokenParam
+
+		case strings.IndexByte("xXbBnN", c) >= 0 && i+1 < len(query) && query[i+1] == '\'':
+			// x'0A' b'01' N'abc'
+			i = skipQuoted(query, i+1, '\'') + 1
+			kind = tokenString
+
+		case isDigit(c) || (c == '.' && i+1 < len(query) && isDigit(query[i+1])):
+			i = scanNumber(query, i)
+			kind = tokenNumber
+
+		case isIdentChar(c):
+			for i < len(query) && isIdentChar(query[i]) {
+				i++
+			}
+			kind = tokenIdent
+
+		case strings.IndexByte("<>=!:", c) >= 0:
+			for i < len(query) && i-start < 3 && strings.IndexByte("<>=!:", query[i]) >= 0 {
+				i++
+			}
+
+		default:
+			i++
+		}
+
+		if i > len(query) {
+			i = len(query)
+		}
+
+		text := strings.ToLower(query[start:i])
+		if c == '`' {
+			text = strings.Trim(text, "`")
+		}
+
+		tokens = append(tokens, &sqlToken{kind: kind, text: text, start: start, end: i})
+	}
+
+	return tokens
+}
+
+func scanNumber(query string, i int) int {
+	if query[i] == '0' && i+1 < len(query) && (query[i+1]|0x20 == 'x' || query[i+1]|0x20 == 'b') {
+		i += 2
+		for i < len(query) && isIdentChar(query[i]) {
+			i++
+		}
+		return i
+	}
+
+	for i < len(query) && (isDigit(query[i]) || query[i] == '.') {
+		i++
+	}
+
+	if i < len(query) && query[i]|0x20 == 'e' {
+		j := i + 1
+		if j < len(query) && (query[j] == '+' || query[j] == '-') {
+			j++
+		}
+
+		if j < len(query) && isDigit(query[j]) {
+			for i = j; i < len(query) && isDigit(query[i]); i++ {
+			}
+		}
+	}
+
+	return i
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentChar(c byte) bool {
+	return isDigit(c) || (c|0x20 >= 'a' && c|0x20 <= 'z') || c == '_' || c == '$' || c >= 0x80
+}
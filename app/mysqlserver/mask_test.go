@@ -0,0 +1,157 @@
+package mysqlserver
+
+import "testing"
+
+func newTestMasker(t *testing.T, m *Masker) *Masker {
+	t.Helper()
+
+	if err := m.init(); err != nil {
+		t.Fatalf("init masker: %s", err)
+	}
+
+	return m
+}
+
+func TestMaskSql(t *testing.T) {
+	columns := newTestMasker(t, &Masker{Columns: []string{"password"}})
+	fingerprint := newTestMasker(t, &Masker{FingerprintOnly: true})
+
+	tests := []struct {
+		name   string
+		masker *Masker
+		query  string
+		want   string
+	}{
+		{"update", columns, "UPDATE user SET password='secret' WHERE id=1", "UPDATE user SET password='***' WHERE id=1"},
+		{"where", columns, "select * from user where password = 'secret'", "select * from user where password = '***'"},
+		{"insert", columns, "insert into user (name, password) values ('a', 'secret')", "insert into user (name, password) values ('a', '***')"},
+		{"other column", columns, "update user set name='a'", "update user set name='a'"},
+		{"block comment", columns, "/* password='secret' */ select 1", "/* password='secret' */ select 1"},
+		{"executable comment", columns, "/*! UPDATE user SET password='secret' */", "/*! UPDATE user SET password='***' */"},
+		{"versioned comment", columns, "/*!50000 UPDATE user SET password='secret' */", "/*!50000 UPDATE user SET password='***' */"},
+		{"versioned comment six digits", columns, "/*!800001 UPDATE user SET password='secret'*/", "/*!800001 UPDATE user SET password='***'*/"},
+		{"versioned comment in statement", columns, "UPDATE user SET /*!50000 password='secret' */ WHERE id=1", "UPDATE user SET /*!50000 password='***' */ WHERE id=1"},
+		{"after executable comment", columns, "/*!50000 SELECT 1 */; UPDATE user SET password='secret'", "/*!50000 SELECT 1 */; UPDATE user SET password='***'"},
+
+		{"fingerprint", fingerprint, "select * from t where a = 'x' and b = 1", "select * from t where a = ? and b = ?"},
+		{"fingerprint versioned comment", fingerprint, "/*!50000 UPDATE user SET password='secret' */", "/*!50000 UPDATE user SET password=? */"},
+		{"fingerprint version is not a literal", fingerprint, "/*!50000 select 1 */", "/*!50000 select ? */"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := tt.masker.maskSql(tt.query)
+			if got != tt.want {
+				t.Errorf("maskSql(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenizeSqlExecutableComment(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"select 1 /* a */", []string{"select", "1"}},
+		{"select 1 /*! a */", []string{"select", "1", "a"}},
+		{"select 1 /*!50000 a */ b", []string{"select", "1", "a", "b"}},
+		{"select 1 /*!5000 a */", []string{"select", "1", "5000", "a"}},
+		{"select 2*/ 1", []string{"select", "2", "*", "/", "1"}},
+		{"select 1 /*! a", []string{"select", "1", "a"}},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, token := range tokenizeSql(tt.query) {
+			got = append(got, token.text)
+		}
+
+		if len(got) != len(tt.want) {
+			t.Errorf("tokenizeSql(%q) = %q, want %q", tt.query, got, tt.want)
+			continue
+		}
+
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("tokenizeSql(%q) = %q, want %q", tt.query, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestMaskErrMsg(t *testing.T) {
+	defer func(m *Masker) {
+		masker = m
+	}(masker)
+
+	columns := newTestMasker(t, &Masker{Columns: []string{"phone"}, Regexes: []*MaskRegex{{Pattern: `1[3-9][0-9]{9}`}}})
+	fingerprint := newTestMasker(t, &Masker{FingerprintOnly: true})
+
+	tests := []struct {
+		name   string
+		masker *Masker
+		msg    string
+		want   string
+	}{
+		{"no masker", nil, "Duplicate entry '13800138000' for key 'user.phone'", "Duplicate entry '13800138000' for key 'user.phone'"},
+		{"duplicate entry", columns, "Duplicate entry '13800138000' for key 'user.phone'", "Duplicate entry '***' for key 'user.phone'"},
+		{"duplicate entry with quote", columns, "Duplicate entry 'it's-a' for key 'user.name'", "Duplicate entry '***' for key 'user.name'"},
+		{"parse error", columns, "You have an error in your SQL syntax; check the manual that corresponds to your MySQL server version for the right syntax to use near 'password='secret'' at line 1",
+			"You have an error in your SQL syntax; check the manual that corresponds to your MySQL server version for the right syntax to use near '***' at line 1"},
+		{"truncated value", columns, "Data too long for column 'phone' at row 1", "Data too long for column '***' at row 1"},
+		{"incorrect value", columns, "Incorrect integer value: 'abc' for column 'age' at row 1", "Incorrect integer value: '***' for column '***' at row 1"},
+		{"unterminated quote", columns, "Unknown column 'secret", "Unknown column '***"},
+		{"regex", columns, "call failed for 13800138000", "call failed for ***"},
+		{"no literal", columns, "Lock wait timeout exceeded; try restarting transaction", "Lock wait timeout exceeded; try restarting transaction"},
+		{"fingerprint", fingerprint, "Duplicate entry '13800138000' for key 'user.phone'", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			masker = tt.masker
+
+			if got := maskErrMsg(tt.msg); got != tt.want {
+				t.Errorf("maskErrMsg(%q) = %q, want %q", tt.msg, got, tt.want)
+			}
+		})
+	}
+}
+
+// 记录文件和jsonl中的错误信息都经过脱敏, 只记录指纹时保留错误码和SQLSTATE
+func TestRecordErrMsgMasked(t *testing.T) {
+	defer func(m *Masker) {
+		masker = m
+	}(masker)
+
+	result := &QueryResult{Err: NewErrPacket(1062, "23000", "Duplicate entry '13800138000' for key 'user.phone'")}
+	cmd := &QueryCommand{Command: ComQuery, Query: "insert into user (phone) values ('13800138000')", Result: result}
+
+	tests := []struct {
+		name     string
+		masker   *Masker
+		wantText string
+		wantMsg  string
+	}{
+		{"columns", newTestMasker(t, &Masker{Columns: []string{"phone"}}),
+			"【duration:0s error:1062 sqlstate:23000 message:Duplicate entry '***' for key 'user.phone'】", "Duplicate entry '***' for key 'user.phone'"},
+		{"fingerprint", newTestMasker(t, &Masker{FingerprintOnly: true}),
+			"【duration:0s error:1062 sqlstate:23000】", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			masker = tt.masker
+
+			if got := result.String(); got != tt.wantText {
+				t.Errorf("String() = %q, want %q", got, tt.wantText)
+			}
+
+			event := NewRecordEvent(&Session{}, cmd)
+			if event.Result.ErrMsg != tt.wantMsg || event.Result.ErrCode != 1062 || event.Result.SqlState != "23000" {
+				t.Errorf("event result = %+v, want message %q", event.Result, tt.wantMsg)
+			}
+		})
+	}
+}
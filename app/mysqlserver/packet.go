@@ -1,6 +1,9 @@
 package mysqlserver
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"io"
 )
 
@@ -32,16 +35,43 @@ func ReadMysqlPacketByLength(conn io.Reader, dataLength int) ([]byte, error) {
 	return data, nil
 }
 
+// DefaultMaxAllowedPacket 与mysql 8.0默认的max_allowed_packet一致
+const DefaultMaxAllowedPacket = 64 << 20
+
+// maxAllowedPacket 合并后逻辑包的最大长度, 超过时断开连接, 避免对端不断发送拆分的包占满内存
+var maxAllowedPacket = DefaultMaxAllowedPacket
+
+// InitMaxAllowedPacket 设置逻辑包的最大长度, 需要不小于服务端的max_allowed_packet, 否则大的结果集行会被拒绝
+func InitMaxAllowedPacket(size int) error {
+	if size < 1024 || size > 1<<30 {
+		return fmt.Errorf("invalid max_allowed_packet: %d, must be between 1024 and 1073741824", size)
+	}
+
+	maxAllowedPacket = size
+
+	return nil
+}
+
+// ReadMysqlPacket 读取一个逻辑包, 长度为MaxPacketSize的包会和后续的包合并,
+// 直到读到长度小于MaxPacketSize的包(可以是空包), SequenceId为第一个包的序列号
 func ReadMysqlPacket(conn io.Reader) (*MysqlPacket, error) {
+	return ReadMysqlPacketLimit(conn, maxAllowedPacket)
+}
+
+// ReadMysqlPacketLimit 同ReadMysqlPacket, 逻辑包长度超过limit时返回错误
+// 认证完成前客户端的包不会超过MaxPacketSize, 使用MaxPacketSize限制未认证的连接
+func ReadMysqlPacketLimit(conn io.Reader, limit int) (*MysqlPacket, error) {
 	header, err := ReadMysqlPacketHeader(conn)
 	if err != nil {
 		return nil, err
 	}
 	//fmt.Printf("%+v\n", header)
 
-	data := make([]byte, header.Length)
+	if int(header.Length) > limit {
+		return nil, fmt.Errorf("packet too large: %d > %d", header.Length, limit)
+	}
 
-	_, err = io.ReadFull(conn, data)
+	data, err := ReadMysqlPacketByLength(conn, int(header.Length))
 	if err != nil {
 		return nil, err
 	}
@@ -51,5 +81,82 @@ func ReadMysqlPacket(conn io.Reader) (*MysqlPacket, error) {
 	}
 	res.MysqlPacketHeader = *header
 
+	length := header.Length
+	lastSequenceId := header.SequenceId
+
+	for length == MaxPacketSize {
+		next, err := ReadMysqlPacketHeader(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		if next.SequenceId != lastSequenceId+1 {
+			return nil, fmt.Errorf("packet sequence err: expect %d got %d", lastSequenceId+1, next.SequenceId)
+		}
+
+		if len(res.Payload)+int(next.Length) > limit {
+			return nil, fmt.Errorf("packet too large: %d > %d", len(res.Payload)+int(next.Length), limit)
+		}
+
+		more, err := ReadMysqlPacketByLength(conn, int(next.Length))
+		if err != nil {
+			return nil, err
+		}
+
+		res.Payload = append(res.Payload, more...)
+		length = next.Length
+		lastSequenceId = next.SequenceId
+	}
+
+	res.Length = uint32(len(res.Payload))
+
 	return res, nil
 }
+
+// ForwardMysqlPacket 按包把src转发到dst, 每个包在转发前先交给handle处理,
+// 保证记录的顺序与对端实际收到的顺序一致
+func ForwardMysqlPacket(dst io.Writer, src io.Reader, handle func(packet *MysqlPacket)) error {
+	reader := bufio.NewReader(src)
+	writer := bufio.NewWriter(dst)
+
+	for {
+		packet, err := ReadMysqlPacket(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		handle(packet)
+
+		_, err = writer.Write(packet.ToByte())
+		if err != nil {
+			return err
+		}
+
+		// 缓冲区里已经有下一个完整的包时先不flush, 减少大结果集时的系统调用
+		if hasBufferedPacket(reader) {
+			continue
+		}
+
+		err = writer.Flush()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func hasBufferedPacket(reader *bufio.Reader) bool {
+	buffered := reader.Buffered()
+	if buffered < 4 {
+		return false
+	}
+
+	header, err := reader.Peek(4)
+	if err != nil {
+		return false
+	}
+
+	return buffered >= 4+int(ReadUint24(header[:3]))
+}
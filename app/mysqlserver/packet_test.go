@@ -0,0 +1,181 @@
+package mysqlserver
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWithHeaderPacket(t *testing.T) {
+	tests := []struct {
+		name       string
+		length     int
+		sequenceId uint8
+		// 每个包的长度和序列号
+		wantLengths []int
+		wantSeqs    []uint8
+	}{
+		{"empty", 0, 0, []int{0}, []uint8{0}},
+		{"small", 10, 1, []int{10}, []uint8{1}},
+		{"max packet size minus one", MaxPacketSize - 1, 0, []int{MaxPacketSize - 1}, []uint8{0}},
+		{"exactly max packet size", MaxPacketSize, 0, []int{MaxPacketSize, 0}, []uint8{0, 1}},
+		{"multi chunk", 2*MaxPacketSize + 10, 3, []int{MaxPacketSize, MaxPacketSize, 10}, []uint8{3, 4, 5}},
+		{"two max packet size", 2 * MaxPacketSize, 0, []int{MaxPacketSize, MaxPacketSize, 0}, []uint8{0, 1, 2}},
+		{"sequence wrap", MaxPacketSize + 1, 255, []int{MaxPacketSize, 1}, []uint8{255, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := bytes.Repeat([]byte{'x'}, tt.length)
+			packet := WithHeaderPacket(data, tt.sequenceId)
+
+			var lengths []int
+			var seqs []uint8
+			for rest := packet; len(rest) > 0; {
+				length := int(ReadUint24(rest[:3]))
+				lengths = append(lengths, length)
+				seqs = append(seqs, rest[3])
+				rest = rest[4+length:]
+			}
+
+			if len(lengths) != len(tt.wantLengths) {
+				t.Fatalf("lengths = %v, want %v", lengths, tt.wantLengths)
+			}
+
+			for i := range lengths {
+				if lengths[i] != tt.wantLengths[i] || seqs[i] != tt.wantSeqs[i] {
+					t.Errorf("packet %d length:%d seq:%d, want length:%d seq:%d", i, lengths[i], seqs[i], tt.wantLengths[i], tt.wantSeqs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReadMysqlPacket(t *testing.T) {
+	tests := []struct {
+		name       string
+		length     int
+		sequenceId uint8
+	}{
+		{"small", 10, 0},
+		{"exactly max packet size", MaxPacketSize, 0},
+		{"multi chunk", 2*MaxPacketSize + 10, 1},
+		{"sequence wrap", 2*MaxPacketSize + 10, 255},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := make([]byte, tt.length)
+			for i := range data {
+				data[i] = byte(i)
+			}
+
+			// 后面跟一个包, 确认只读取了一个逻辑包, 包括结尾的空包
+			stream := append(WithHeaderPacket(data, tt.sequenceId), WithHeaderPacket([]byte("next"), 0)...)
+			reader := bytes.NewReader(stream)
+
+			packet, err := ReadMysqlPacket(reader)
+			if err != nil {
+				t.Fatalf("read packet: %s", err)
+			}
+
+			if !bytes.Equal(packet.Payload, data) {
+				t.Errorf("payload length %d, want %d", len(packet.Payload), len(data))
+			}
+
+			if packet.SequenceId != tt.sequenceId || int(packet.Length) != tt.length {
+				t.Errorf("seq:%d length:%d, want seq:%d length:%d", packet.SequenceId, packet.Length, tt.sequenceId, tt.length)
+			}
+
+			if !bytes.Equal(packet.ToByte(), stream[:len(stream)-8]) {
+				t.Errorf("ToByte does not match the original packets")
+			}
+
+			wantLast := tt.sequenceId + uint8(tt.length/MaxPacketSize)
+			if packet.LastSequenceId() != wantLast {
+				t.Errorf("LastSequenceId = %d, want %d", packet.LastSequenceId(), wantLast)
+			}
+
+			next, err := ReadMysqlPacket(reader)
+			if err != nil || string(next.Payload) != "next" {
+				t.Errorf("next packet = %v %v, want next", next, err)
+			}
+		})
+	}
+}
+
+func TestReadMysqlPacketErr(t *testing.T) {
+	full := WithHeaderPacket(make([]byte, MaxPacketSize+1), 0)
+
+	wrongSeq := append([]byte{}, full...)
+	wrongSeq[4+MaxPacketSize+3] = 5
+
+	tests := []struct {
+		name  string
+		data  []byte
+		limit int
+	}{
+		{"wrong sequence", wrongSeq, DefaultMaxAllowedPacket},
+		{"truncated chunk", full[:len(full)-1], DefaultMaxAllowedPacket},
+		{"missing next chunk", full[:4+MaxPacketSize], DefaultMaxAllowedPacket},
+		{"first chunk over limit", WithHeaderPacket(make([]byte, 2048), 0), 1024},
+		{"reassembly over limit", full, MaxPacketSize},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadMysqlPacketLimit(bytes.NewReader(tt.data), tt.limit)
+			if err == nil {
+				t.Errorf("ReadMysqlPacketLimit err = nil")
+			}
+		})
+	}
+}
+
+// 未认证的连接使用MaxPacketSize限制, 正好MaxPacketSize的包加结尾空包仍然可以读取
+func TestReadMysqlPacketLimitBoundary(t *testing.T) {
+	data := make([]byte, MaxPacketSize)
+
+	packet, err := ReadMysqlPacketLimit(bytes.NewReader(WithHeaderPacket(data, 1)), MaxPacketSize)
+	if err != nil {
+		t.Fatalf("read packet: %s", err)
+	}
+
+	if len(packet.Payload) != MaxPacketSize {
+		t.Errorf("payload length %d, want %d", len(packet.Payload), MaxPacketSize)
+	}
+}
+
+func TestInitMaxAllowedPacket(t *testing.T) {
+	defer func() {
+		maxAllowedPacket = DefaultMaxAllowedPacket
+	}()
+
+	tests := []struct {
+		size    int
+		wantErr bool
+	}{
+		{0, true},
+		{1023, true},
+		{1024, false},
+		{DefaultMaxAllowedPacket, false},
+		{1 << 30, false},
+		{1<<30 + 1, true},
+	}
+
+	for _, tt := range tests {
+		err := InitMaxAllowedPacket(tt.size)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("InitMaxAllowedPacket(%d) err = %v, wantErr %v", tt.size, err, tt.wantErr)
+		}
+	}
+
+	err := InitMaxAllowedPacket(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ReadMysqlPacket(bytes.NewReader(WithHeaderPacket(make([]byte, 1025), 0)))
+	if err == nil {
+		t.Errorf("ReadMysqlPacket over max_allowed_packet err = nil")
+	}
+}
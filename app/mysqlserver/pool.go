@@ -0,0 +1,404 @@
+package mysqlserver
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"proxymysql/app/zlog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErConCount ER_CON_COUNT_ERROR, 连接池等待超时时返回给客户端
+const ErConCount = 1040
+
+// 为nil时不使用连接池, 每个客户端独占一个服务端连接
+var backendPool *BackendPool
+
+// poolKey 登录账号 当前库 影响响应格式的capability 字符集和执行过的SET语句都相同的连接可以直接复用,
+// 只有库和SET语句不同的连接重置会话后复用
+type poolKey struct {
+	backend    string
+	user       string
+	schema     string
+	capability uint32
+	charset    uint8
+	// 连接上按顺序执行过的SET语句的sha256
+	sets [sha256.Size]byte
+}
+
+// sameAccount 登录账号 capability和字符集相同, COM_RESET_CONNECTION后重新同步库和SET语句即可复用
+func (k poolKey) sameAccount(o poolKey) bool {
+	return k.backend == o.backend && k.user == o.user && k.capability == o.capability && k.charset == o.charset
+}
+
+// BackendPool 已认证的服务端连接池, 客户端在事务中或自动提交的一条语句期间租用一个连接
+type BackendPool struct {
+	// 每个后端的最大连接数, 包括空闲和使用中的连接
+	size        int
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+
+	mu   sync.Mutex
+	idle map[poolKey][]*backendConn
+	open map[*Backend]int
+	// 连接数已满时按先后顺序等待的acquire, 有连接归还或关闭时通知第一个
+	waiters map[*Backend][]chan struct{}
+}
+
+// InitBackendPool size为0时不使用连接池, 连接池需要代理认证, 代理用服务账号登录服务端
+func InitBackendPool(size int, idleTimeout time.Duration, maxLifetime time.Duration) error {
+	if size == 0 {
+		return nil
+	}
+
+	if size < 0 || idleTimeout <= 0 || maxLifetime <= 0 {
+		return fmt.Errorf("invalid pool config: size:%d idle_timeout:%s max_lifetime:%s", size, idleTimeout, maxLifetime)
+	}
+
+	if !proxyAuthEnabled() {
+		return fmt.Errorf("backend pool requires auth_user_file")
+	}
+
+	backendPool = &BackendPool{
+		size:        size,
+		idleTimeout: idleTimeout,
+		maxLifetime: maxLifetime,
+		idle:        make(map[poolKey][]*backendConn),
+		open:        make(map[*Backend]int),
+		waiters:     make(map[*Backend][]chan struct{}),
+	}
+
+	go backendPool.reap()
+
+	return nil
+}
+
+// acquire 返回key对应的空闲连接, reset为true时连接的库或SET语句不同, 需要调用方重置会话后重新同步
+// 没有空闲连接时占用一个连接数并返回nil, 由调用方新建连接
+// 连接数已满时关闭其他账号的空闲连接腾出位置, 都在使用中时按先后顺序等待connect_timeout
+func (b *BackendPool) acquire(backend *Backend, key poolKey) (c *backendConn, reset bool, err error) {
+	b.mu.Lock()
+
+	// 已经有等待的请求时排在后面, 不插队
+	if len(b.waiters[backend]) == 0 {
+		c, reset, ok := b.tryAcquireLocked(backend, key)
+		if ok {
+			b.mu.Unlock()
+			return c, reset, nil
+		}
+	}
+
+	wait := make(chan struct{}, 1)
+	b.waiters[backend] = append(b.waiters[backend], wait)
+	b.mu.Unlock()
+
+	timer := time.NewTimer(connectTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-wait:
+			b.mu.Lock()
+
+			c, reset, ok := b.tryAcquireLocked(backend, key)
+			if ok {
+				b.removeWaiterLocked(backend, wait)
+				b.mu.Unlock()
+				return c, reset, nil
+			}
+
+			b.mu.Unlock()
+
+		case <-timer.C:
+			b.mu.Lock()
+			b.removeWaiterLocked(backend, wait)
+			b.mu.Unlock()
+
+			return nil, false, fmt.Errorf("backend %s pool exhausted, size:%d", backend.Name, b.size)
+		}
+	}
+}
+
+// removeWaiterLocked 等待结束后移出队列, 通知下一个, 可能还有可用的连接或已经通知过自己
+func (b *BackendPool) removeWaiterLocked(backend *Backend, wait chan struct{}) {
+	waiters := b.waiters[backend]
+
+	for i, w := range waiters {
+		if w == wait {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+
+	if len(waiters) == 0 {
+		delete(b.waiters, backend)
+	} else {
+		b.waiters[backend] = waiters
+	}
+
+	b.notifyLocked(backend)
+}
+
+// notifyLocked 有连接归还或连接数减少时通知第一个等待的acquire
+func (b *BackendPool) notifyLocked(backend *Backend) {
+	if waiters := b.waiters[backend]; len(waiters) > 0 {
+		select {
+		case waiters[0] <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// tryAcquireLocked 优先使用key相同的空闲连接, 其次是同一账号的空闲连接, 都没有时占用一个连接数
+func (b *BackendPool) tryAcquireLocked(backend *Backend, key poolKey) (*backendConn, bool, bool) {
+	now := time.Now()
+
+	for conns := b.idle[key]; len(conns) > 0; conns = b.idle[key] {
+		c := conns[len(conns)-1]
+		b.popIdleLocked(key)
+
+		if b.expired(c, now) {
+			b.closeLocked(c)
+			continue
+		}
+
+		return c, false, true
+	}
+
+	for other, conns := range b.idle {
+		if !other.sameAccount(key) {
+			continue
+		}
+
+		for len(conns) > 0 {
+			c := conns[len(conns)-1]
+			conns = b.popIdleLocked(other)
+
+			if b.expired(c, now) {
+				b.closeLocked(c)
+				continue
+			}
+
+			return c, true, true
+		}
+	}
+
+	if b.open[backend] >= b.size && !b.evictLocked(backend) {
+		return nil, false, false
+	}
+
+	b.open[backend]++
+
+	return nil, false, true
+}
+
+// popIdleLocked 移除key最近归还的空闲连接, 返回剩余的空闲连接
+func (b *BackendPool) popIdleLocked(key poolKey) []*backendConn {
+	conns := b.idle[key][:len(b.idle[key])-1]
+
+	if len(conns) == 0 {
+		delete(b.idle, key)
+	} else {
+		b.idle[key] = conns
+	}
+
+	return conns
+}
+
+// evictLocked 关闭后端最久未使用的一个空闲连接
+func (b *BackendPool) evictLocked(backend *Backend) bool {
+	var (
+		oldestKey poolKey
+		oldest    *backendConn
+	)
+
+	for key, conns := range b.idle {
+		if key.backend == backend.Name && len(conns) > 0 && (oldest == nil || conns[0].idleAt.Before(oldest.idleAt)) {
+			oldestKey, oldest = key, conns[0]
+		}
+	}
+
+	if oldest == nil {
+		return false
+	}
+
+	if len(b.idle[oldestKey]) == 1 {
+		delete(b.idle, oldestKey)
+	} else {
+		b.idle[oldestKey] = b.idle[oldestKey][1:]
+	}
+	b.closeLocked(oldest)
+
+	return true
+}
+
+// adopt 把不是连接池建立的连接放入连接池, 连接数已满时关闭
+func (b *BackendPool) adopt(c *backendConn, key poolKey) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.open[c.backend] >= b.size {
+		_, _ = c.conn.Write(WithHeaderPacket([]byte{ComQuit}, 0))
+		_ = c.conn.Close()
+		return
+	}
+
+	b.open[c.backend]++
+	c.idleAt = time.Now()
+	b.idle[key] = append(b.idle[key], c)
+	b.notifyLocked(c.backend)
+}
+
+// release 归还连接, key需要与连接上的库和SET语句一致
+func (b *BackendPool) release(c *backendConn, key poolKey) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.createdAt) >= b.maxLifetime {
+		b.closeLocked(c)
+		return
+	}
+
+	c.idleAt = now
+	b.idle[key] = append(b.idle[key], c)
+	b.notifyLocked(c.backend)
+}
+
+// discard 关闭状态未知的连接, c为nil时只释放acquire占用的连接数
+func (b *BackendPool) discard(backend *Backend, c *backendConn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c == nil {
+		b.open[backend]--
+		b.notifyLocked(backend)
+		return
+	}
+
+	b.closeLocked(c)
+}
+
+func (b *BackendPool) closeLocked(c *backendConn) {
+	b.open[c.backend]--
+	b.notifyLocked(c.backend)
+
+	_, _ = c.conn.Write(WithHeaderPacket([]byte{ComQuit}, 0))
+	_ = c.conn.Close()
+}
+
+func (b *BackendPool) expired(c *backendConn, now time.Time) bool {
+	return now.Sub(c.idleAt) >= b.idleTimeout || now.Sub(c.createdAt) >= b.maxLifetime
+}
+
+// reap 定时关闭空闲超时和超过最长存活时间的连接
+func (b *BackendPool) reap() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		b.mu.Lock()
+
+		for key, conns := range b.idle {
+			alive := conns[:0]
+			for _, c := range conns {
+				if b.expired(c, now) {
+					b.closeLocked(c)
+					continue
+				}
+				alive = append(alive, c)
+			}
+
+			if len(alive) == 0 {
+				delete(b.idle, key)
+			} else {
+				b.idle[key] = alive
+			}
+		}
+
+		b.mu.Unlock()
+	}
+}
+
+// poolKey 当前会话在连接池中的key, sets为连接上已经执行的SET语句
+func (p *ProxyConn) poolKey(schema string, sets []string) poolKey {
+	return poolKey{
+		backend:    p.backend.Name,
+		user:       p.proxyUser.BackendUser,
+		schema:     schema,
+		capability: p.serverResp.ClientFlag & replicaCapabilityMask,
+		charset:    p.serverResp.Charset,
+		sets:       sha256.Sum256([]byte(strings.Join(sets, "\x00"))),
+	}
+}
+
+// leasePrimary 从连接池租用主库连接, 库和SET语句相同的连接直接使用, 否则重置会话后同步当前库和SET语句
+func (p *ProxyConn) leasePrimary(split *readWriteSplit) error {
+	c, reset, err := backendPool.acquire(p.backend, p.poolKey(p.session.Schema, split.sets))
+	if err != nil {
+		return err
+	}
+
+	if reset {
+		err = p.execInternal(c, []byte{ComResetConnection})
+		if err != nil {
+			backendPool.discard(p.backend, c)
+			return err
+		}
+
+		// 重置不改变当前库, SET语句需要重新同步
+		c.sets = 0
+	} else if c != nil {
+		c.sets = len(split.sets)
+	}
+
+	if c == nil {
+		conn, err := p.dialBackend(p.backend)
+		if err != nil {
+			backendPool.discard(p.backend, nil)
+			return err
+		}
+
+		c = newBackendConn(p.backend, conn)
+		c.schema = p.session.Schema
+
+		zlog.Debugf("connection_id:%d pool create conn to backend:%s", p.session.ConnectionId, p.backend.Name)
+	}
+
+	err = p.syncSession(c, split.sets)
+	if err != nil {
+		backendPool.discard(p.backend, c)
+		return err
+	}
+
+	split.primary = c
+
+	return nil
+}
+
+// releasePrimary 把主库连接归还连接池, 连接上的库和SET语句记在key中, 同样会话的下一次租用不需要重置和同步
+// 执行过无法重放的SET语句时先用COM_RESET_CONNECTION清理会话
+// 临时表 锁 用户变量 预处理语句会让会话粘滞不会归还, LAST_INSERT_ID()等语句级的状态不会清理
+func (p *ProxyConn) releasePrimary(split *readWriteSplit) {
+	c := split.primary
+	split.primary = nil
+
+	c.schema = p.session.Schema
+	c.sets = len(split.sets)
+
+	if split.dirty {
+		split.dirty = false
+
+		err := p.execInternal(c, []byte{ComResetConnection})
+		if err != nil {
+			zlog.Warnf("connection_id:%d reset pooled conn err: %s", p.session.ConnectionId, err)
+			backendPool.discard(c.backend, c)
+			return
+		}
+
+		c.sets = 0
+	}
+
+	backendPool.release(c, p.poolKey(c.schema, split.sets[:c.sets]))
+}
@@ -0,0 +1,210 @@
+package mysqlserver
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer 对每条命令返回OK包, 记录收到的命令
+type fakeServer struct {
+	mu       sync.Mutex
+	commands []string
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	for {
+		pk, err := ReadMysqlPacket(conn)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.commands = append(s.commands, string(pk.Payload))
+		s.mu.Unlock()
+
+		_, err = conn.Write(WithHeaderPacket([]byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}, 1))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// take 返回上次调用后收到的命令
+func (s *fakeServer) take() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	commands := s.commands
+	s.commands = nil
+
+	return commands
+}
+
+func newTestPool(t *testing.T, size int) {
+	t.Helper()
+
+	pool, timeout := backendPool, connectTimeout
+	t.Cleanup(func() {
+		backendPool = pool
+		connectTimeout = timeout
+	})
+
+	backendPool = &BackendPool{
+		size:        size,
+		idleTimeout: time.Hour,
+		maxLifetime: time.Hour,
+		idle:        make(map[poolKey][]*backendConn),
+		open:        make(map[*Backend]int),
+		waiters:     make(map[*Backend][]chan struct{}),
+	}
+}
+
+func newTestPooledConn(backend *Backend, schema string) (*ProxyConn, *readWriteSplit) {
+	p := &ProxyConn{
+		backend:    backend,
+		session:    &Session{Schema: schema},
+		proxyUser:  &ProxyUser{BackendUser: "app"},
+		serverResp: &HandshakeResponse{},
+	}
+
+	return p, &readWriteSplit{backend: backend, pooled: true, autocommit: true, writeStmts: make(map[uint32]bool)}
+}
+
+// 会话的库和SET语句与空闲连接相同时, 每条语句租用和归还连接不执行内部命令
+func TestPoolLeaseInternalCommands(t *testing.T) {
+	newTestPool(t, 1)
+
+	server := &fakeServer{}
+	client, serverConn := net.Pipe()
+	go server.serve(serverConn)
+	t.Cleanup(func() { _ = client.Close() })
+
+	backend := &Backend{Name: "a"}
+	p, split := newTestPooledConn(backend, "db1")
+
+	// 登录后的连接没有执行过SET语句
+	c := newBackendConn(backend, client)
+	c.schema = "db1"
+	backendPool.adopt(c, p.poolKey("db1", nil))
+
+	split.sets = []string{"SET NAMES utf8mb4", "SET sql_mode=''"}
+
+	reset := string([]byte{ComResetConnection})
+	steps := []struct {
+		name   string
+		schema string
+		dirty  bool
+		want   []string
+	}{
+		{"first lease", "db1", false, []string{reset, "\x03SET NAMES utf8mb4", "\x03SET sql_mode=''"}},
+		{"same session", "db1", false, nil},
+		{"same session again", "db1", false, nil},
+		{"schema changed", "db2", false, []string{reset, "\x02db2", "\x03SET NAMES utf8mb4", "\x03SET sql_mode=''"}},
+		{"back to same session", "db2", false, nil},
+		// SET TRANSACTION等无法重放的语句执行后归还前重置
+		{"dirty", "db2", true, []string{reset}},
+		{"after dirty", "db2", false, []string{reset, "\x03SET NAMES utf8mb4", "\x03SET sql_mode=''"}},
+	}
+
+	for _, step := range steps {
+		p.session.Schema = step.schema
+
+		err := p.leasePrimary(split)
+		if err != nil {
+			t.Fatalf("%s: lease: %s", step.name, err)
+		}
+
+		split.dirty = step.dirty
+		p.releasePrimary(split)
+
+		got := server.take()
+		if len(got) != len(step.want) {
+			t.Errorf("%s: commands = %q, want %q", step.name, got, step.want)
+			continue
+		}
+
+		for i := range got {
+			if got[i] != step.want[i] {
+				t.Errorf("%s: commands = %q, want %q", step.name, got, step.want)
+				break
+			}
+		}
+	}
+}
+
+// 连接数已满时按先后顺序等待, 有连接归还时唤醒第一个, 超过connect_timeout返回错误
+func TestPoolAcquireWait(t *testing.T) {
+	newTestPool(t, 1)
+	connectTimeout = time.Second
+
+	backend := &Backend{Name: "a"}
+	key := poolKey{backend: backend.Name}
+
+	c, _, err := backendPool.acquire(backend, key)
+	if err != nil || c != nil {
+		t.Fatalf("acquire = %v %v, want new conn slot", c, err)
+	}
+	held := &backendConn{backend: backend, createdAt: time.Now()}
+
+	order := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			c, _, err := backendPool.acquire(backend, key)
+			if err != nil {
+				order <- -1
+				return
+			}
+
+			order <- i
+			backendPool.release(c, key)
+		}(i)
+
+		// 等待前一个开始排队
+		for {
+			backendPool.mu.Lock()
+			n := len(backendPool.waiters[backend])
+			backendPool.mu.Unlock()
+
+			if n == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	backendPool.release(held, key)
+
+	for want := 0; want < 2; want++ {
+		if got := <-order; got != want {
+			t.Errorf("acquire order got %d, want %d", got, want)
+		}
+	}
+
+	// 唯一的连接被占用时等待超时
+	c, _, err = backendPool.acquire(backend, key)
+	if err != nil || c != held {
+		t.Fatalf("acquire = %v %v, want idle conn", c, err)
+	}
+
+	connectTimeout = 20 * time.Millisecond
+
+	start := time.Now()
+	_, _, err = backendPool.acquire(backend, key)
+	if err == nil {
+		t.Errorf("acquire err = nil when pool exhausted")
+	}
+
+	if elapsed := time.Since(start); elapsed < connectTimeout {
+		t.Errorf("acquire returned after %s, want at least %s", elapsed, connectTimeout)
+	}
+
+	backendPool.mu.Lock()
+	waiters := len(backendPool.waiters[backend])
+	backendPool.mu.Unlock()
+
+	if waiters != 0 {
+		t.Errorf("waiters = %d after timeout, want 0", waiters)
+	}
+}
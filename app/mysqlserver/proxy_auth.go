@@ -0,0 +1,560 @@
+package mysqlserver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"net"
+	"os"
+	"proxymysql/app/zlog"
+	"strings"
+)
+
+const (
+	ErAccessDenied = 1045
+
+	// 代理自己完成客户端认证, 再用服务账号登录服务端
+	AuthPathProxy = "proxy_auth"
+)
+
+// ProxyUser 代理用户, 客户端使用代理账号登录, 代理用映射的服务账号登录服务端
+// Password 为空时使用 NativePasswordHash(mysql.user 中的 *HEX 格式) 和 Sha2PasswordHash(hex(SHA256(SHA256(password))))
+type ProxyUser struct {
+	User               string `json:"user"`
+	Password           string `json:"password"`
+	NativePasswordHash string `json:"native_password_hash"`
+	Sha2PasswordHash   string `json:"sha2_password_hash"`
+	BackendUser        string `json:"backend_user"`
+	BackendPassword    string `json:"backend_password"`
+
+	// SHA1(SHA1(password))
+	nativeStage2 []byte
+	// SHA256(SHA256(password))
+	sha2Digest []byte
+}
+
+// 为nil时不启用代理认证, 客户端的认证信息直接转发给服务端
+var proxyUsers map[string]*ProxyUser
+
+// InitProxyAuth 从json文件加载代理用户, 文件为空时不启用
+func InitProxyAuth(userFile string) error {
+	if userFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(userFile)
+	if err != nil {
+		return err
+	}
+
+	var users []*ProxyUser
+
+	err = jsoniter.Unmarshal(data, &users)
+	if err != nil {
+		return fmt.Errorf("parse user file err: %w", err)
+	}
+
+	res := make(map[string]*ProxyUser, len(users))
+
+	for _, user := range users {
+		if user.User == "" || user.BackendUser == "" {
+			return fmt.Errorf("user and backend_user are required: %+v", user)
+		}
+
+		if _, ok := res[user.User]; ok {
+			return fmt.Errorf("duplicate user: %s", user.User)
+		}
+
+		err = user.init()
+		if err != nil {
+			return fmt.Errorf("user %s: %w", user.User, err)
+		}
+
+		res[user.User] = user
+	}
+
+	proxyUsers = res
+
+	zlog.Infof("proxy auth enabled, users: %d", len(res))
+
+	return nil
+}
+
+func proxyAuthEnabled() bool {
+	return proxyUsers != nil
+}
+
+func (u *ProxyUser) init() error {
+	if u.Password != "" {
+		stage1 := sha1.Sum([]byte(u.Password))
+		stage2 := sha1.Sum(stage1[:])
+		u.nativeStage2 = stage2[:]
+
+		digest1 := sha256.Sum256([]byte(u.Password))
+		digest2 := sha256.Sum256(digest1[:])
+		u.sha2Digest = digest2[:]
+
+		return nil
+	}
+
+	if u.NativePasswordHash != "" {
+		stage2, err := hex.DecodeString(strings.TrimPrefix(u.NativePasswordHash, "*"))
+		if err != nil || len(stage2) != sha1.Size {
+			return fmt.Errorf("invalid native_password_hash")
+		}
+		u.nativeStage2 = stage2
+	}
+
+	if u.Sha2PasswordHash != "" {
+		digest, err := hex.DecodeString(u.Sha2PasswordHash)
+		if err != nil || len(digest) != sha256.Size {
+			return fmt.Errorf("invalid sha2_password_hash")
+		}
+		u.sha2Digest = digest
+	}
+
+	return nil
+}
+
+// emptyPassword 没有配置任何密码时只允许空密码登录
+func (u *ProxyUser) emptyPassword() bool {
+	return u.nativeStage2 == nil && u.sha2Digest == nil
+}
+
+func (u *ProxyUser) supportPlugin(plugin string) bool {
+	switch AuthMethodDescription(plugin) {
+	case MysqlNativePassword:
+		return u.nativeStage2 != nil || u.emptyPassword()
+	case CachingSha2Password:
+		return u.sha2Digest != nil || u.emptyPassword()
+	}
+
+	return false
+}
+
+// choosePlugin 客户端使用的插件不支持时选择代理用户的密码支持的插件
+func (u *ProxyUser) choosePlugin(plugin string) string {
+	for _, candidate := range []string{plugin, string(CachingSha2Password), string(MysqlNativePassword)} {
+		if u.supportPlugin(candidate) {
+			return candidate
+		}
+	}
+
+	return string(MysqlNativePassword)
+}
+
+func authSwitchRequest(plugin string, scramble []byte, seq uint8) []byte {
+	data := make([]byte, 0, len(plugin)+len(scramble)+3)
+	data = append(data, AuthSwitchRequestPacket)
+	data = append(data, WriteStringNull(plugin)...)
+	data = append(data, WriteStringNull(string(scramble))...)
+
+	return WithHeaderPacket(data, seq)
+}
+
+// verify 校验客户端用scramble计算的认证数据
+func (u *ProxyUser) verify(plugin string, authData []byte, scramble []byte) bool {
+	if u.emptyPassword() {
+		return len(authData) == 0
+	}
+
+	switch AuthMethodDescription(plugin) {
+	case MysqlNativePassword:
+		// authData = SHA1(password) XOR SHA1(scramble + SHA1(SHA1(password)))
+		if len(authData) != sha1.Size {
+			return false
+		}
+
+		hash := sha1.New()
+		hash.Write(scramble)
+		hash.Write(u.nativeStage2)
+
+		stage1 := hash.Sum(nil)
+		for i := range stage1 {
+			stage1[i] ^= authData[i]
+		}
+
+		stage2 := sha1.Sum(stage1)
+
+		return subtle.ConstantTimeCompare(stage2[:], u.nativeStage2) == 1
+
+	case CachingSha2Password:
+		// authData = SHA256(password) XOR SHA256(SHA256(SHA256(password)) + scramble)
+		if len(authData) != sha256.Size {
+			return false
+		}
+
+		hash := sha256.New()
+		hash.Write(u.sha2Digest)
+		hash.Write(scramble)
+
+		digest1 := hash.Sum(nil)
+		for i := range digest1 {
+			digest1[i] ^= authData[i]
+		}
+
+		digest2 := sha256.Sum256(digest1)
+
+		return subtle.ConstantTimeCompare(digest2[:], u.sha2Digest) == 1
+	}
+
+	return false
+}
+
+// scramblePassword 客户端一侧的认证数据计算, 用于代理登录服务端
+func scramblePassword(plugin string, password string, scramble []byte) []byte {
+	if password == "" {
+		return nil
+	}
+
+	switch AuthMethodDescription(plugin) {
+	case MysqlNativePassword:
+		stage1 := sha1.Sum([]byte(password))
+		stage2 := sha1.Sum(stage1[:])
+
+		hash := sha1.New()
+		hash.Write(scramble)
+		hash.Write(stage2[:])
+
+		res := hash.Sum(nil)
+		for i := range res {
+			res[i] ^= stage1[i]
+		}
+
+		return res
+
+	case CachingSha2Password:
+		digest1 := sha256.Sum256([]byte(password))
+		digest2 := sha256.Sum256(digest1[:])
+
+		hash := sha256.New()
+		hash.Write(digest2[:])
+		hash.Write(scramble)
+
+		res := hash.Sum(nil)
+		for i := range res {
+			res[i] ^= digest1[i]
+		}
+
+		return res
+	}
+
+	return nil
+}
+
+// authenticateClient 用代理的scramble校验客户端, 返回代理用户和最后一个客户端包的序列号
+func (p *ProxyConn) authenticateClient(resp *HandshakeResponse, scramble []byte) (*ProxyUser, uint8, error) {
+	seq := resp.SequenceId + uint8(resp.Length/MaxPacketSize)
+	plugin := resp.AuthPluginMethod
+	authData := resp.Password
+
+	user, ok := proxyUsers[resp.Username]
+	if !ok {
+		return nil, seq, p.denyClient(resp, seq)
+	}
+
+	// 客户端使用的插件与代理用户的密码不匹配时要求客户端切换插件
+	if !user.supportPlugin(plugin) {
+		plugin = user.choosePlugin(plugin)
+
+		_, err := p.clientConn.Write(authSwitchRequest(plugin, scramble, seq+1))
+		if err != nil {
+			return nil, seq, err
+		}
+
+		pk, err := ReadMysqlPacketLimit(p.clientConn, MaxPacketSize)
+		if err != nil {
+			return nil, seq, err
+		}
+
+		seq = pk.LastSequenceId()
+		authData = pk.Payload
+	}
+
+	p.session.AuthPlugin = plugin
+
+	if !user.verify(plugin, authData, scramble) {
+		return nil, seq, p.denyClient(resp, seq)
+	}
+
+	// 代理用户就是caching_sha2_password的缓存, 总是走fast auth
+	if AuthMethodDescription(plugin) == CachingSha2Password {
+		seq++
+
+		_, err := p.clientConn.Write(WithHeaderPacket([]byte{AuthMoreDataPacket, CachingSha2FastAuth}, seq))
+		if err != nil {
+			return nil, seq, err
+		}
+	}
+
+	return user, seq, nil
+}
+
+func (p *ProxyConn) denyClient(resp *HandshakeResponse, seq uint8) error {
+	errPacket := p.accessDenied(resp.Username, len(resp.Password) > 0)
+
+	_, _ = p.clientConn.Write(errPacket.ToByte(seq + 1))
+
+	p.session.AuthPath = AuthPathProxy
+	p.logAuth([]byte{ErrPacket})
+
+	return fmt.Errorf("proxy auth failed: %s", errPacket.ErrMsg)
+}
+
+// mapHandshakeResponse 把客户端的HandshakeResponse换成服务账号
+func (u *ProxyUser) mapHandshakeResponse(resp *HandshakeResponse, plugin string, scramble []byte) {
+	resp.Username = u.BackendUser
+	resp.AuthPluginMethod = plugin
+	resp.Password = scramblePassword(plugin, u.BackendPassword, scramble)
+	// 客户端可能经过了插件切换, 服务端一侧重新从1开始
+	resp.SequenceId = 1
+}
+
+// authenticateBackend 用服务账号完成服务端的认证, 把服务端最终的OK/ERR转发给客户端
+func (p *ProxyConn) authenticateBackend(user *ProxyUser, clientSeq uint8) error {
+	pk, err := authenticateServer(p.serverConn, user, p.scramble)
+	if err != nil {
+		return err
+	}
+
+	p.session.AuthPath = AuthPathProxy
+	p.session.BackendUser = user.BackendUser
+
+	pk.SequenceId = clientSeq + 1
+
+	_, err = p.clientConn.Write(pk.ToByte())
+	if err != nil {
+		return err
+	}
+
+	p.logAuth(pk.Payload)
+
+	if pk.Payload[0] == ErrPacket {
+		errPacket, err := ParseErrPacket(pk.Payload)
+		if err != nil {
+			return err
+		}
+
+		return fmt.Errorf("backend auth failed: %s", errPacket.Error())
+	}
+
+	return nil
+}
+
+// authenticateServer 发送HandshakeResponse之后, 用服务账号完成认证, 返回服务端最终的OK/ERR包
+func authenticateServer(serverConn net.Conn, user *ProxyUser, scramble []byte) (*MysqlPacket, error) {
+	for {
+		pk, err := ReadMysqlPacket(serverConn)
+		if err != nil {
+			return nil, err
+		}
+
+		payload := pk.Payload
+		if len(payload) == 0 {
+			return nil, fmt.Errorf("empty auth packet from server")
+		}
+
+		var reply []byte
+
+		switch {
+		case payload[0] == OKPacket || payload[0] == ErrPacket:
+			return pk, nil
+
+		case payload[0] == AuthSwitchRequestPacket:
+			idx := bytes.IndexByte(payload[1:], 0x00)
+			if idx < 0 {
+				return nil, fmt.Errorf("invalid auth switch request: %+v", payload)
+			}
+
+			plugin := string(payload[1 : idx+1])
+			scramble = bytes.TrimRight(payload[idx+2:], "\x00")
+
+			reply = scramblePassword(plugin, user.BackendPassword, scramble)
+			if reply == nil {
+				reply = []byte{}
+			}
+
+		case len(payload) == 2 && payload[0] == AuthMoreDataPacket && payload[1] == CachingSha2FastAuth:
+			continue
+
+		case len(payload) == 2 && payload[0] == AuthMoreDataPacket && payload[1] == CachingSha2FullAuth:
+			if isTlsConn(serverConn) {
+				reply = WriteStringNull(user.BackendPassword)
+			} else {
+				reply = []byte{cachingSha2RequestPublicKey}
+			}
+
+		case payload[0] == AuthMoreDataPacket:
+			// 服务端返回的公钥
+			reply, err = encryptPassword(WriteStringNull(user.BackendPassword), scramble, payload[1:])
+			if err != nil {
+				return nil, err
+			}
+
+		default:
+			return nil, fmt.Errorf("unexpected auth packet from server: %+v", payload)
+		}
+
+		_, err = serverConn.Write(WithHeaderPacket(reply, pk.LastSequenceId()+1))
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// changeUser 代理认证时拦截COM_CHANGE_USER, 客户端的认证数据是用握手时的scramble计算的, 不能转发给服务端
+// 用新的scramble要求客户端重新认证代理用户, 通过后用映射的服务账号重新登录服务端, 失败时返回ERR包, 会话保持原来的用户
+func (p *ProxyConn) changeUser(split *readWriteSplit, packet *MysqlPacket, clientReader *bufio.Reader,
+	clientWriter *bufio.Writer, rq *RecordQuery) error {
+	seq := packet.LastSequenceId()
+
+	changeUser, err := ParseChangeUser(packet.Payload, p.session.Capability)
+	if err != nil {
+		zlog.Warnf("connection_id:%d parse change user err: %s", p.session.ConnectionId, err)
+		changeUser = &ChangeUser{}
+	}
+
+	user, ok := proxyUsers[changeUser.Username]
+	plugin := changeUser.AuthPluginMethod
+	usingPassword := len(changeUser.AuthResponse) > 0
+
+	if ok {
+		plugin = user.choosePlugin(plugin)
+		scramble := GetAuthPluginData()[:20]
+
+		seq++
+		_, err = clientWriter.Write(authSwitchRequest(plugin, scramble, seq))
+		if err != nil {
+			return err
+		}
+
+		err = clientWriter.Flush()
+		if err != nil {
+			return err
+		}
+
+		reply, err := ReadMysqlPacket(clientReader)
+		if err != nil {
+			return err
+		}
+
+		seq = reply.LastSequenceId()
+		usingPassword = len(reply.Payload) > 0
+		ok = user.verify(plugin, reply.Payload, scramble)
+	}
+
+	last := &MysqlPacket{MysqlPacketHeader: MysqlPacketHeader{SequenceId: seq}}
+
+	if !ok {
+		zlog.Warnf("change user failed, connection_id:%d user:%s new_user:%s plugin:%s path:%s",
+			p.session.ConnectionId, p.session.User, changeUser.Username, plugin, AuthPathProxy)
+
+		return p.writeClientErr(rq, clientWriter, last, p.accessDenied(changeUser.Username, usingPassword))
+	}
+
+	if AuthMethodDescription(plugin) == CachingSha2Password {
+		last.SequenceId++
+
+		_, err = clientWriter.Write(WithHeaderPacket([]byte{AuthMoreDataPacket, CachingSha2FastAuth}, last.SequenceId))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = p.switchBackendUser(split, user, changeUser)
+	if err != nil {
+		zlog.Warnf("connection_id:%d change user %s login backend as %s err: %s",
+			p.session.ConnectionId, changeUser.Username, user.BackendUser, err)
+
+		errPacket, ok := err.(*MysqlErrPacket)
+		if !ok {
+			errPacket = NewErrPacket(ErAccessDenied, "28000", err.Error())
+		}
+
+		return p.writeClientErr(rq, clientWriter, last, errPacket)
+	}
+
+	p.session.AuthPlugin = plugin
+	p.session.BackendUser = user.BackendUser
+
+	zlog.Infof("change user success, connection_id:%d user:%s new_user:%s plugin:%s path:%s backend_user:%s",
+		p.session.ConnectionId, p.session.User, changeUser.Username, plugin, AuthPathProxy, user.BackendUser)
+
+	okPacket := (&MysqlOkPacket{StatusFlags: ServerStatusAutocommit}).ToByte(last.SequenceId + 1)
+
+	// 记录中的会话在OK包之后切换为新的代理用户和库
+	rq.ReadServerPacket(&MysqlPacket{MysqlPacketHeader: MysqlPacketHeader{SequenceId: last.SequenceId + 1}, Payload: okPacket[4:]})
+
+	_, err = clientWriter.Write(okPacket)
+	if err != nil {
+		return err
+	}
+
+	return clientWriter.Flush()
+}
+
+// switchBackendUser 用新代理用户映射的服务账号重新建立主库连接, 原来的主库和副本连接上的会话不再使用
+// 连接池模式下只归还状态, 之后按新的服务账号从连接池租用
+func (p *ProxyConn) switchBackendUser(split *readWriteSplit, user *ProxyUser, changeUser *ChangeUser) error {
+	oldUser, oldResp, oldSchema := p.proxyUser, p.serverResp, p.session.Schema
+
+	resp := *p.serverResp
+	resp.Username = user.BackendUser
+	if changeUser.Charset > 0 {
+		resp.Charset = uint8(changeUser.Charset)
+	}
+
+	// 登录新连接时使用新的库, 会话中的库在记录OK包时切换
+	p.proxyUser, p.serverResp, p.session.Schema = user, &resp, changeUser.Database
+	defer func() {
+		p.session.Schema = oldSchema
+	}()
+
+	var primary *backendConn
+
+	if !split.pooled {
+		conn, err := p.dialBackend(split.backend)
+		if err != nil {
+			p.proxyUser, p.serverResp = oldUser, oldResp
+			return err
+		}
+
+		primary = newBackendConn(split.backend, conn)
+		primary.schema = changeUser.Database
+	}
+
+	if split.pooled {
+		split.closePrimary()
+	} else {
+		_, _ = split.primary.conn.Write(WithHeaderPacket([]byte{ComQuit}, 0))
+		_ = split.primary.conn.Close()
+
+		split.primary = primary
+		p.serverConn = primary.conn
+	}
+
+	split.closeReplica()
+	split.reset()
+
+	return nil
+}
+
+func (p *ProxyConn) accessDenied(username string, usingPassword bool) *MysqlErrPacket {
+	using := "NO"
+	if usingPassword {
+		using = "YES"
+	}
+
+	host, _, err := net.SplitHostPort(p.session.ClientAddr)
+	if err != nil {
+		host = p.session.ClientAddr
+	}
+
+	return NewErrPacket(ErAccessDenied, "28000",
+		fmt.Sprintf("Access denied for user '%s'@'%s' (using password: %s)", username, host, using))
+}
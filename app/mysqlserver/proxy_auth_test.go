@@ -0,0 +1,95 @@
+package mysqlserver
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestProxyUserVerify(t *testing.T) {
+	user := &ProxyUser{User: "alice", Password: "secret", BackendUser: "app"}
+	if err := user.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	scramble := GetAuthPluginData()[:20]
+
+	for _, plugin := range []string{string(MysqlNativePassword), string(CachingSha2Password)} {
+		if !user.verify(plugin, scramblePassword(plugin, "secret", scramble), scramble) {
+			t.Errorf("%s: right password rejected", plugin)
+		}
+
+		if user.verify(plugin, scramblePassword(plugin, "wrong", scramble), scramble) {
+			t.Errorf("%s: wrong password accepted", plugin)
+		}
+
+		// 用其他scramble计算的认证数据不能通过
+		if user.verify(plugin, scramblePassword(plugin, "secret", GetAuthPluginData()[:20]), scramble) {
+			t.Errorf("%s: auth data of another scramble accepted", plugin)
+		}
+	}
+}
+
+func TestChoosePlugin(t *testing.T) {
+	native := &ProxyUser{NativePasswordHash: "*14E65567ABDB5135D0CFD9A70B3032C179A49EE7"}
+	if err := native.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	sha2 := &ProxyUser{Sha2PasswordHash: "73641c99f7719f57d8f4beb11a303afcd190243a51ced8782ca6d3dbe014d146"}
+	if err := sha2.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user   *ProxyUser
+		plugin string
+		want   string
+	}{
+		{native, string(MysqlNativePassword), string(MysqlNativePassword)},
+		{native, string(CachingSha2Password), string(MysqlNativePassword)},
+		{native, "", string(MysqlNativePassword)},
+		{sha2, string(MysqlNativePassword), string(CachingSha2Password)},
+		{sha2, string(CachingSha2Password), string(CachingSha2Password)},
+	}
+
+	for _, tt := range tests {
+		if got := tt.user.choosePlugin(tt.plugin); got != tt.want {
+			t.Errorf("choosePlugin(%q) = %q, want %q", tt.plugin, got, tt.want)
+		}
+	}
+}
+
+func TestGetAuthPluginData(t *testing.T) {
+	a, b := GetAuthPluginData(), GetAuthPluginData()
+
+	if len(a) != 21 || a[20] != 0x00 {
+		t.Fatalf("invalid scramble: %v", a)
+	}
+
+	if bytes.IndexByte(a[:20], 0x00) >= 0 {
+		t.Errorf("scramble contains 0x00: %v", a)
+	}
+
+	if bytes.Equal(a, b) {
+		t.Errorf("scramble is not random: %v", a)
+	}
+}
+
+func TestParseChangeUser(t *testing.T) {
+	payload := []byte{ComChangeUser}
+	payload = append(payload, "carol\x00"...)
+	payload = append(payload, 3, 1, 2, 3)
+	payload = append(payload, "db3\x00"...)
+	payload = append(payload, 45, 0)
+	payload = append(payload, "mysql_native_password\x00"...)
+
+	changeUser, err := ParseChangeUser(payload, CapabilityClientSecureConnection|CapabilityClientPluginAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changeUser.Username != "carol" || changeUser.Database != "db3" || changeUser.Charset != 45 ||
+		changeUser.AuthPluginMethod != "mysql_native_password" || !bytes.Equal(changeUser.AuthResponse, []byte{1, 2, 3}) {
+		t.Errorf("unexpected change user: %+v", changeUser)
+	}
+}
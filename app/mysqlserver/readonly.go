@@ -0,0 +1,118 @@
+package mysqlserver
+
+import (
+	"fmt"
+	"proxymysql/app/zlog"
+	"regexp"
+	"strings"
+)
+
+// ErCantExecuteInReadOnlyTransaction ER_CANT_EXECUTE_IN_READ_ONLY_TRANSACTION, 只读监听拒绝写入时返回给客户端
+const ErCantExecuteInReadOnlyTransaction = 1792
+
+// 只读监听允许的语句, 其余语句全部拒绝
+var readOnlyStatements = map[string]bool{
+	"select": true, "show": true, "explain": true, "describe": true, "desc": true, "help": true,
+	"use": true, "set": true, "begin": true, "start": true, "commit": true, "rollback": true,
+	"savepoint": true, "release": true, "unlock": true, "with": true,
+}
+
+var (
+	// 修改全局状态的SET: SET GLOBAL/PERSIST, SET PASSWORD, SET DEFAULT ROLE
+	globalSetReg = regexp.MustCompile(`(^set\s+|,\s*)(global|persist|persist_only)\b|@@(global|persist|persist_only)\.|^set\s+(password|default\s+role)\b`)
+	// 写文件的SELECT
+	intoFileReg = regexp.MustCompile(`\binto\s+(outfile|dumpfile)\b`)
+	// WITH之后括号外的第一个语句关键字, 是DML时拒绝
+	cteStatementReg    = regexp.MustCompile(`\b(select|table|values|insert|update|delete|replace)\b`)
+	cteWriteStatements = map[string]bool{"insert": true, "update": true, "delete": true, "replace": true}
+)
+
+// readOnlyViolation 返回只读监听拒绝语句的原因, 允许时返回空
+func readOnlyViolation(stmt string) string {
+	masked := strings.TrimLeft(maskStatement(stmt), "( ")
+	keyword := leadingKeyword(masked)
+
+	switch {
+	case keyword == "":
+		return ""
+
+	case !readOnlyStatements[keyword]:
+		return strings.ToUpper(keyword)
+
+	case keyword == "start" && !strings.HasPrefix(masked, "start transaction"):
+		// START REPLICA 等
+		return "START"
+
+	case keyword == "set" && globalSetReg.MatchString(masked):
+		return "SET GLOBAL"
+
+	case (keyword == "select" || keyword == "with") && intoFileReg.MatchString(masked):
+		return "write in " + strings.ToUpper(keyword)
+
+	case keyword == "with":
+		// WITH ... UPDATE/DELETE, 只看CTE定义括号外的语句, SELECT REPLACE(...) 不是写入
+		if cteWriteStatements[cteStatementReg.FindString(outsideParens(masked))] {
+			return "write in WITH"
+		}
+	}
+
+	return ""
+}
+
+// outsideParens 把括号中的内容替换为空格
+func outsideParens(masked string) string {
+	data := []byte(masked)
+	depth := 0
+
+	for i, c := range data {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+			data[i] = ' '
+			continue
+		}
+
+		if depth > 0 {
+			data[i] = ' '
+		}
+	}
+
+	return string(data)
+}
+
+// checkReadOnly 只读监听在命令发往服务端之前检查, 返回拒绝时发给客户端的ERR包
+// 预处理语句在PREPARE时检查, 执行时不再检查
+func (p *ProxyConn) checkReadOnly(payload []byte) *MysqlErrPacket {
+	if !p.listener.ReadOnly {
+		return nil
+	}
+
+	var reason, query string
+
+	switch payload[0] {
+	case ComQuery, ComPrepare:
+		query = string(payload[1:])
+
+		for _, stmt := range executableStatements(query) {
+			reason = readOnlyViolation(stmt)
+			if reason != "" {
+				break
+			}
+		}
+
+	case ComBinlogDump, ComBinlogDumpGTID, ComRegisterReplica:
+		reason = commandTag(payload[0])
+	}
+
+	if reason == "" {
+		return nil
+	}
+
+	zlog.Warnf("read only listener %s reject %s connection_id:%d user:%s client:%s query:%s",
+		p.listener.Listen, reason, p.session.ConnectionId, p.session.User, p.session.ClientAddr, maskQuery(query))
+
+	return NewErrPacket(ErCantExecuteInReadOnlyTransaction, "25006",
+		fmt.Sprintf("Cannot execute %s through a read only proxy listener", reason))
+}
@@ -0,0 +1,81 @@
+package mysqlserver
+
+import "testing"
+
+func TestReadOnlyViolation(t *testing.T) {
+	tests := []struct {
+		stmt string
+		want string
+	}{
+		{"select 1", ""},
+		{"(select 1) union (select 2)", ""},
+		{"show tables", ""},
+		{"explain select 1", ""},
+		{"set names utf8mb4", ""},
+		{"begin", ""},
+		{"start transaction read only", ""},
+		{"select 'insert'", ""},
+		{"SELECT REPLACE(name,'a','b') FROM t", ""},
+		{"SELECT INSERT('abc',1,1,'x')", ""},
+		{"select * from t where `update` = 1", ""},
+		{"with a as (select 1) select * from a", ""},
+		{"with a as (select replace(x,'a','b') from t) select insert(y,1,1,'x') from a", ""},
+		{"with recursive a(n) as (select 1 union all select n+1 from a where n < 3) select n from a", ""},
+
+		{"insert into t values (1)", "INSERT"},
+		{"UPDATE t set a=1", "UPDATE"},
+		{"delete from t", "DELETE"},
+		{"replace into t values (1)", "REPLACE"},
+		{"create table x (a int)", "CREATE"},
+		{"call p()", "CALL"},
+		{"lock tables t read", "LOCK"},
+		{"start replica", "START"},
+		{"set global x=1", "SET GLOBAL"},
+		{"set @a=1, global y=2", "SET GLOBAL"},
+		{"set @@global.x=1", "SET GLOBAL"},
+		{"select * from t into outfile '/tmp/x'", "write in SELECT"},
+		{"with a as (select 1) select * from a into dumpfile '/tmp/x'", "write in WITH"},
+		{"with a as (select 1) update t set b=1", "write in WITH"},
+		{"with a as (select 1) delete from t", "write in WITH"},
+
+		{"/*!50000 DELETE FROM t */", "DELETE"},
+		{"/*!DROP TABLE t*/", "DROP"},
+		{"/* x */ /*!80000 INSERT INTO t VALUES (1) */", "INSERT"},
+		{"/* delete from t */ select 1", ""},
+	}
+
+	for _, tt := range tests {
+		if got := readOnlyViolation(tt.stmt); got != tt.want {
+			t.Errorf("readOnlyViolation(%q) = %q, want %q", tt.stmt, got, tt.want)
+		}
+	}
+}
+
+func TestCheckReadOnly(t *testing.T) {
+	p := &ProxyConn{listener: &Listener{ReadOnly: true}, session: &Session{}}
+
+	tests := []struct {
+		payload []byte
+		reject  bool
+	}{
+		{append([]byte{ComQuery}, "select 1"...), false},
+		{append([]byte{ComQuery}, "select 1; delete from t"...), true},
+		{append([]byte{ComQuery}, "select 1 /*! ; delete from t */"...), true},
+		{append([]byte{ComQuery}, "/*!50000 DELETE FROM t */"...), true},
+		{append([]byte{ComPrepare}, "select replace(?, 'a', 'b')"...), false},
+		{append([]byte{ComPrepare}, "update t set a = ?"...), true},
+		{[]byte{ComBinlogDump, 0, 0, 0, 0}, true},
+		{[]byte{ComPing}, false},
+	}
+
+	for _, tt := range tests {
+		errPacket := p.checkReadOnly(tt.payload)
+		if (errPacket != nil) != tt.reject {
+			t.Errorf("checkReadOnly(%q) = %v, want reject %v", tt.payload, errPacket, tt.reject)
+		}
+
+		if errPacket != nil && (errPacket.ErrCode != ErCantExecuteInReadOnlyTransaction || errPacket.SqlState != "25006") {
+			t.Errorf("checkReadOnly(%q) = %v", tt.payload, errPacket)
+		}
+	}
+}
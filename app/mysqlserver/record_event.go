@@ -0,0 +1,169 @@
+package mysqlserver
+
+import (
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"strings"
+)
+
+// 记录文件格式
+const (
+	RecordFormatText  = "text"
+	RecordFormatJsonl = "jsonl"
+)
+
+var commandNames = map[uint8]string{
+	ComQuit:             "COM_QUIT",
+	ComInitDB:           "COM_INIT_DB",
+	ComQuery:            "COM_QUERY",
+	ComFieldList:        "COM_FIELD_LIST",
+	ComPing:             "COM_PING",
+	ComChangeUser:       "COM_CHANGE_USER",
+	ComBinlogDump:       "COM_BINLOG_DUMP",
+	ComRegisterReplica:  "COM_REGISTER_SLAVE",
+	ComPrepare:          "COM_STMT_PREPARE",
+	ComStmtExecute:      "COM_STMT_EXECUTE",
+	ComStmtSendLongData: "COM_STMT_SEND_LONG_DATA",
+	ComStmtClose:        "COM_STMT_CLOSE",
+	ComStmtReset:        "COM_STMT_RESET",
+	ComSetOption:        "COM_SET_OPTION",
+	ComStmtFetch:        "COM_STMT_FETCH",
+	ComBinlogDumpGTID:   "COM_BINLOG_DUMP_GTID",
+	ComResetConnection:  "COM_RESET_CONNECTION",
+}
+
+func CommandName(command uint8) string {
+	if name, ok := commandNames[command]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("COM_UNKNOWN_%#x", command)
+}
+
+// commandTag 文本格式记录中的标签, 如 INIT_DB STMT_CLOSE
+func commandTag(command uint8) string {
+	return strings.TrimPrefix(CommandName(command), "COM_")
+}
+
+// RecordEvent jsonl格式中的一行
+type RecordEvent struct {
+	Time         string `json:"time"`
+	ConnectionId uint32 `json:"connection_id"`
+	ClientAddr   string `json:"client_addr"`
+	Backend      string `json:"backend,omitempty"`
+	User         string `json:"user"`
+	Schema       string `json:"schema"`
+	// 命令发出时是否在事务中
+	InTransaction bool              `json:"in_transaction"`
+	Variables     map[string]string `json:"variables,omitempty"`
+	ClientAttrs   map[string]string `json:"client_attrs,omitempty"`
+	Command       string            `json:"command"`
+	StmtId        uint32            `json:"stmt_id,omitempty"`
+	// 多语句拆分后的序号, 从1开始
+	StatementIndex int           `json:"statement_index,omitempty"`
+	TrxId          uint64        `json:"trx_id,omitempty"`
+	TrxMark        string        `json:"trx_mark,omitempty"`
+	Server         string        `json:"server,omitempty"`
+	Sql            string        `json:"sql"`
+	Args           []interface{} `json:"args,omitempty"`
+	Result         *RecordResult `json:"result,omitempty"`
+}
+
+type RecordResult struct {
+	DurationMs   float64 `json:"duration_ms"`
+	AffectedRows uint64  `json:"affected_rows"`
+	LastInsertId uint64  `json:"last_insert_id"`
+	Warnings     uint16  `json:"warnings"`
+	RowCount     uint64  `json:"rows"`
+	ErrCode      uint16  `json:"error_code,omitempty"`
+	SqlState     string  `json:"sql_state,omitempty"`
+	ErrMsg       string  `json:"error_message,omitempty"`
+}
+
+func NewRecordEvent(session *Session, cmd *QueryCommand) *RecordEvent {
+	query, args := maskCommand(cmd)
+
+	event := &RecordEvent{
+		Time:           cmd.StartTime.Format("2006-01-02 15:04:05.000"),
+		ConnectionId:   session.ConnectionId,
+		ClientAddr:     session.ClientAddr,
+		Backend:        session.Backend,
+		User:           session.User,
+		Schema:         session.Schema,
+		InTransaction:  session.InTransaction,
+		Variables:      maskVariables(session.Variables),
+		ClientAttrs:    session.ClientAttrs,
+		Command:        CommandName(cmd.Command),
+		Sql:            query,
+		Args:           args,
+		StatementIndex: cmd.StatementIndex,
+		TrxId:          cmd.TrxId,
+		TrxMark:        cmd.TrxMark,
+		Server:         cmd.Server,
+	}
+
+	if cmd.Stmt != nil {
+		event.StmtId = cmd.Stmt.StmtId
+	}
+
+	if cmd.Result != nil {
+		event.Result = &RecordResult{
+			DurationMs:   float64(cmd.Result.Duration.Microseconds()) / 1000,
+			AffectedRows: cmd.Result.AffectedRows,
+			LastInsertId: cmd.Result.LastInsertId,
+			Warnings:     cmd.Result.Warnings,
+			RowCount:     cmd.Result.RowCount,
+		}
+
+		if cmd.Result.Err != nil {
+			event.Result.ErrCode = cmd.Result.Err.ErrCode
+			event.Result.SqlState = cmd.Result.Err.SqlState
+			event.Result.ErrMsg = maskErrMsg(cmd.Result.Err.ErrMsg)
+		}
+	}
+
+	return event
+}
+
+func (e *RecordEvent) ToJson() ([]byte, error) {
+	return jsoniter.Marshal(e)
+}
+
+// TransactionEvent jsonl格式中的事务汇总, command为TRANSACTION
+type TransactionEvent struct {
+	Time         string  `json:"time"`
+	ConnectionId uint32  `json:"connection_id"`
+	ClientAddr   string  `json:"client_addr"`
+	User         string  `json:"user"`
+	Schema       string  `json:"schema"`
+	Command      string  `json:"command"`
+	TrxId        uint64  `json:"trx_id"`
+	Begin        string  `json:"begin"`
+	End          string  `json:"end"`
+	Statements   int     `json:"statements"`
+	Errors       int     `json:"errors"`
+	AffectedRows uint64  `json:"affected_rows"`
+	DurationMs   float64 `json:"duration_ms"`
+}
+
+func NewTransactionEvent(session *Session, trx *Transaction) *TransactionEvent {
+	return &TransactionEvent{
+		Time:         trx.StartTime.Format("2006-01-02 15:04:05.000"),
+		ConnectionId: session.ConnectionId,
+		ClientAddr:   session.ClientAddr,
+		User:         session.User,
+		Schema:       session.Schema,
+		Command:      "TRANSACTION",
+		TrxId:        trx.Id,
+		Begin:        trx.Begin,
+		End:          trx.End,
+		Statements:   trx.Statements,
+		Errors:       trx.Errors,
+		AffectedRows: trx.AffectedRows,
+		DurationMs:   float64(trx.Duration().Microseconds()) / 1000,
+	}
+}
+
+func (e *TransactionEvent) ToJson() ([]byte, error) {
+	return jsoniter.Marshal(e)
+}
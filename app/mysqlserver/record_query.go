@@ -5,28 +5,62 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/huandu/go-sqlbuilder"
-	jsoniter "github.com/json-iterator/go"
-	"io"
 	"os"
+	"proxymysql/app/conf"
+	"proxymysql/app/db"
 	"proxymysql/app/zlog"
-	"regexp"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 )
 
-var _ io.Writer = (*RecordQuery)(nil)
-
 type RecordQuery struct {
-	file       *os.File
-	pipeReader *io.PipeReader
-	pipeWriter *io.PipeWriter
-	stmtId     uint32
-	stmtMap    map[uint32]string
+	file    *os.File
+	format  string
+	session *Session
+
+	mu sync.Mutex
+	// key为服务端COM_STMT_PREPARE_OK返回的statement_id
+	stmtMap map[uint32]*PrepareStmt
+	// 已发往服务端, 还在等待响应的命令
+	pending []*QueryCommand
+	// pending[0] 响应的解析状态
+	respState  int
+	respRemain int
+
+	// 当前未结束的事务
+	trx *Transaction
+	// 连接内递增的事务id
+	trxSeq uint64
+	// 最近一次status_flags中的SERVER_STATUS_AUTOCOMMIT
+	autocommit bool
+}
+
+type PrepareStmt struct {
+	StmtId     uint32
+	Query      string
+	NumColumns uint16
+	NumParams  uint16
+	// 最近一次new_params_bind_flag=1时绑定的参数类型, 之后的执行会复用
+	ParamTypes []*BindArg
+	// COM_STMT_SEND_LONG_DATA 发送的参数, key为参数位置, 执行后清空
+	LongData map[uint16][]byte
 }
 
-func NewRecordQuery(clientIp string, dirPath string) *RecordQuery {
-	clientPort := strings.Replace(clientIp, "127.0.0.1:", "", -1)
-	fileName := dirPath + "/" + clientPort + ".log"
+func NewRecordQuery(session *Session, dirPath string) *RecordQuery {
+	format := conf.App.RecordFormat
+	if format == "" {
+		format = RecordFormatText
+	}
+
+	ext := ".log"
+	if format == RecordFormatJsonl {
+		ext = ".jsonl"
+	}
+
+	clientPort := strings.Replace(session.ClientAddr, "127.0.0.1:", "", -1)
+	fileName := dirPath + "/" + clientPort + ext
 	zlog.Infof("create file:%s", fileName)
 
 	file, err2 := os.Create(fileName)
@@ -35,102 +69,458 @@ func NewRecordQuery(clientIp string, dirPath string) *RecordQuery {
 	}
 
 	r := &RecordQuery{}
-	r.pipeReader, r.pipeWriter = io.Pipe()
 	r.file = file
-	r.stmtMap = make(map[uint32]string)
-	go r.readQuery()
+	r.format = format
+	r.session = session
+	r.stmtMap = make(map[uint32]*PrepareStmt)
+	r.autocommit = true
 	return r
 }
 
-func (r *RecordQuery) Write(p []byte) (n int, err error) {
-	r.pipeWriter.Write(p)
+func (r *RecordQuery) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	return len(p), err
-}
+	if r.trx != nil {
+		r.trx.End = TrxMarkDisconnect
+		r.writeTransaction(r.trx)
+		r.trx = nil
+	}
 
-func (r *RecordQuery) Close() error {
-	r.pipeWriter.Close()
-	r.pipeReader.Close()
+	return r.file.Close()
+}
 
-	return nil
+// ReadClientPacket 处理客户端发往服务端的包
+// 审计日志在释放锁后入队, block策略等待队列时不会阻塞另一个方向上服务端响应的记录
+func (r *RecordQuery) ReadClientPacket(packet *MysqlPacket) {
+	if queryLog := r.readClientPacket(packet); queryLog != nil {
+		db.SaveQueryLog(queryLog)
+	}
 }
 
-func (r *RecordQuery) readQuery() {
-	for {
-		packet, err := ReadMysqlPacket(r.pipeReader)
-		if err != nil {
-			// errors.Is(err, io.ErrClosedPipe)
-			zlog.Errorf("read pipe pack err: %s", err)
+// readClientPacket 返回需要写入审计库的日志
+func (r *RecordQuery) readClientPacket(packet *MysqlPacket) (queryLog *db.SqlQueryLog) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// LOAD DATA LOCAL INFILE 的文件内容和 COM_CHANGE_USER 的认证数据不是命令
+	if len(r.pending) > 0 && (r.respState == respStateLocalInfile || r.respState == respStateAuth) {
+		return
+	}
+
+	if len(packet.Payload) == 0 {
+		return
+	}
+
+	cmd := &QueryCommand{
+		Command:   packet.Payload[0],
+		StartTime: time.Now(),
+		Result:    &QueryResult{},
+	}
+
+	switch packet.Payload[0] {
+	case ComQuery:
+		query := string(packet.Payload[1:])
+
+		zlog.Debugf("query: %s\n", maskQuery(query))
+		cmd.Query = query
+
+		queryLog = r.queryLog(maskQuery(query))
+
+	case ComPrepare:
+		query := string(packet.Payload[1:])
+
+		zlog.Infof("prepare %s\n", maskQuery(query))
+		cmd.Query = query
+
+		queryLog = r.queryLog(maskQuery(query))
+
+	case ComStmtExecute:
+		if len(packet.Payload) < 5 {
 			return
 		}
 
-		if len(packet.Payload) < 2 {
-			continue
+		stmtId := ReadUint32(packet.Payload[1:5])
+		stmt, ok := r.stmtMap[stmtId]
+		if !ok {
+			zlog.Warnf("ComStmtExecute unknown stmt id: %d", stmtId)
+			break
 		}
 
-		switch packet.Payload[0] {
-		case ComQuery:
-			query := string(packet.Payload[1:])
+		cmd.Stmt = stmt
+
+		_, args := r.parseStmtArgs(stmt, packet.Payload)
+		cmd.Args = args
+		// 服务端执行后会清空long data
+		stmt.LongData = nil
+
+		//fmt.Printf("ComStmtExecute: %s %+v\n", query, args)
+
+		fullSqlQuery, err := sqlbuilder.MySQL.Interpolate(stmt.Query, args)
+		if err != nil {
+			zlog.Errorf("ComStmtExecute builder sql err: %s", err)
+			break
+		}
 
-			zlog.Debugf("query: %s\n", query)
+		cmd.Query = fullSqlQuery
 
-			r.saveToDb(query)
+		// 日志和审计库使用脱敏后的语句
+		maskedQuery, _ := maskCommand(cmd)
 
-		case ComPrepare:
-			query := string(packet.Payload[1:])
+		zlog.Infof("stmt: %s\n", maskedQuery)
 
-			write := bufio.NewWriter(r.file)
-			_, _ = write.WriteString(fmt.Sprintf("【%s】【PREPARE】 %s\n",
-				time.Now().Format("2006-01-02 15:04:05.000"), query))
-			_ = write.Flush()
+		queryLog = r.queryLog(maskedQuery)
 
-			zlog.Infof("prepare %s\n", query)
-			r.stmtId++
-			r.stmtMap[r.stmtId] = query
+	case ComStmtSendLongData:
+		// status(1) statement_id(4) param_id(2) data
+		if len(packet.Payload) < 7 {
+			return
+		}
 
-			r.saveToDb(query)
+		stmt, ok := r.stmtMap[ReadUint32(packet.Payload[1:5])]
+		if !ok {
+			return
+		}
 
-		case ComStmtExecute:
-			query := r.stmtMap[r.stmtId]
+		if stmt.LongData == nil {
+			stmt.LongData = make(map[uint16][]byte)
+		}
 
-			_, args := r.parseStmtArgs(strings.Count(query, "?"), packet.Payload)
+		paramId := ReadUint16(packet.Payload[5:7])
+		stmt.LongData[paramId] = append(stmt.LongData[paramId], packet.Payload[7:]...)
 
-			//fmt.Printf("ComStmtExecute: %s %+v\n", query, args)
+		cmd.Stmt = stmt
+		cmd.Query = fmt.Sprintf("param_id:%d length:%d", paramId, len(packet.Payload)-7)
 
-			fullSqlQuery, err := sqlbuilder.MySQL.Interpolate(query, args)
-			if err != nil {
-				zlog.Errorf("ComStmtExecute builder sql err: %s", err)
-			} else {
-				write := bufio.NewWriter(r.file)
-				_, _ = write.WriteString(fmt.Sprintf("【%s】【FULLSQL】 %s\n",
-					time.Now().Format("2006-01-02 15:04:05.000"), fullSqlQuery))
-				_ = write.Flush()
+		// 没有响应
+		r.writeNoResponse(cmd)
+		return
 
-				zlog.Infof("stmt: %s\n", fullSqlQuery)
+	case ComStmtReset, ComStmtFetch:
+		// statement_id(4) [num_rows(4) 仅COM_STMT_FETCH]
+		if len(packet.Payload) < 5 {
+			return
+		}
+
+		if stmt, ok := r.stmtMap[ReadUint32(packet.Payload[1:5])]; ok {
+			cmd.Stmt = stmt
+			cmd.Query = stmt.Query
+
+			if packet.Payload[0] == ComStmtReset {
+				stmt.LongData = nil
 			}
+		}
 
-			r.saveToDb(fullSqlQuery)
+		if packet.Payload[0] == ComStmtFetch && len(packet.Payload) >= 9 {
+			cmd.Query = fmt.Sprintf("%s 【num_rows:%d】", cmd.Query, ReadUint32(packet.Payload[5:9]))
+		}
 
-		case ComStmtClose:
-			delete(r.stmtMap, r.stmtId)
+	case ComStmtClose:
+		if len(packet.Payload) < 5 {
+			return
 		}
 
+		stmtId := ReadUint32(packet.Payload[1:5])
+		if stmt, ok := r.stmtMap[stmtId]; ok {
+			cmd.Stmt = stmt
+			cmd.Query = stmt.Query
+		}
+
+		delete(r.stmtMap, stmtId)
+
+		// 没有响应
+		r.writeNoResponse(cmd)
+		return
+
+	case ComInitDB:
+		cmd.Query = string(packet.Payload[1:])
+
+	case ComFieldList:
+		// table(NUL) wildcard(EOF)
+		table, wildcard, _ := bytes.Cut(packet.Payload[1:], []byte{0x00})
+		cmd.Query = string(table)
+		if len(wildcard) > 0 {
+			cmd.Query += " " + string(wildcard)
+		}
+
+	case ComSetOption:
+		if len(packet.Payload) < 3 {
+			return
+		}
+
+		cmd.Query = setOptionName(ReadUint16(packet.Payload[1:3]))
+
+	case ComChangeUser:
+		changeUser, err := ParseChangeUser(packet.Payload, r.session.Capability)
+		if err != nil {
+			zlog.Errorf("parse change user err: %s", err)
+		} else {
+			cmd.ChangeUser = changeUser
+			cmd.Query = fmt.Sprintf("user:%s schema:%s", changeUser.Username, changeUser.Database)
+		}
+
+	case ComQuit:
+		r.writeNoResponse(cmd)
+		return
+	}
+
+	r.pending = append(r.pending, cmd)
+
+	return
+}
+
+// ReadServerPacket 处理服务端返回给客户端的包
+func (r *RecordQuery) ReadServerPacket(packet *MysqlPacket) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// 客户端要等上一条命令的响应读完才会发下一条命令,
+	// 所以收到的包总是属于最早一条还在等待响应的命令
+	if len(r.pending) == 0 {
+		return
+	}
+
+	cmd := r.pending[0]
+	if !r.readResponse(cmd, packet.Payload) {
+		return
+	}
+
+	r.pending = r.pending[1:]
+	r.respState = respStateFirst
+	r.respRemain = 0
+
+	// 没有经过OK/EOF/ERR结束的响应(如COM_STMT_PREPARE_OK)当前结果还没有记录
+	if len(cmd.Results) == 0 || cmd.Results[len(cmd.Results)-1] != cmd.Result {
+		r.endResult(cmd)
+	}
+
+	cmd.Result = mergeResults(cmd.Results)
+	r.finishCommand(cmd)
+}
+
+// finishCommand 命令响应结束后记录, 先按命令发出时的会话记录, 再更新会话
+func (r *RecordQuery) finishCommand(cmd *QueryCommand) {
+	switch cmd.Command {
+	case ComQuery:
+		// 多语句按语句分别记录各自的结果
+		for _, stmtCmd := range r.splitStatements(cmd) {
+			r.recordCommand("QUERY", stmtCmd)
+			r.applyStatement(stmtCmd)
+		}
+
+		return
+
+	case ComPrepare:
+		if cmd.Stmt != nil && cmd.Result.Err == nil {
+			r.stmtMap[cmd.Stmt.StmtId] = cmd.Stmt
+		}
+
+		r.recordCommand("PREPARE", cmd)
+
+	case ComStmtExecute:
+		if cmd.Query == "" {
+			r.writeTransaction(r.trackTransaction(cmd))
+			break
+		}
+
+		r.recordCommand("FULLSQL", cmd)
+		r.applyStatement(cmd)
+
+		return
+
+	default:
+		r.recordCommand(commandTag(cmd.Command), cmd)
+
+		if cmd.Result.Err == nil {
+			r.applySessionChange(cmd)
+		}
 	}
 
+	r.session.applyResults(cmd.Results)
+}
+
+// applyStatement 语句执行后更新会话
+func (r *RecordQuery) applyStatement(cmd *QueryCommand) {
+	if cmd.Result == nil {
+		return
+	}
+
+	if cmd.Result.Err == nil {
+		r.session.applyStatement(cmd.Query)
+	}
+
+	r.session.applyResults(cmd.Results)
+}
+
+// applySessionChange 命令成功后更新会话, 之后的记录使用新的库和用户
+func (r *RecordQuery) applySessionChange(cmd *QueryCommand) {
+	switch cmd.Command {
+	case ComInitDB:
+		r.session.Schema = cmd.Query
+
+	case ComChangeUser:
+		if cmd.ChangeUser != nil {
+			r.session.User = cmd.ChangeUser.Username
+			r.session.Schema = cmd.ChangeUser.Database
+		}
+
+		// 服务端会重置会话, 预处理语句全部失效
+		r.stmtMap = make(map[uint32]*PrepareStmt)
+		r.session.reset()
+
+	case ComResetConnection:
+		r.stmtMap = make(map[uint32]*PrepareStmt)
+		r.session.reset()
+
+	case ComSetOption:
+		switch cmd.Query {
+		case setOptionName(MysqlOptionMultiStatementsOn):
+			r.session.Capability |= CapabilityClientMultiStatements
+		case setOptionName(MysqlOptionMultiStatementsOff):
+			r.session.Capability &^= CapabilityClientMultiStatements
+		}
+	}
+}
+
+// writeNoResponse 记录没有响应的命令
+func (r *RecordQuery) writeNoResponse(cmd *QueryCommand) {
+	cmd.Result = nil
+	r.recordCommand(commandTag(cmd.Command), cmd)
+}
+
+// recordCommand 分配事务后记录命令, 命令结束了事务时再记录事务汇总
+func (r *RecordQuery) recordCommand(tag string, cmd *QueryCommand) {
+	finished := r.trackTransaction(cmd)
+	r.writeRecord(tag, cmd)
+	r.writeTransaction(finished)
+}
+
+func (r *RecordQuery) writeRecord(tag string, cmd *QueryCommand) {
+	write := bufio.NewWriter(r.file)
+	query, _ := maskCommand(cmd)
+
+	if r.format == RecordFormatJsonl {
+		line, err := NewRecordEvent(r.session, cmd).ToJson()
+		if err != nil {
+			zlog.Errorf("marshal record event err: %s", err)
+			return
+		}
+
+		_, _ = write.Write(line)
+		_ = write.WriteByte('\n')
+	} else {
+		_, _ = write.WriteString(fmt.Sprintf("【%s】【%s】%s%s%s %s %s\n",
+			cmd.StartTime.Format("2006-01-02 15:04:05.000"), tag, r.session, trxTag(cmd.TrxId, cmd.TrxMark), serverTag(cmd.Server), query, cmd.Result))
+	}
+
+	_ = write.Flush()
+}
+
+// setServer 读写分离时记录最近一条命令实际发往的后端
+func (r *RecordQuery) setServer(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.pending) > 0 {
+		r.pending[len(r.pending)-1].Server = name
+	}
+}
+
+// writeTransaction 开启record_transaction时, 事务结束后记录一条汇总
+func (r *RecordQuery) writeTransaction(trx *Transaction) {
+	if trx == nil || !conf.App.RecordTransaction {
+		return
+	}
+
+	write := bufio.NewWriter(r.file)
+
+	if r.format == RecordFormatJsonl {
+		line, err := NewTransactionEvent(r.session, trx).ToJson()
+		if err != nil {
+			zlog.Errorf("marshal transaction event err: %s", err)
+			return
+		}
+
+		_, _ = write.Write(line)
+		_ = write.WriteByte('\n')
+	} else {
+		_, _ = write.WriteString(fmt.Sprintf("【%s】【TRANSACTION】%s%s %s\n",
+			trx.StartTime.Format("2006-01-02 15:04:05.000"), r.session, trxTag(trx.Id, ""), trx))
+	}
+
+	_ = write.Flush()
+}
+
+func serverTag(server string) string {
+	if server == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("【server:%s】", server)
+}
+
+// trxTag 文本格式记录中的事务id和标记
+func trxTag(id uint64, mark string) string {
+	if id == 0 {
+		return ""
+	}
+
+	if mark == "" {
+		return fmt.Sprintf("【trx:%d】", id)
+	}
+
+	return fmt.Sprintf("【trx:%d %s】", id, mark)
+}
+
+// ParsePrepareOk 解析COM_STMT_PREPARE_OK
+// status(1) statement_id(4) num_columns(2) num_params(2) reserved(1) warning_count(2)
+func ParsePrepareOk(payload []byte) (*PrepareStmt, error) {
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("empty prepare response")
+	}
+
+	if payload[0] == ErrPacket {
+		return nil, fmt.Errorf("server return err packet")
+	}
+
+	if payload[0] != OKPacket || len(payload) < 12 {
+		return nil, fmt.Errorf("invalid prepare ok packet: %+v", payload)
+	}
+
+	return &PrepareStmt{
+		StmtId:     ReadUint32(payload[1:5]),
+		NumColumns: ReadUint16(payload[5:7]),
+		NumParams:  ReadUint16(payload[7:9]),
+	}, nil
 }
 
 type BindArg struct {
 	ArgType  uint8
 	Unsigned uint8
+	Name     string
 	ArgValue interface{}
 }
 
-func (r *RecordQuery) parseStmtArgs(argNum int, data []byte) ([]*BindArg, []any) {
-	if argNum == 0 {
+// 参数类型后一个字节的最高位表示无符号
+const unsignedFlag = 0x80
+
+// parseStmtArgs 解析COM_STMT_EXECUTE中绑定的参数
+// status(1) statement_id(4) flags(1) iteration_count(4)
+// [parameter_count(lenenc) 仅CLIENT_QUERY_ATTRIBUTES] null_bitmap new_params_bind_flag(1)
+// [type(2) [name(lenenc) 仅CLIENT_QUERY_ATTRIBUTES]]... values...
+// new_params_bind_flag为0时沿用该语句上一次绑定的参数类型,
+// 通过COM_STMT_SEND_LONG_DATA发送的参数不在values中, 直接取stmt.LongData
+func (r *RecordQuery) parseStmtArgs(stmt *PrepareStmt, data []byte) ([]*BindArg, []any) {
+	if len(data) < 10 {
 		return nil, nil
 	}
 
-	if len(data) == 0 {
+	argNum := int(stmt.NumParams)
+
+	queryAttributes := r.session.Capability&CapabilityClientQueryAttributes > 0
+	flags := data[5]
+
+	if argNum == 0 && !(queryAttributes && flags&ParameterCountAvailable > 0) {
 		return nil, nil
 	}
 
@@ -142,33 +532,83 @@ func (r *RecordQuery) parseStmtArgs(argNum int, data []byte) ([]*BindArg, []any)
 
 	buf.Next(skipPos)
 
-	nullBitMapLen := (argNum + 7) / 8
+	// 开启query attributes时, 参数个数 = 预处理语句的参数 + 查询属性
+	paramCount := argNum
+	if queryAttributes {
+		count, pos, ok := ReadLengthEncodedInt(buf.Bytes())
+		if !ok {
+			zlog.Errorf("read parameter_count err, stmt:%d length:%d", stmt.StmtId, len(data))
+			return nil, nil
+		}
+
+		buf.Next(pos)
+		paramCount = int(count)
+	}
+
+	if paramCount == 0 {
+		return nil, nil
+	}
+
+	nullBitMapLen := (paramCount + 7) / 8
 	//fmt.Println(nullBitMapLen)
 
+	if buf.Len() < nullBitMapLen+1 {
+		zlog.Errorf("read null bitmap err, stmt:%d param_count:%d length:%d", stmt.StmtId, paramCount, len(data))
+		return nil, nil
+	}
+
 	nullBitMap := buf.Next(nullBitMapLen)
 	//fmt.Println("nullBitMap", nullBitMap)
 
 	newParamsBindFlag := ReadByte(buf.Next(1))
 	//fmt.Println("newParamsBindFlag", ReadByte(newParamsBindFlag))
 
-	if newParamsBindFlag != 0x01 {
-		return nil, nil
-	}
+	bindArgs := make([]*BindArg, paramCount)
 
-	bindArgs := make([]*BindArg, argNum)
-	args := make([]interface{}, argNum)
+	if newParamsBindFlag == 0x01 {
+		stmt.ParamTypes = make([]*BindArg, paramCount)
 
-	for i := 0; i < argNum; i++ {
-		filedType := ReadByte(buf.Next(1))
-		//fmt.Printf("filedType: %+v\n", filedType)
+		for i := 0; i < paramCount; i++ {
+			if buf.Len() < 2 {
+				zlog.Errorf("read args type err, stmt:%d param:%d length:%d", stmt.StmtId, i, len(data))
+				stmt.ParamTypes = nil
+				return nil, nil
+			}
+
+			filedType := ReadByte(buf.Next(1))
+			//fmt.Printf("filedType: %+v\n", filedType)
 
-		unsigned := ReadByte(buf.Next(1))
-		//fmt.Printf("unsigned: %+v\n", unsigned)
+			unsigned := ReadByte(buf.Next(1))
+			//fmt.Printf("unsigned: %+v\n", unsigned)
 
+			paramType := &BindArg{
+				ArgType:  filedType,
+				Unsigned: unsigned,
+			}
+
+			if queryAttributes {
+				name, err := readBinaryLengthEncoded(buf)
+				if err != nil {
+					zlog.Errorf("read args name err: %s", err)
+					stmt.ParamTypes = nil
+					return nil, nil
+				}
+
+				paramType.Name = string(name)
+			}
+
+			stmt.ParamTypes[i] = paramType
+		}
+	} else if len(stmt.ParamTypes) != paramCount {
+		zlog.Warnf("stmt %d has no bound param types", stmt.StmtId)
+		return nil, nil
+	}
+
+	for i, paramType := range stmt.ParamTypes {
 		bindArgs[i] = &BindArg{
-			ArgType:  filedType,
-			Unsigned: unsigned,
-			ArgValue: nil,
+			ArgType:  paramType.ArgType,
+			Unsigned: paramType.Unsigned,
+			Name:     paramType.Name,
 		}
 	}
 
@@ -176,7 +616,7 @@ func (r *RecordQuery) parseStmtArgs(argNum int, data []byte) ([]*BindArg, []any)
 
 	//fmt.Printf("%+v\n", nullBitMap)
 
-	for i := 0; i < argNum; i++ {
+	for i := 0; i < paramCount; i++ {
 		nullBytePos := i / 8
 		nullBitPos := i % 8
 
@@ -184,103 +624,64 @@ func (r *RecordQuery) parseStmtArgs(argNum int, data []byte) ([]*BindArg, []any)
 		//fmt.Printf("nullBitPos:  %08b\n", 1<<nullBitPos)
 
 		if (nullBitMap[nullBytePos] & (1 << nullBitPos)) > 0 {
-			//buf.Next(1)
 			bindArgs[i].ArgValue = nil
-			args[i] = nil
-
-			//fmt.Printf("%+v\n", bindArgs[i])
 
 			continue
 		}
 
-		switch bindArgs[i].ArgType {
-
-		case FieldTypeTiny, FieldTypeBit:
-			val := ReadByte(buf.Next(1))
-
-			bindArgs[i].ArgValue = val
-			args[i] = val
-
-		case FieldTypeInt24, FieldTypeLong:
-			val := ReadUint32(buf.Next(4))
-
-			bindArgs[i].ArgValue = val
-			args[i] = val
-
-		case FieldTypeLongLong:
-			val := ReadUint64(buf.Next(8))
-
-			bindArgs[i].ArgValue = val
-			args[i] = val
-
-		default:
-			length, pos, ok := ReadLengthEncodedInt(buf.Bytes())
-			if !ok {
-				zlog.Errorf("read args err %+v", buf.Bytes())
-				continue
+		if longData, ok := stmt.LongData[uint16(i)]; ok && i < argNum {
+			if utf8.Valid(longData) {
+				bindArgs[i].ArgValue = string(longData)
+			} else {
+				bindArgs[i].ArgValue = longData
 			}
 
-			buf.Next(pos)
-			val := string(buf.Next(int(length)))
-
-			bindArgs[i].ArgValue = val
-			args[i] = val
+			continue
+		}
 
-			//fmt.Printf("str: %s\n", val)
+		val, err := ReadBinaryValue(buf, bindArgs[i].ArgType, bindArgs[i].Unsigned&unsignedFlag > 0)
+		if err != nil {
+			zlog.Errorf("read args err: %s, stmt:%d param:%d type:%d length:%d", err, stmt.StmtId, i, bindArgs[i].ArgType, len(data))
+			return nil, nil
 		}
 
+		bindArgs[i].ArgValue = val
 	}
 
-	return bindArgs, args
-}
-
-type SqlComment struct {
-	//AdminId       int64
-	//AdminName     string
-	//AdminRealName string
-	//QueryGameId  int32
-	//HeaderGameId int32
-	//Ip           string
-	//RequestPath string
-	//RequestInfo string
-	UnixMilli int64
-	Query     string
-	//CallInfo   string
-	CreateTime string
-}
-
-var adminCommentReg = regexp.MustCompile(`/\*\s+TzAdmin-([\s\S]+)-TzAdmin\s+\*/`)
-
-func (r *RecordQuery) parseSqlComment(query string) (sc *SqlComment) {
-	sc = &SqlComment{}
-	sc.Query = query
-	if sc.UnixMilli == 0 {
-		sc.UnixMilli = time.Now().UnixMilli()
+	// 查询属性排在语句参数之后, 不参与拼接sql
+	if paramCount > argNum {
+		bindArgs = bindArgs[:argNum]
 	}
 
-	sc.CreateTime = time.Now().Format("2006-01-02 15:04:05.000")
-
-	if !strings.Contains(query, " TzAdmin-") {
-		return
+	args := make([]interface{}, len(bindArgs))
+	for i, arg := range bindArgs {
+		args[i] = arg.ArgValue
 	}
 
-	subMatch := adminCommentReg.FindStringSubmatch(query)
-
-	if len(subMatch) >= 2 {
-		err := jsoniter.Unmarshal([]byte(subMatch[1]), sc)
-		if err != nil {
-			zlog.Warnf("解析sql admin信息失败 %s [%s]", err, subMatch[1])
-			return
-		}
+	return bindArgs, args
+}
 
-		_sql := strings.TrimSpace(adminCommentReg.ReplaceAllString(sc.Query, ""))
-		sc.Query = _sql
-		//zlog.Infof("%+v\n", sc)
+// queryLog 解析后台sql注释, 生成审计库的日志
+func (r *RecordQuery) queryLog(query string) *db.SqlQueryLog {
+	if query == "" {
+		return nil
 	}
 
-	return
-}
-
-func (r *RecordQuery) saveToDb(query string) {
-	return
+	sc := r.parseSqlComment(query)
+
+	createTime, _ := time.ParseInLocation("2006-01-02 15:04:05.000", sc.CreateTime, time.Local)
+
+	return &db.SqlQueryLog{
+		AdminId:       sc.AdminId,
+		AdminName:     sc.AdminName,
+		AdminRealName: sc.AdminRealName,
+		QueryGameId:   sc.QueryGameId,
+		HeaderGameId:  sc.HeaderGameId,
+		Ip:            sc.Ip,
+		RequestPath:   sc.RequestPath,
+		RequestInfo:   sc.GetRequestInfo(),
+		UnixMilli:     sc.UnixMilli,
+		Query:         sc.Query,
+		CreateTime:    createTime,
+	}
 }
@@ -0,0 +1,249 @@
+package mysqlserver
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// 以下COM_STMT_EXECUTE包抓取自mysql客户端, 去掉了4字节包头
+// status(1) statement_id(4) flags(1) iteration_count(4)
+// [parameter_count(lenenc)] null_bitmap new_params_bind_flag(1) types... values...
+func TestParseStmtArgs(t *testing.T) {
+	tests := []struct {
+		name       string
+		capability uint32
+		numParams  uint16
+		payload    []byte
+		want       []any
+		wantNames  []string
+	}{
+		{
+			// select ?, ?, ? 参数 int64(-1) nil "abc"
+			"integer null string", 0, 3,
+			[]byte{
+				0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+				0x02,
+				0x01,
+				0x08, 0x00, 0x06, 0x00, 0xfe, 0x00,
+				0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+				0x03, 'a', 'b', 'c',
+			},
+			[]any{int64(-1), nil, "abc"}, nil,
+		},
+		{
+			// 无符号 bigint unsigned 和 tinyint unsigned
+			"unsigned", 0, 2,
+			[]byte{
+				0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+				0x00,
+				0x01,
+				0x08, 0x80, 0x01, 0x80,
+				0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+				0xff,
+			},
+			[]any{uint64(math.MaxUint64), uint8(255)}, nil,
+		},
+		{
+			// 9个参数, null_bitmap占2字节, 第2个和第9个为NULL
+			"two byte null bitmap", 0, 9,
+			[]byte{
+				0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+				0x02, 0x01,
+				0x01,
+				0x01, 0x00, 0x01, 0x00, 0x01, 0x00, 0x01, 0x00, 0x01, 0x00, 0x01, 0x00, 0x01, 0x00, 0x01, 0x00, 0x01, 0x00,
+				0x01, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+			},
+			[]any{int8(1), nil, int8(3), int8(4), int8(5), int8(6), int8(7), int8(8), nil}, nil,
+		},
+		{
+			// DATETIME(6) 和 负的TIME(6)
+			"datetime and time", 0, 4,
+			[]byte{
+				0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+				0x00,
+				0x01,
+				0x0c, 0x00, 0x0c, 0x00, 0x0b, 0x00, 0x0b, 0x00,
+				0x0b, 0xe8, 0x07, 0x0a, 0x11, 0x0d, 0x2d, 0x05, 0x40, 0xe2, 0x01, 0x00,
+				0x00,
+				0x0c, 0x01, 0x01, 0x00, 0x00, 0x00, 0x02, 0x03, 0x04, 0x01, 0x00, 0x00, 0x00,
+				0x08, 0x01, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x1e, 0x00,
+			},
+			[]any{"2024-10-17 13:45:05.123456", "0000-00-00 00:00:00", "-26:03:04.000001", "-12:30:00"}, nil,
+		},
+		{
+			// 开启query attributes, 1个参数和1个查询属性 traceid='xyz', 查询属性不参与拼接sql
+			"query attributes", CapabilityClientQueryAttributes, 1,
+			[]byte{
+				0x17, 0x01, 0x00, 0x00, 0x00, 0x08, 0x01, 0x00, 0x00, 0x00,
+				0x02,
+				0x00,
+				0x01,
+				0x08, 0x00, 0x00,
+				0xfe, 0x00, 0x07, 't', 'r', 'a', 'c', 'e', 'i', 'd',
+				0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0x03, 'x', 'y', 'z',
+			},
+			[]any{int64(1)}, []string{"", "traceid"},
+		},
+		{
+			// 开启query attributes但没有查询属性, parameter_count等于参数个数
+			"query attributes without attribute", CapabilityClientQueryAttributes, 1,
+			[]byte{
+				0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+				0x01,
+				0x00,
+				0x01,
+				0x03, 0x00, 0x00,
+				0x2a, 0x00, 0x00, 0x00,
+			},
+			[]any{int32(42)}, []string{""},
+		},
+		{
+			// 语句没有参数, 只有查询属性
+			"only query attributes", CapabilityClientQueryAttributes, 0,
+			[]byte{
+				0x17, 0x01, 0x00, 0x00, 0x00, 0x08, 0x01, 0x00, 0x00, 0x00,
+				0x01,
+				0x00,
+				0x01,
+				0xfe, 0x00, 0x01, 'k',
+				0x01, 'v',
+			},
+			[]any{}, []string{"k"},
+		},
+		{
+			"no params", 0, 0,
+			[]byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00},
+			nil, nil,
+		},
+		{
+			"truncated value", 0, 1,
+			[]byte{
+				0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+				0x00,
+				0x01,
+				0x08, 0x00,
+				0x01, 0x00, 0x00,
+			},
+			nil, nil,
+		},
+		{
+			"truncated types", 0, 2,
+			[]byte{
+				0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+				0x00,
+				0x01,
+				0x08, 0x00, 0x08,
+			},
+			nil, nil,
+		},
+		{
+			// new_params_bind_flag为0但之前没有绑定过参数类型
+			"no bound types", 0, 1,
+			[]byte{
+				0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+				0x00,
+				0x00,
+				0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			},
+			nil, nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &RecordQuery{session: &Session{Capability: tt.capability}}
+			stmt := &PrepareStmt{StmtId: 1, NumParams: tt.numParams}
+
+			bindArgs, args := r.parseStmtArgs(stmt, tt.payload)
+			if !reflect.DeepEqual(args, tt.want) {
+				t.Errorf("args = %#v, want %#v", args, tt.want)
+			}
+
+			if tt.wantNames == nil {
+				return
+			}
+
+			var names []string
+			for _, paramType := range stmt.ParamTypes {
+				names = append(names, paramType.Name)
+			}
+
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("names = %v, want %v", names, tt.wantNames)
+			}
+
+			if len(bindArgs) != len(tt.want) {
+				t.Errorf("len(bindArgs) = %d, want %d", len(bindArgs), len(tt.want))
+			}
+		})
+	}
+}
+
+// 同一个语句第二次执行时new_params_bind_flag为0, 沿用第一次绑定的参数类型
+func TestParseStmtArgsReuseTypes(t *testing.T) {
+	r := &RecordQuery{session: &Session{}}
+	stmt := &PrepareStmt{StmtId: 1, NumParams: 2}
+
+	first := []byte{
+		0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+		0x00,
+		0x01,
+		0x03, 0x80, 0xfe, 0x00,
+		0x01, 0x00, 0x00, 0x00,
+		0x01, 'a',
+	}
+
+	second := []byte{
+		0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+		0x00,
+		0x00,
+		0xff, 0xff, 0xff, 0xff,
+		0x02, 'b', 'c',
+	}
+
+	third := []byte{
+		0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+		0x01,
+		0x00,
+		0x02, 'd', 'e',
+	}
+
+	tests := []struct {
+		payload []byte
+		want    []any
+	}{
+		{first, []any{uint32(1), "a"}},
+		{second, []any{uint32(math.MaxUint32), "bc"}},
+		{third, []any{nil, "de"}},
+	}
+
+	for i, tt := range tests {
+		_, args := r.parseStmtArgs(stmt, tt.payload)
+		if !reflect.DeepEqual(args, tt.want) {
+			t.Errorf("execute %d args = %#v, want %#v", i+1, args, tt.want)
+		}
+	}
+}
+
+// COM_STMT_SEND_LONG_DATA发送的参数不在values中
+func TestParseStmtArgsLongData(t *testing.T) {
+	r := &RecordQuery{session: &Session{}}
+	stmt := &PrepareStmt{StmtId: 1, NumParams: 2, LongData: map[uint16][]byte{0: []byte("long data")}}
+
+	payload := []byte{
+		0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+		0x00,
+		0x01,
+		0xfc, 0x00, 0x08, 0x00,
+		0x07, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+
+	_, args := r.parseStmtArgs(stmt, payload)
+
+	want := []any{"long data", int64(7)}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("args = %#v, want %#v", args, want)
+	}
+}
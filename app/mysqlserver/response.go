@@ -0,0 +1,500 @@
+package mysqlserver
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type MysqlOkPacket struct {
+	AffectedRows     uint64
+	LastInsertId     uint64
+	StatusFlags      uint16
+	Warnings         uint16
+	Info             string
+	SessionStateInfo []byte
+}
+
+// ParseOkPacket 解析OK包, 开启CLIENT_DEPRECATE_EOF时以0xfe开头的结果集结束包也是这个格式
+// header(1) affected_rows(lenenc) last_insert_id(lenenc) status_flags(2) warnings(2)
+// CLIENT_SESSION_TRACK: info(lenenc) [session_state_info(lenenc)]  否则: info(EOF)
+func ParseOkPacket(payload []byte, capability uint32) (*MysqlOkPacket, error) {
+	if len(payload) == 0 || (payload[0] != OKPacket && payload[0] != EOFPacket) {
+		return nil, fmt.Errorf("invalid ok packet: %+v", payload)
+	}
+
+	buf := bytes.NewBuffer(payload[1:])
+
+	res := &MysqlOkPacket{}
+
+	affectedRows, pos, ok := ReadLengthEncodedInt(buf.Bytes())
+	if !ok {
+		return nil, fmt.Errorf("read affected rows err")
+	}
+	buf.Next(pos)
+	res.AffectedRows = affectedRows
+
+	lastInsertId, pos, ok := ReadLengthEncodedInt(buf.Bytes())
+	if !ok {
+		return nil, fmt.Errorf("read last insert id err")
+	}
+	buf.Next(pos)
+	res.LastInsertId = lastInsertId
+
+	if buf.Len() < 4 {
+		return nil, fmt.Errorf("read status flags err")
+	}
+
+	res.StatusFlags = ReadUint16(buf.Next(2))
+	res.Warnings = ReadUint16(buf.Next(2))
+
+	if capability&CapabilityClientSessionTrack == 0 {
+		res.Info = buf.String()
+		return res, nil
+	}
+
+	if buf.Len() == 0 {
+		return res, nil
+	}
+
+	info, err := readBinaryLengthEncoded(buf)
+	if err != nil {
+		return nil, fmt.Errorf("read info err: %w", err)
+	}
+	res.Info = string(info)
+
+	if res.StatusFlags&ServerSessionStateChanged > 0 {
+		sessionStateInfo, err := readBinaryLengthEncoded(buf)
+		if err != nil {
+			return nil, fmt.Errorf("read session state info err: %w", err)
+		}
+		res.SessionStateInfo = sessionStateInfo
+	}
+
+	return res, nil
+}
+
+// ToByte 代理自己返回的OK包, 不带info和session_state_info
+func (o *MysqlOkPacket) ToByte(sequenceId uint8) []byte {
+	data := make([]byte, 0, 16)
+
+	data = append(data, OKPacket)
+	data = append(data, WriteLengthEncodedInt(o.AffectedRows)...)
+	data = append(data, WriteLengthEncodedInt(o.LastInsertId)...)
+	data = append(data, WriteUint16(o.StatusFlags)...)
+	data = append(data, WriteUint16(o.Warnings)...)
+
+	return WithHeaderPacket(data, sequenceId)
+}
+
+type MysqlErrPacket struct {
+	ErrCode  uint16
+	SqlState string
+	ErrMsg   string
+}
+
+func (e *MysqlErrPacket) Error() string {
+	return fmt.Sprintf("ERROR %d (%s): %s", e.ErrCode, e.SqlState, e.ErrMsg)
+}
+
+func NewErrPacket(errCode uint16, sqlState string, errMsg string) *MysqlErrPacket {
+	return &MysqlErrPacket{
+		ErrCode:  errCode,
+		SqlState: sqlState,
+		ErrMsg:   errMsg,
+	}
+}
+
+func (e *MysqlErrPacket) ToByte(sequenceId uint8) []byte {
+	data := make([]byte, 0, 9+len(e.ErrMsg))
+
+	data = append(data, ErrPacket)
+	data = append(data, WriteUint16(e.ErrCode)...)
+	data = append(data, '#')
+	data = append(data, WriteString(e.SqlState)...)
+	data = append(data, WriteString(e.ErrMsg)...)
+
+	return WithHeaderPacket(data, sequenceId)
+}
+
+// ParseErrPacket 解析ERR包
+// header(1) error_code(2) [sql_state_marker(1) sql_state(5)] error_message(EOF)
+func ParseErrPacket(payload []byte) (*MysqlErrPacket, error) {
+	if len(payload) < 3 || payload[0] != ErrPacket {
+		return nil, fmt.Errorf("invalid err packet: %+v", payload)
+	}
+
+	res := &MysqlErrPacket{
+		ErrCode: ReadUint16(payload[1:3]),
+	}
+
+	msg := payload[3:]
+	if len(msg) >= 6 && msg[0] == '#' {
+		res.SqlState = string(msg[1:6])
+		msg = msg[6:]
+	}
+
+	res.ErrMsg = string(msg)
+
+	return res, nil
+}
+
+type MysqlEofPacket struct {
+	Warnings    uint16
+	StatusFlags uint16
+}
+
+// ParseEofPacket 解析EOF包
+// header(1) warnings(2) status_flags(2)
+func ParseEofPacket(payload []byte) (*MysqlEofPacket, error) {
+	if len(payload) < 5 || payload[0] != EOFPacket {
+		return nil, fmt.Errorf("invalid eof packet: %+v", payload)
+	}
+
+	return &MysqlEofPacket{
+		Warnings:    ReadUint16(payload[1:3]),
+		StatusFlags: ReadUint16(payload[3:5]),
+	}, nil
+}
+
+// 结果集中的行数据不会以0xfe开头且长度小于16M, 以此区分行数据和EOF/OK结束包
+func isEofPacket(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == EOFPacket && len(payload) < MaxPacketSize
+}
+
+// QueryResult 服务端对一条命令的响应结果
+type QueryResult struct {
+	Duration     time.Duration
+	AffectedRows uint64
+	LastInsertId uint64
+	Warnings     uint16
+	RowCount     uint64
+	StatusFlags  uint16
+	Err          *MysqlErrPacket
+	// 是否是结果集, 否则是OK/ERR包
+	ResultSet bool
+	// 是否收到了带status_flags的OK/EOF包
+	HasStatus bool
+	// OK包中的session_state_info
+	SessionStateInfo []byte
+}
+
+func (qr *QueryResult) String() string {
+	if qr == nil {
+		return ""
+	}
+
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("【duration:%s", qr.Duration))
+
+	if qr.Err != nil {
+		sb.WriteString(fmt.Sprintf(" error:%d sqlstate:%s", qr.Err.ErrCode, qr.Err.SqlState))
+
+		// 记录文件中的错误信息同样脱敏
+		if msg := maskErrMsg(qr.Err.ErrMsg); msg != "" {
+			sb.WriteString(" message:" + msg)
+		}
+
+		sb.WriteString("】")
+		return sb.String()
+	}
+
+	sb.WriteString(fmt.Sprintf(" affected_rows:%d last_insert_id:%d warnings:%d rows:%d】",
+		qr.AffectedRows, qr.LastInsertId, qr.Warnings, qr.RowCount))
+
+	return sb.String()
+}
+
+// mergeResults 把多个结果合并成一个, 用于整条命令的汇总
+func mergeResults(results []*QueryResult) *QueryResult {
+	res := &QueryResult{}
+
+	for _, result := range results {
+		res.Duration += result.Duration
+		res.AffectedRows += result.AffectedRows
+		if result.LastInsertId > 0 {
+			res.LastInsertId = result.LastInsertId
+		}
+		res.Warnings += result.Warnings
+		res.RowCount += result.RowCount
+		res.ResultSet = res.ResultSet || result.ResultSet
+
+		if result.HasStatus {
+			res.StatusFlags = result.StatusFlags
+			res.HasStatus = true
+		}
+
+		if result.Err != nil {
+			res.Err = result.Err
+		}
+	}
+
+	return res
+}
+
+// QueryCommand 已发往服务端, 等待响应的客户端命令
+type QueryCommand struct {
+	Command   uint8
+	Query     string
+	Stmt      *PrepareStmt
+	Args      []interface{}
+	StartTime time.Time
+	// 响应结束后为所有结果的汇总
+	Result *QueryResult
+	// 开启CLIENT_MULTI_RESULTS时每个结果集/OK/ERR各一个, 按服务端返回顺序
+	Results []*QueryResult
+	// 多语句拆分后在原命令中的序号, 从1开始
+	StatementIndex int
+	// COM_CHANGE_USER 切换后的用户和库
+	ChangeUser *ChangeUser
+	// 所属事务的id和在事务中的标记, 不在事务中为0
+	TrxId   uint64
+	TrxMark string
+	// 读写分离时实际执行命令的后端
+	Server string
+}
+
+// 响应的解析状态
+const (
+	// 等待响应的第一个包
+	respStateFirst = iota
+	// 结果集的列定义
+	respStateColumns
+	// 列定义后的EOF包, 开启CLIENT_DEPRECATE_EOF时没有
+	respStateColumnsEof
+	// 结果集的行数据
+	respStateRows
+	// COM_STMT_PREPARE_OK 后的参数和列定义
+	respStatePrepareDefs
+	// COM_FIELD_LIST 的列定义
+	respStateFieldList
+	// LOAD DATA LOCAL INFILE, 客户端正在发送文件内容
+	respStateLocalInfile
+	// COM_CHANGE_USER 的认证交互
+	respStateAuth
+)
+
+// readResponse 按命令类型解析服务端响应, 响应结束时返回true
+func (r *RecordQuery) readResponse(cmd *QueryCommand, payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+
+	switch r.respState {
+	case respStateFirst:
+		switch {
+		case payload[0] == ErrPacket:
+			return r.readErr(cmd, payload)
+
+		case cmd.Command == ComPrepare && payload[0] == OKPacket:
+			stmt, err := ParsePrepareOk(payload)
+			if err != nil {
+				return true
+			}
+
+			stmt.Query = cmd.Query
+			cmd.Stmt = stmt
+
+			// 参数和列定义各自以EOF结束(开启CLIENT_DEPRECATE_EOF时没有)
+			r.respRemain = int(stmt.NumParams) + int(stmt.NumColumns)
+			if !r.deprecateEof() {
+				if stmt.NumParams > 0 {
+					r.respRemain++
+				}
+				if stmt.NumColumns > 0 {
+					r.respRemain++
+				}
+			}
+
+			r.respState = respStatePrepareDefs
+			return r.respRemain == 0
+
+		case cmd.Command == ComChangeUser:
+			if payload[0] == OKPacket {
+				return r.readOk(cmd, payload)
+			}
+
+			r.respState = respStateAuth
+			return false
+
+		case cmd.Command == ComFieldList:
+			r.respState = respStateFieldList
+			return r.readResponse(cmd, payload)
+
+		case cmd.Command == ComStmtFetch:
+			r.respState = respStateRows
+			return r.readResponse(cmd, payload)
+
+		case cmd.Command != ComQuery && cmd.Command != ComStmtExecute:
+			// 其余命令只返回一个包
+			if payload[0] == OKPacket {
+				return r.readOk(cmd, payload)
+			}
+			if isEofPacket(payload) {
+				return r.readEof(cmd, payload)
+			}
+			return true
+
+		case payload[0] == OKPacket:
+			return r.readOk(cmd, payload)
+
+		case payload[0] == NullValue:
+			// LOCAL INFILE Request, 客户端发送完文件后服务端再返回OK/ERR
+			r.respState = respStateLocalInfile
+			return false
+		}
+
+		columnCount, _, ok := ReadLengthEncodedInt(payload)
+		if !ok || columnCount == 0 {
+			return true
+		}
+
+		cmd.Result.ResultSet = true
+		r.respRemain = int(columnCount)
+		r.respState = respStateColumns
+		return false
+
+	case respStateColumns:
+		r.respRemain--
+		if r.respRemain > 0 {
+			return false
+		}
+
+		if r.deprecateEof() {
+			r.respState = respStateRows
+		} else {
+			r.respState = respStateColumnsEof
+		}
+		return false
+
+	case respStateColumnsEof:
+		eof, err := ParseEofPacket(payload)
+		if err != nil {
+			return true
+		}
+
+		// 使用游标时列定义后结果集就结束了, 行数据通过COM_STMT_FETCH获取
+		if eof.StatusFlags&ServerStatusCursorExists > 0 {
+			return r.readEof(cmd, payload)
+		}
+
+		r.respState = respStateRows
+		return false
+
+	case respStateRows:
+		if payload[0] == ErrPacket {
+			return r.readErr(cmd, payload)
+		}
+
+		if !isEofPacket(payload) {
+			cmd.Result.RowCount++
+			return false
+		}
+
+		if r.deprecateEof() {
+			return r.readOk(cmd, payload)
+		}
+		return r.readEof(cmd, payload)
+
+	case respStatePrepareDefs:
+		r.respRemain--
+		return r.respRemain <= 0
+
+	case respStateFieldList:
+		if payload[0] == ErrPacket {
+			return r.readErr(cmd, payload)
+		}
+
+		if isEofPacket(payload) {
+			if r.deprecateEof() {
+				return r.readOk(cmd, payload)
+			}
+			return r.readEof(cmd, payload)
+		}
+
+		cmd.Result.RowCount++
+		return false
+
+	case respStateLocalInfile, respStateAuth:
+		switch payload[0] {
+		case OKPacket:
+			return r.readOk(cmd, payload)
+		case ErrPacket:
+			return r.readErr(cmd, payload)
+		}
+		return false
+	}
+
+	return true
+}
+
+// readOk 读取OK包, 还有更多结果集时继续等待
+func (r *RecordQuery) readOk(cmd *QueryCommand, payload []byte) bool {
+	ok, err := ParseOkPacket(payload, r.session.Capability)
+	if err != nil {
+		return true
+	}
+
+	result := cmd.Result
+	result.AffectedRows = ok.AffectedRows
+	result.LastInsertId = ok.LastInsertId
+	result.Warnings = ok.Warnings
+	result.StatusFlags = ok.StatusFlags
+	result.HasStatus = true
+	result.SessionStateInfo = ok.SessionStateInfo
+
+	return r.nextResult(cmd)
+}
+
+func (r *RecordQuery) readEof(cmd *QueryCommand, payload []byte) bool {
+	eof, err := ParseEofPacket(payload)
+	if err != nil {
+		return true
+	}
+
+	cmd.Result.Warnings = eof.Warnings
+	cmd.Result.StatusFlags = eof.StatusFlags
+	cmd.Result.HasStatus = true
+
+	return r.nextResult(cmd)
+}
+
+func (r *RecordQuery) readErr(cmd *QueryCommand, payload []byte) bool {
+	errPacket, err := ParseErrPacket(payload)
+	if err == nil {
+		cmd.Result.Err = errPacket
+	}
+
+	r.endResult(cmd)
+
+	return true
+}
+
+// nextResult 当前结果结束, 服务端设置了SERVER_MORE_RESULTS_EXISTS时继续读下一个结果
+func (r *RecordQuery) nextResult(cmd *QueryCommand) bool {
+	r.endResult(cmd)
+
+	if cmd.Result.StatusFlags&ServerMoreResultsExists > 0 {
+		cmd.Result = &QueryResult{}
+		r.respState = respStateFirst
+		return false
+	}
+
+	return true
+}
+
+// endResult 记录当前结果, 耗时为距离上一个结果结束的时间
+func (r *RecordQuery) endResult(cmd *QueryCommand) {
+	var elapsed time.Duration
+	for _, result := range cmd.Results {
+		elapsed += result.Duration
+	}
+
+	cmd.Result.Duration = time.Since(cmd.StartTime) - elapsed
+	cmd.Results = append(cmd.Results, cmd.Result)
+}
+
+func (r *RecordQuery) deprecateEof() bool {
+	return r.session.Capability&CapabilityClientDeprecateEOF > 0
+}
@@ -0,0 +1,547 @@
+package mysqlserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"os"
+	"path"
+	"proxymysql/app/zlog"
+	"strconv"
+	"strings"
+)
+
+// 结果集脱敏的动作
+const (
+	// 替换为固定的mask
+	ResultMaskMask = "mask"
+	// 替换为sha256的hex, 相同的值脱敏后仍然相同, 可以用于关联
+	ResultMaskHash = "hash"
+)
+
+// 列定义中的flags, 脱敏后的列是字符串, 去掉数值和二进制相关的flag
+const (
+	columnFlagBlob     = 0x0010
+	columnFlagUnsigned = 0x0020
+	columnFlagZerofill = 0x0040
+	columnFlagBinary   = 0x0080
+	columnFlagEnum     = 0x0100
+	columnFlagSet      = 0x0800
+	columnFlagNum      = 0x8000
+
+	maskedColumnFlags = columnFlagBlob | columnFlagUnsigned | columnFlagZerofill | columnFlagBinary |
+		columnFlagEnum | columnFlagSet | columnFlagNum
+)
+
+// 为nil时不改写结果集
+var resultMasker *ResultMasker
+
+// ResultMaskRule 结果集中的列满足条件时脱敏, 条件支持通配符 * ? [], 不区分大小写, 为空的条件不参与匹配
+// Schema Table Column 匹配列定义中的库 原始表名 原始列名, 表达式的列没有原始表名和列名, 只能用Alias匹配
+type ResultMaskRule struct {
+	Name string `json:"name"`
+	// 客户端登录的账号, 为空时对所有账号生效
+	Users  []string `json:"users"`
+	Schema string   `json:"schema"`
+	Table  string   `json:"table"`
+	Column string   `json:"column"`
+	// 结果集中的列名, 有别名时是别名
+	Alias  string `json:"alias"`
+	Action string `json:"action"`
+}
+
+// ResultMasker 结果集脱敏规则文件, 服务端返回的行数据按第一个匹配的规则改写后再发给客户端
+//
+//	{
+//	  "mask": "***",
+//	  "hash_salt": "secret",
+//	  "rules": [
+//	    {"name": "phone", "users": ["report", "bi_*"], "table": "user", "column": "phone", "action": "mask"},
+//	    {"name": "id-card", "schema": "crm", "column": "id_card*", "action": "hash"},
+//	    {"name": "alias", "alias": "secret_*", "action": "mask"}
+//	  ]
+//	}
+type ResultMasker struct {
+	Mask string `json:"mask"`
+	// hash前拼在值前面, 防止按常见值反查
+	HashSalt string            `json:"hash_salt"`
+	Rules    []*ResultMaskRule `json:"rules"`
+}
+
+// InitResultMasking 从json文件加载结果集脱敏规则, 文件为空时不启用
+func InitResultMasking(ruleFile string) error {
+	if ruleFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(ruleFile)
+	if err != nil {
+		return err
+	}
+
+	m := &ResultMasker{}
+
+	err = jsoniter.Unmarshal(data, m)
+	if err != nil {
+		return fmt.Errorf("parse result mask file err: %w", err)
+	}
+
+	if m.Mask == "" {
+		m.Mask = "***"
+	}
+
+	for i, rule := range m.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+
+		err = rule.init()
+		if err != nil {
+			return fmt.Errorf("result mask rule %s: %w", rule.Name, err)
+		}
+	}
+
+	resultMasker = m
+
+	zlog.Infof("result masking enabled, rules: %d", len(m.Rules))
+
+	return nil
+}
+
+func (r *ResultMaskRule) init() error {
+	if r.Action != ResultMaskMask && r.Action != ResultMaskHash {
+		return fmt.Errorf("invalid action: %s", r.Action)
+	}
+
+	if r.Schema == "" && r.Table == "" && r.Column == "" && r.Alias == "" {
+		return fmt.Errorf("requires schema, table, column or alias")
+	}
+
+	patterns := append([]string{r.Schema, r.Table, r.Column, r.Alias}, r.Users...)
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %s: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// matchPattern 空的条件匹配任意值
+func matchPattern(pattern string, value string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(value))
+
+	return ok
+}
+
+func (r *ResultMaskRule) matchUser(user string) bool {
+	if len(r.Users) == 0 {
+		return true
+	}
+
+	for _, pattern := range r.Users {
+		if matchPattern(pattern, user) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *ResultMaskRule) match(user string, def *columnDefinition) bool {
+	return r.matchUser(user) &&
+		matchPattern(r.Schema, string(def.schema)) &&
+		matchPattern(r.Table, string(def.orgTable)) &&
+		matchPattern(r.Column, string(def.orgName)) &&
+		matchPattern(r.Alias, string(def.name))
+}
+
+// columnAction 返回列的脱敏动作, 不需要脱敏时返回空
+func (m *ResultMasker) columnAction(user string, def *columnDefinition) string {
+	for _, rule := range m.Rules {
+		if rule.match(user, def) {
+			return rule.Action
+		}
+	}
+
+	return ""
+}
+
+func (m *ResultMasker) maskValue(action string, value []byte) []byte {
+	if action == ResultMaskHash {
+		sum := sha256.Sum256(append([]byte(m.HashSalt), value...))
+		return []byte(hex.EncodeToString(sum[:]))
+	}
+
+	return []byte(m.Mask)
+}
+
+// maskedDefinition 脱敏后的列改为utf8mb4的VAR_STRING, 客户端按字符串解析
+func (m *ResultMasker) maskedDefinition(def *columnDefinition) *columnDefinition {
+	res := *def
+	res.charset = uint16(CharsetUtf8mb4GeneralCiId)
+	res.fieldType = FieldTypeVarString
+	res.flags &^= maskedColumnFlags
+	res.decimals = 0
+
+	// 字节数, utf8mb4每个字符最多4个字节
+	length := len(m.Mask)
+	if length < sha256.Size*2 {
+		length = sha256.Size * 2
+	}
+	res.length = uint32(length) * 4
+
+	return &res
+}
+
+// columnDefinition Protocol::ColumnDefinition41
+// catalog(lenenc) schema(lenenc) table(lenenc) org_table(lenenc) name(lenenc) org_name(lenenc)
+// length_of_fixed_length_fields(lenenc) character_set(2) column_length(4) type(1) flags(2) decimals(1) filler(2)
+type columnDefinition struct {
+	catalog   []byte
+	schema    []byte
+	table     []byte
+	orgTable  []byte
+	name      []byte
+	orgName   []byte
+	charset   uint16
+	length    uint32
+	fieldType uint8
+	flags     uint16
+	decimals  uint8
+	// COM_FIELD_LIST 的默认值, 原样保留
+	rest []byte
+}
+
+func parseColumnDefinition(payload []byte) (*columnDefinition, error) {
+	buf := bytes.NewBuffer(payload)
+	res := &columnDefinition{}
+
+	for _, field := range []*[]byte{&res.catalog, &res.schema, &res.table, &res.orgTable, &res.name, &res.orgName} {
+		value, err := readBinaryLengthEncoded(buf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid column definition: %w", err)
+		}
+		*field = value
+	}
+
+	fixed, err := readBinaryLengthEncoded(buf)
+	if err != nil || len(fixed) < 12 {
+		return nil, fmt.Errorf("invalid column definition fixed length fields")
+	}
+
+	res.charset = ReadUint16(fixed[0:2])
+	res.length = ReadUint32(fixed[2:6])
+	res.fieldType = fixed[6]
+	res.flags = ReadUint16(fixed[7:9])
+	res.decimals = fixed[9]
+	res.rest = buf.Bytes()
+
+	return res, nil
+}
+
+func (c *columnDefinition) ToByte() []byte {
+	data := make([]byte, 0, 64)
+
+	for _, field := range [][]byte{c.catalog, c.schema, c.table, c.orgTable, c.name, c.orgName} {
+		data = append(data, WriteLengthEncodedString(field)...)
+	}
+
+	data = append(data, 0x0c)
+	data = append(data, WriteUint16(c.charset)...)
+	data = append(data, WriteUint32(c.length)...)
+	data = append(data, c.fieldType)
+	data = append(data, WriteUint16(c.flags)...)
+	data = append(data, c.decimals, 0, 0)
+	data = append(data, c.rest...)
+
+	return data
+}
+
+// resultColumns 一个结果集的原始列定义和每列的脱敏动作
+type resultColumns struct {
+	defs    []*columnDefinition
+	actions []string
+	masked  bool
+}
+
+// resultMask 一个客户端连接的结果集改写状态, 转发响应时逐包改写列定义和行数据
+type resultMask struct {
+	masker *ResultMasker
+	user   string
+	// 当前命令
+	command uint8
+	stmtId  uint32
+	stmt    *PrepareStmt
+	// 预处理语句的响应中已经读到的参数和列定义数
+	prepareDefs int
+	columns     *resultColumns
+	// 执行过的预处理语句最近一次结果集的列, COM_STMT_FETCH 的行数据没有列定义
+	stmtColumns map[uint32]*resultColumns
+}
+
+// newResultMask 未启用结果集脱敏时返回nil
+func newResultMask() *resultMask {
+	if resultMasker == nil {
+		return nil
+	}
+
+	return &resultMask{masker: resultMasker, stmtColumns: make(map[uint32]*resultColumns)}
+}
+
+// begin 命令发往服务端后, 开始读响应之前调用
+func (m *resultMask) begin(user string, payload []byte) {
+	m.user = user
+	m.command = payload[0]
+	m.stmt = nil
+	m.prepareDefs = 0
+	m.columns = &resultColumns{}
+
+	if (m.command == ComStmtExecute || m.command == ComStmtFetch) && len(payload) >= 5 {
+		m.stmtId = ReadUint32(payload[1:5])
+	}
+
+	if m.command == ComStmtFetch && m.stmtColumns[m.stmtId] != nil {
+		m.columns = m.stmtColumns[m.stmtId]
+	}
+}
+
+func (m *resultMask) closeStmt(stmtId uint32) {
+	delete(m.stmtColumns, stmtId)
+}
+
+// rewrite 改写响应中的一个包, state为解析这个包之前的响应状态, 不需要改写时返回原payload
+func (m *resultMask) rewrite(state int, cmd *QueryCommand, payload []byte) ([]byte, error) {
+	if len(payload) == 0 {
+		return payload, nil
+	}
+
+	if state == respStateFirst && m.command == ComStmtFetch {
+		state = respStateRows
+	}
+
+	switch state {
+	case respStateFirst:
+		// 多结果集时每个结果集重新读列定义
+		m.columns = &resultColumns{}
+		if m.command == ComStmtExecute {
+			m.stmtColumns[m.stmtId] = m.columns
+		}
+
+	case respStateColumns:
+		return m.rewriteColumn(payload)
+
+	case respStatePrepareDefs:
+		// 参数定义在前, 列定义在后, 开启CLIENT_DEPRECATE_EOF时没有中间的EOF
+		if cmd.Stmt == nil || isEofPacket(payload) {
+			return payload, nil
+		}
+
+		m.prepareDefs++
+		if m.prepareDefs <= int(cmd.Stmt.NumParams) {
+			return payload, nil
+		}
+
+		return m.rewriteColumn(payload)
+
+	case respStateRows:
+		if !m.columns.masked || payload[0] == ErrPacket || isEofPacket(payload) {
+			return payload, nil
+		}
+
+		if m.command == ComStmtExecute || m.command == ComStmtFetch {
+			return m.maskBinaryRow(payload)
+		}
+
+		return m.maskTextRow(payload)
+	}
+
+	return payload, nil
+}
+
+// rewriteColumn 记录原始列定义, 需要脱敏的列改为字符串类型
+func (m *resultMask) rewriteColumn(payload []byte) ([]byte, error) {
+	def, err := parseColumnDefinition(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	action := m.masker.columnAction(m.user, def)
+
+	m.columns.defs = append(m.columns.defs, def)
+	m.columns.actions = append(m.columns.actions, action)
+
+	if action == "" {
+		return payload, nil
+	}
+
+	m.columns.masked = true
+
+	return m.masker.maskedDefinition(def).ToByte(), nil
+}
+
+// maskTextRow 文本协议的行: 每列是 length encoded string, NULL为0xfb
+func (m *resultMask) maskTextRow(payload []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(payload)
+	res := make([]byte, 0, len(payload))
+
+	for _, action := range m.columns.actions {
+		if buf.Len() > 0 && buf.Bytes()[0] == NullValue {
+			buf.Next(1)
+			res = append(res, NullValue)
+			continue
+		}
+
+		value, err := readBinaryLengthEncoded(buf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid text row: %w", err)
+		}
+
+		if action != "" {
+			value = m.masker.maskValue(action, value)
+		}
+
+		res = append(res, WriteLengthEncodedString(value)...)
+	}
+
+	return res, nil
+}
+
+// maskBinaryRow 二进制协议的行: header(1) null_bitmap((列数+7+2)/8) 非NULL列的值
+// 脱敏的列按列类型和小数位转为服务端文本协议的格式再计算hash, 再写成 length encoded string
+func (m *resultMask) maskBinaryRow(payload []byte) ([]byte, error) {
+	bitmapLen := (len(m.columns.defs) + 7 + 2) / 8
+	if len(payload) < 1+bitmapLen {
+		return nil, fmt.Errorf("invalid binary row length: %d", len(payload))
+	}
+
+	bitmap := payload[1 : 1+bitmapLen]
+	buf := bytes.NewBuffer(payload[1+bitmapLen:])
+
+	res := make([]byte, 0, len(payload))
+	res = append(res, payload[:1+bitmapLen]...)
+
+	for i, def := range m.columns.defs {
+		if bitmap[(i+2)/8]&(1<<((i+2)%8)) > 0 {
+			continue
+		}
+
+		data := buf.Bytes()
+
+		value, err := ReadBinaryValue(buf, def.fieldType, def.flags&columnFlagUnsigned > 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid binary row: %w", err)
+		}
+
+		action := m.columns.actions[i]
+		if action == "" {
+			res = append(res, data[:len(data)-buf.Len()]...)
+			continue
+		}
+
+		res = append(res, WriteLengthEncodedString(m.masker.maskValue(action, binaryValueText(value, def)))...)
+	}
+
+	return res, nil
+}
+
+// 列定义中decimals为该值时浮点数没有固定的小数位
+const notFixedDecimals = 31
+
+// binaryValueText 把ReadBinaryValue读出的值转为服务端文本协议中的格式,
+// 日期时间按decimals补齐小数位, 浮点数按decimals或最短表示, ZEROFILL的整数按显示宽度补0
+func binaryValueText(value interface{}, def *columnDefinition) []byte {
+	var text string
+
+	switch v := value.(type) {
+	case []byte:
+		return v
+
+	case string:
+		text = v
+		if def.fieldType == FieldTypeDateTime || def.fieldType == FieldTypeTimestamp || def.fieldType == FieldTypeTime {
+			text = fixTemporalDecimals(text, def.decimals)
+		}
+
+	case float32:
+		text = formatFloat(float64(v), 32, def.decimals)
+
+	case float64:
+		text = formatFloat(v, 64, def.decimals)
+
+	default:
+		text = fmt.Sprint(v)
+
+		if def.fieldType == FieldTypeYear {
+			text = fmt.Sprintf("%04d", v)
+		} else if def.flags&columnFlagZerofill > 0 && len(text) < int(def.length) {
+			text = strings.Repeat("0", int(def.length)-len(text)) + text
+		}
+	}
+
+	return []byte(text)
+}
+
+// fixTemporalDecimals 二进制协议中微秒为0时没有小数部分, 文本协议按列的小数位(0-6)输出
+func fixTemporalDecimals(text string, decimals uint8) string {
+	microsecond := "000000"
+	if pos := strings.LastIndexByte(text, '.'); pos >= 0 {
+		microsecond = text[pos+1:]
+		text = text[:pos]
+	}
+
+	if decimals == 0 || decimals > 6 {
+		return text
+	}
+
+	return text + "." + microsecond[:decimals]
+}
+
+// formatFloat 有固定小数位时按小数位输出, 否则与服务端my_gcvt一致:
+// 最短的精确表示, 小数点后有4个以上的0或整数部分比有效数字多15位以上时使用指数形式, 如 1e21 1e-5
+func formatFloat(f float64, bitSize int, decimals uint8) string {
+	if decimals < notFixedDecimals {
+		return strconv.FormatFloat(f, 'f', int(decimals), bitSize)
+	}
+
+	if f == 0 {
+		return "0"
+	}
+
+	sign := ""
+	if f < 0 {
+		sign = "-"
+		f = -f
+	}
+
+	mantissa, exp, _ := strings.Cut(strconv.FormatFloat(f, 'e', -1, bitSize), "e")
+	digits := strings.Replace(mantissa, ".", "", 1)
+	e, _ := strconv.Atoi(exp)
+
+	// 小数点前的位数, 为负数时是小数点后0的个数
+	decpt := e + 1
+
+	switch {
+	case decpt <= -4 || decpt > len(digits)+15:
+		res := digits[:1]
+		if len(digits) > 1 {
+			res += "." + digits[1:]
+		}
+		return sign + res + "e" + strconv.Itoa(e)
+
+	case decpt <= 0:
+		return sign + "0." + strings.Repeat("0", -decpt) + digits
+
+	case decpt >= len(digits):
+		return sign + digits + strings.Repeat("0", decpt-len(digits))
+
+	default:
+		return sign + digits[:decpt] + "." + digits[decpt:]
+	}
+}
@@ -0,0 +1,128 @@
+package mysqlserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func float64Bytes(f float64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, math.Float64bits(f))
+}
+
+func float32Bytes(f float32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, math.Float32bits(f))
+}
+
+// 同一个值在文本协议和二进制协议中脱敏后的hash相同
+func TestResultMaskCrossProtocol(t *testing.T) {
+	tests := []struct {
+		name string
+		def  *columnDefinition
+		// 二进制协议中的值和服务端文本协议中的值
+		binary []byte
+		text   string
+	}{
+		{"datetime(6) without microsecond", &columnDefinition{fieldType: FieldTypeDateTime, decimals: 6},
+			[]byte{0x07, 0xe8, 0x07, 0x0a, 0x11, 0x0d, 0x2d, 0x05}, "2024-10-17 13:45:05.000000"},
+		{"datetime(3)", &columnDefinition{fieldType: FieldTypeDateTime, decimals: 3},
+			[]byte{0x0b, 0xe8, 0x07, 0x0a, 0x11, 0x0d, 0x2d, 0x05, 0x78, 0xe0, 0x01, 0x00}, "2024-10-17 13:45:05.123"},
+		{"datetime", &columnDefinition{fieldType: FieldTypeDateTime},
+			[]byte{0x07, 0xe8, 0x07, 0x0a, 0x11, 0x0d, 0x2d, 0x05}, "2024-10-17 13:45:05"},
+		{"datetime midnight", &columnDefinition{fieldType: FieldTypeDateTime},
+			[]byte{0x04, 0xe8, 0x07, 0x0a, 0x11}, "2024-10-17 00:00:00"},
+		{"zero datetime", &columnDefinition{fieldType: FieldTypeDateTime},
+			[]byte{0x00}, "0000-00-00 00:00:00"},
+		{"timestamp(2)", &columnDefinition{fieldType: FieldTypeTimestamp, decimals: 2},
+			[]byte{0x0b, 0xe8, 0x07, 0x0a, 0x11, 0x0d, 0x2d, 0x05, 0x20, 0xa1, 0x07, 0x00}, "2024-10-17 13:45:05.50"},
+		{"date", &columnDefinition{fieldType: FieldTypeDate},
+			[]byte{0x04, 0xe8, 0x07, 0x0a, 0x11}, "2024-10-17"},
+		{"time(6) negative", &columnDefinition{fieldType: FieldTypeTime, decimals: 6},
+			[]byte{0x08, 0x01, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x1e, 0x00}, "-12:30:00.000000"},
+		{"time(3) with days", &columnDefinition{fieldType: FieldTypeTime, decimals: 3},
+			[]byte{0x0c, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02, 0x03, 0x04, 0xe8, 0x03, 0x00, 0x00}, "26:03:04.001"},
+		{"zero time", &columnDefinition{fieldType: FieldTypeTime},
+			[]byte{0x00}, "00:00:00"},
+
+		{"double large", &columnDefinition{fieldType: FieldTypeDouble, decimals: notFixedDecimals}, float64Bytes(1e21), "1e21"},
+		{"double 1e16", &columnDefinition{fieldType: FieldTypeDouble, decimals: notFixedDecimals}, float64Bytes(1e16), "1e16"},
+		{"double 1e15", &columnDefinition{fieldType: FieldTypeDouble, decimals: notFixedDecimals}, float64Bytes(1e15), "1000000000000000"},
+		{"double", &columnDefinition{fieldType: FieldTypeDouble, decimals: notFixedDecimals}, float64Bytes(123.456), "123.456"},
+		{"double fraction", &columnDefinition{fieldType: FieldTypeDouble, decimals: notFixedDecimals}, float64Bytes(0.1), "0.1"},
+		{"double small", &columnDefinition{fieldType: FieldTypeDouble, decimals: notFixedDecimals}, float64Bytes(0.0001), "0.0001"},
+		{"double exponent", &columnDefinition{fieldType: FieldTypeDouble, decimals: notFixedDecimals}, float64Bytes(1e-5), "1e-5"},
+		{"double negative exponent", &columnDefinition{fieldType: FieldTypeDouble, decimals: notFixedDecimals}, float64Bytes(-1.5e300), "-1.5e300"},
+		{"double zero", &columnDefinition{fieldType: FieldTypeDouble, decimals: notFixedDecimals}, float64Bytes(0), "0"},
+		{"double(10,2)", &columnDefinition{fieldType: FieldTypeDouble, decimals: 2}, float64Bytes(3.1), "3.10"},
+		{"float", &columnDefinition{fieldType: FieldTypeFloat, decimals: notFixedDecimals}, float32Bytes(0.1), "0.1"},
+		{"float large", &columnDefinition{fieldType: FieldTypeFloat, decimals: notFixedDecimals}, float32Bytes(1e21), "1e21"},
+
+		{"year", &columnDefinition{fieldType: FieldTypeYear}, []byte{0xe8, 0x07}, "2024"},
+		{"zero year", &columnDefinition{fieldType: FieldTypeYear}, []byte{0x00, 0x00}, "0000"},
+		{"int zerofill", &columnDefinition{fieldType: FieldTypeLong, flags: columnFlagZerofill | columnFlagUnsigned, length: 5}, []byte{0x2a, 0x00, 0x00, 0x00}, "00042"},
+		{"bigint unsigned", &columnDefinition{fieldType: FieldTypeLongLong, flags: columnFlagUnsigned}, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, "18446744073709551615"},
+		{"bigint", &columnDefinition{fieldType: FieldTypeLongLong}, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, "-1"},
+		{"decimal", &columnDefinition{fieldType: FieldTypeNewDecimal, decimals: 2}, []byte{0x05, '1', '2', '.', '5', '0'}, "12.50"},
+		{"varchar", &columnDefinition{fieldType: FieldTypeVarString}, []byte{0x03, 'a', 'b', 'c'}, "abc"},
+	}
+
+	masker := &ResultMasker{Mask: "***", HashSalt: "salt"}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &resultMask{
+				masker:  masker,
+				columns: &resultColumns{defs: []*columnDefinition{tt.def}, actions: []string{ResultMaskHash}},
+			}
+
+			textRow, err := m.maskTextRow(WriteLengthEncodedString([]byte(tt.text)))
+			if err != nil {
+				t.Fatalf("mask text row: %s", err)
+			}
+
+			// header(1) null_bitmap(1) 值
+			binaryRow, err := m.maskBinaryRow(append([]byte{0x00, 0x00}, tt.binary...))
+			if err != nil {
+				t.Fatalf("mask binary row: %s", err)
+			}
+
+			value, err := ReadBinaryValue(bytes.NewBuffer(tt.binary), tt.def.fieldType, tt.def.flags&columnFlagUnsigned > 0)
+			if err != nil {
+				t.Fatalf("read binary value: %s", err)
+			}
+
+			if got := string(binaryValueText(value, tt.def)); got != tt.text {
+				t.Errorf("binaryValueText = %q, want %q", got, tt.text)
+			}
+
+			if !bytes.Equal(binaryRow[2:], textRow) {
+				t.Errorf("binary row hash %q, text row hash %q", binaryRow[2:], textRow)
+			}
+		})
+	}
+}
+
+func TestResultMaskBinaryRowNull(t *testing.T) {
+	m := &resultMask{
+		masker: &ResultMasker{Mask: "***"},
+		columns: &resultColumns{
+			defs:    []*columnDefinition{{fieldType: FieldTypeLong}, {fieldType: FieldTypeVarString}, {fieldType: FieldTypeDouble, decimals: notFixedDecimals}},
+			actions: []string{"", ResultMaskMask, ResultMaskMask},
+		},
+	}
+
+	// 第2列为NULL, bitmap从第3位开始
+	payload := []byte{0x00, 0x08, 0x01, 0x00, 0x00, 0x00}
+	payload = append(payload, float64Bytes(2.5)...)
+
+	got, err := m.maskBinaryRow(payload)
+	if err != nil {
+		t.Fatalf("mask binary row: %s", err)
+	}
+
+	want := []byte{0x00, 0x08, 0x01, 0x00, 0x00, 0x00, 0x03, '*', '*', '*'}
+	if !bytes.Equal(got, want) {
+		t.Errorf("maskBinaryRow = %v, want %v", got, want)
+	}
+}
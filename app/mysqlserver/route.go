@@ -0,0 +1,290 @@
+package mysqlserver
+
+import (
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"os"
+	"path/filepath"
+	"proxymysql/app/zlog"
+)
+
+// 没有配置路由文件时, remote_db 对应的后端名称
+const DefaultBackendName = "default"
+
+// Backend 一个命名的后端数据库
+type Backend struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+	// 只读副本的后端名称, 配置后事务外的SELECT发往副本, 其余发往本后端(主库)
+	Replicas []string `json:"replicas"`
+	// 写入后多长时间内的读仍然发往主库, 为0时写入后整个会话都使用主库
+	StickyAfterWriteMs int `json:"sticky_after_write_ms"`
+	// 本后端不可用时依次尝试的后端名称
+	Failover []string `json:"failover"`
+	// 复制延迟超过该秒数时标记为不可用, 为0时不检查, 需要health_check_user
+	MaxReplicationLagS int `json:"max_replication_lag_s"`
+
+	// 记录文件目录
+	dirPath  string
+	replicas []*Backend
+	failover []*Backend
+	// 轮询选择副本
+	replicaIndex uint32
+	health       backendHealth
+}
+
+// Route 按握手包中的用户名和库选择后端, 为空的条件不参与匹配
+type Route struct {
+	User     string `json:"user"`
+	Database string `json:"database"`
+	Backend  string `json:"backend"`
+
+	backend *Backend
+}
+
+func (r *Route) match(resp *HandshakeResponse) bool {
+	return (r.User == "" || r.User == resp.Username) && (r.Database == "" || r.Database == resp.Database)
+}
+
+// Listener 一个监听地址, 按Routes的顺序匹配, 都不匹配时使用Backend
+type Listener struct {
+	Listen  string   `json:"listen"`
+	Backend string   `json:"backend"`
+	Routes  []*Route `json:"routes"`
+	// 只读监听, 拒绝写入和DDL等语句
+	ReadOnly bool `json:"read_only"`
+
+	backend *Backend
+}
+
+// route 为客户端选择后端
+func (l *Listener) route(resp *HandshakeResponse) *Backend {
+	for _, route := range l.Routes {
+		if route.match(resp) {
+			return route.backend
+		}
+	}
+
+	return l.backend
+}
+
+// RouteConfig 路由文件
+//
+//	{
+//	  "backends": [{"name": "prod-replica", "addr": "10.0.0.1:3306", "failover": ["staging"]}, {"name": "staging", "addr": "10.0.0.2:3306"}],
+//	  "listeners": [
+//	    {"listen": ":5306", "backend": "prod-replica"},
+//	    {"listen": ":5307", "backend": "staging", "routes": [{"user": "report", "backend": "prod-replica"}]}
+//	  ]
+//	}
+type RouteConfig struct {
+	Backends  []*Backend  `json:"backends"`
+	Listeners []*Listener `json:"listeners"`
+
+	// 由remote_db和listen_port生成, 记录文件不区分后端目录
+	single bool
+}
+
+// LoadRouteConfig 加载路由文件, 文件为空时使用remote_db和listen_port作为唯一的后端和监听
+func LoadRouteConfig(routeFile string, remoteDb string, listenPort string) (*RouteConfig, error) {
+	if routeFile == "" {
+		if remoteDb == "" {
+			return nil, fmt.Errorf("remote db addr not set")
+		}
+
+		backend := &Backend{Name: DefaultBackendName, Addr: remoteDb}
+
+		return &RouteConfig{
+			Backends:  []*Backend{backend},
+			Listeners: []*Listener{{Listen: listenPort, Backend: backend.Name, backend: backend}},
+			single:    true,
+		}, nil
+	}
+
+	data, err := os.ReadFile(routeFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &RouteConfig{}
+
+	err = jsoniter.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("parse route file err: %w", err)
+	}
+
+	err = cfg.init()
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (c *RouteConfig) init() error {
+	if len(c.Listeners) == 0 {
+		return fmt.Errorf("no listener configured")
+	}
+
+	backends := make(map[string]*Backend, len(c.Backends))
+
+	for _, backend := range c.Backends {
+		if backend.Name == "" || backend.Addr == "" {
+			return fmt.Errorf("backend name and addr are required: %+v", backend)
+		}
+
+		// 名称同时是记录目录名
+		if filepath.Base(backend.Name) != backend.Name || backend.Name == "." || backend.Name == ".." {
+			return fmt.Errorf("invalid backend name: %s", backend.Name)
+		}
+
+		if _, ok := backends[backend.Name]; ok {
+			return fmt.Errorf("duplicate backend: %s", backend.Name)
+		}
+
+		backends[backend.Name] = backend
+	}
+
+	for _, backend := range c.Backends {
+		for _, name := range backend.Replicas {
+			replica, ok := backends[name]
+			if !ok || replica == backend {
+				return fmt.Errorf("backend %s: invalid replica: %s", backend.Name, name)
+			}
+
+			backend.replicas = append(backend.replicas, replica)
+		}
+
+		for _, name := range backend.Failover {
+			failover, ok := backends[name]
+			if !ok || failover == backend {
+				return fmt.Errorf("backend %s: invalid failover: %s", backend.Name, name)
+			}
+
+			backend.failover = append(backend.failover, failover)
+		}
+	}
+
+	listens := make(map[string]bool, len(c.Listeners))
+
+	for _, listener := range c.Listeners {
+		if listener.Listen == "" {
+			return fmt.Errorf("listener listen is required: %+v", listener)
+		}
+
+		if listens[listener.Listen] {
+			return fmt.Errorf("duplicate listener: %s", listener.Listen)
+		}
+		listens[listener.Listen] = true
+
+		backend, ok := backends[listener.Backend]
+		if !ok {
+			return fmt.Errorf("listener %s: unknown backend: %s", listener.Listen, listener.Backend)
+		}
+		listener.backend = backend
+
+		for _, route := range listener.Routes {
+			if route.User == "" && route.Database == "" {
+				return fmt.Errorf("listener %s: route requires user or database: %+v", listener.Listen, route)
+			}
+
+			backend, ok := backends[route.Backend]
+			if !ok {
+				return fmt.Errorf("listener %s: unknown backend: %s", listener.Listen, route.Backend)
+			}
+			route.backend = backend
+		}
+	}
+
+	return nil
+}
+
+// CheckReadWriteSplit 读写分离需要代理认证, 代理用服务账号登录副本
+func (c *RouteConfig) CheckReadWriteSplit() error {
+	for _, backend := range c.Backends {
+		if len(backend.replicas) > 0 && !proxyAuthEnabled() {
+			return fmt.Errorf("backend %s: read/write splitting requires auth_user_file", backend.Name)
+		}
+	}
+
+	return nil
+}
+
+// InitRecordDir 每个后端记录到dirPath下以后端名称命名的目录
+func (c *RouteConfig) InitRecordDir(dirPath string) error {
+	for _, backend := range c.Backends {
+		backend.dirPath = dirPath
+		if !c.single {
+			backend.dirPath = filepath.Join(dirPath, backend.Name)
+		}
+
+		err := os.MkdirAll(backend.dirPath, os.ModePerm)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// switchBackend 关闭默认后端的连接, 改连路由选择的后端, 返回新后端的握手包
+// 不是代理认证时客户端的认证数据是按默认后端的scramble计算的, 需要让客户端用新的scramble重新计算
+func (p *ProxyConn) switchBackend(backend *Backend, resp *HandshakeResponse) (*HandshakeV10, error) {
+	_ = p.serverConn.Close()
+	p.backend = backend
+
+	serverConn, err := p.getServerConn()
+	if err != nil {
+		return nil, err
+	}
+	p.serverConn = serverConn
+
+	hk, err := ReadHandshakeV10(p.serverConn)
+	if err != nil {
+		return nil, err
+	}
+
+	p.scramble = hk.AuthPluginData[:20]
+
+	zlog.Infof("connection_id:%d user:%s database:%s route to backend:%s", p.session.ConnectionId, resp.Username, resp.Database, backend.Name)
+
+	if proxyAuthEnabled() {
+		return hk, nil
+	}
+
+	if resp.ClientFlag&CapabilityClientPluginAuth == 0 {
+		return nil, fmt.Errorf("client does not support auth switch, can not route to backend %s", backend.Name)
+	}
+
+	plugin := resp.AuthPluginMethod
+	if plugin == "" {
+		plugin = hk.AuthPluginMethod
+	}
+
+	data := make([]byte, 0, len(plugin)+len(p.scramble)+3)
+	data = append(data, AuthSwitchRequestPacket)
+	data = append(data, WriteStringNull(plugin)...)
+	data = append(data, WriteStringNull(string(p.scramble))...)
+
+	seq := resp.SequenceId + uint8(resp.Length/MaxPacketSize)
+
+	_, err = p.clientConn.Write(WithHeaderPacket(data, seq+1))
+	if err != nil {
+		return nil, err
+	}
+
+	pk, err := ReadMysqlPacketLimit(p.clientConn, MaxPacketSize)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.AuthPluginMethod = plugin
+	resp.Password = pk.Payload
+	p.session.AuthPlugin = plugin
+
+	// 切换请求和客户端的回复各占一个客户端序列号, 发给服务端的握手包序列号不变
+	p.clientSeqOffset += 2
+	resp.SequenceId += 2
+
+	return hk, nil
+}
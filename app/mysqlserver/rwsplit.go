@@ -0,0 +1,700 @@
+package mysqlserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"proxymysql/app/zlog"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 副本与主库的这些capability不一致时无法按同一种格式解析响应
+const replicaCapabilityMask = CapabilityClientDeprecateEOF | CapabilityClientQueryAttributes |
+	CapabilityClientMultiResults | CapabilityClientSessionTrack
+
+var (
+	// 只能在主库执行的读: 加锁读、写入变量或文件、依赖会话状态的函数
+	primaryReadReg = regexp.MustCompile(`\b(into|for\s+update|for\s+share|lock\s+in\s+share\s+mode|sql_calc_found_rows)\b|` +
+		`\b(get_lock|release_lock|release_all_locks|is_used_lock|is_free_lock|last_insert_id|found_rows|row_count|connection_id)\s*\(|@`)
+	// 之后整个会话都要留在主库: 临时表、表锁、用户锁、用户变量、文本协议的PREPARE
+	stickyStatementReg = regexp.MustCompile(`^(create\s+temporary\s+table|lock\s+tables?|prepare)\b|\bget_lock\s*\(|(^|[^@])@([^@]|$)`)
+)
+
+// 不修改数据的语句, 执行后不影响读写分离
+var nonWriteStatements = map[string]bool{
+	"select": true, "set": true, "use": true, "show": true, "desc": true, "describe": true, "explain": true,
+	"begin": true, "start": true, "commit": true, "rollback": true, "savepoint": true, "release": true,
+	"do": true, "help": true,
+}
+
+// backendConn 命令转发循环中的一个服务端连接
+type backendConn struct {
+	backend *Backend
+	conn    net.Conn
+	reader  *bufio.Reader
+	// 副本或连接池中的连接上已经同步的库和SET语句数
+	schema string
+	sets   int
+	// 连接池使用的建立时间和归还时间
+	createdAt time.Time
+	idleAt    time.Time
+}
+
+func newBackendConn(backend *Backend, conn net.Conn) *backendConn {
+	return &backendConn{backend: backend, conn: conn, reader: bufio.NewReader(conn), createdAt: time.Now()}
+}
+
+// readWriteSplit 一个客户端连接按命令转发时的状态, 用于读写分离和连接池
+type readWriteSplit struct {
+	backend *Backend
+	// 连接池模式下只在事务中或会话粘滞时持有, 其余时间为nil
+	primary *backendConn
+	replica *backendConn
+	// 副本连接或同步失败后本会话不再使用副本
+	replicaFailed bool
+
+	pooled bool
+
+	inTransaction bool
+	autocommit    bool
+	// 使用了临时表、锁或用户变量, 整个会话都使用主库
+	sticky bool
+	// 最近一次在主库写入的时间
+	lastWrite time.Time
+	// 上一条语句是写入或SQL_CALC_FOUND_ROWS, 下一条语句可能读取LAST_INSERT_ID() ROW_COUNT() FOUND_ROWS(),
+	// 连接池模式下归还时的COM_RESET_CONNECTION会清除它们, 需要再持有主库连接一条语句
+	holdNext bool
+	// 主库上执行成功的SET语句, 副本和连接池中的连接使用前按顺序重放
+	sets []string
+	// 执行过无法解析重放的SET语句(如SET TRANSACTION), 连接池模式下归还前需要重置会话
+	dirty bool
+	// 会写入数据的预处理语句, key为主库返回的statement_id
+	writeStmts map[uint32]bool
+}
+
+func (s *readWriteSplit) closeReplica() {
+	if s.replica != nil {
+		_ = s.replica.conn.Close()
+		s.replica = nil
+	}
+}
+
+// reset 服务端重置会话或切换用户后清除会话状态
+func (s *readWriteSplit) reset() {
+	s.inTransaction = false
+	s.autocommit = true
+	s.sticky = false
+	s.lastWrite = time.Time{}
+	s.holdNext = false
+	s.sets = nil
+	s.dirty = false
+	s.writeStmts = make(map[uint32]bool)
+	s.replicaFailed = false
+}
+
+// closePrimary 连接池模式下关闭会话结束时仍持有的主库连接, 未结束的事务由服务端回滚
+func (s *readWriteSplit) closePrimary() {
+	if s.pooled && s.primary != nil {
+		backendPool.discard(s.backend, s.primary)
+		s.primary = nil
+	}
+}
+
+// canRelease 连接池模式下事务外、没有会话粘滞和预处理语句, 且不是刚写入时主库连接可以归还
+func (s *readWriteSplit) canRelease() bool {
+	return s.pooled && s.primary != nil && !s.inTransaction && !s.sticky && !s.holdNext && len(s.writeStmts) == 0
+}
+
+// canReadReplica 事务外、自动提交、没有会话粘滞时读可以发往副本
+func (s *readWriteSplit) canReadReplica() bool {
+	if len(s.backend.replicas) == 0 || s.replicaFailed || s.inTransaction || !s.autocommit || s.sticky {
+		return false
+	}
+
+	if s.lastWrite.IsZero() {
+		return true
+	}
+
+	stickyMs := s.backend.StickyAfterWriteMs
+	if stickyMs == 0 {
+		return false
+	}
+
+	return time.Since(s.lastWrite) >= time.Duration(stickyMs)*time.Millisecond
+}
+
+// afterPrimaryResponse 主库的响应结束后更新事务和粘滞状态
+func (s *readWriteSplit) afterPrimaryResponse(cmd *QueryCommand, payload []byte) {
+	var failed bool
+
+	s.holdNext = false
+
+	for _, result := range cmd.Results {
+		if result.Err != nil {
+			failed = true
+
+			if result.Err.ErrCode == ErLockDeadlock {
+				s.inTransaction = false
+			}
+			continue
+		}
+
+		if result.HasStatus {
+			s.inTransaction = result.StatusFlags&ServerStatusInTrans > 0
+			s.autocommit = result.StatusFlags&ServerStatusAutocommit > 0
+		}
+	}
+
+	switch cmd.Command {
+	case ComQuery:
+		for _, stmt := range SplitStatements(cmd.Query) {
+			s.applyStatement(stmt, failed)
+		}
+
+	case ComPrepare:
+		if cmd.Stmt != nil && !failed {
+			s.writeStmts[cmd.Stmt.StmtId] = isWriteStatement(maskStatement(cmd.Query))
+		}
+
+	case ComStmtExecute:
+		if len(payload) < 5 || s.writeStmts[ReadUint32(payload[1:5])] {
+			s.lastWrite = time.Now()
+			s.holdNext = true
+		}
+
+	case ComChangeUser, ComResetConnection:
+		if !failed {
+			// 服务端重置了会话, 副本上的会话也不再可用
+			s.closeReplica()
+			s.reset()
+		}
+	}
+}
+
+func (s *readWriteSplit) applyStatement(stmt string, failed bool) {
+	masked := maskStatement(stmt)
+
+	if stickyStatementReg.MatchString(masked) {
+		if !s.sticky {
+			zlog.Debugf("stick to primary: %s", maskQuery(stmt))
+		}
+		s.sticky = true
+	}
+
+	if leadingKeyword(masked) == "set" {
+		if failed {
+			return
+		}
+
+		if len(parseSetStatement(stmt)) > 0 {
+			s.sets = append(s.sets, stmt)
+		} else {
+			s.dirty = true
+		}
+		return
+	}
+
+	if isWriteStatement(masked) {
+		s.lastWrite = time.Now()
+		s.holdNext = true
+	}
+
+	if strings.Contains(masked, "sql_calc_found_rows") {
+		s.holdNext = true
+	}
+}
+
+// maskStatement 去掉注释, 转为小写并把引号中的内容替换为空格, 避免注释和字符串中的关键字被误判
+// 可执行注释 /*! ... */ 中的语句会被服务端执行, 保留注释中的内容
+func maskStatement(stmt string) string {
+	return maskQuoted(stmt, "'\"`")
+}
+
+// maskQuoted 同maskStatement, 只替换quotes中的引号
+func maskQuoted(stmt string, quotes string) string {
+	data := []byte(strings.ToLower(strings.TrimSpace(stripComments(stmt))))
+
+	for i := 0; i < len(data); i++ {
+		if c := data[i]; strings.IndexByte(quotes, c) >= 0 {
+			end := skipQuoted(string(data), i, c)
+			for k := i + 1; k < end && k < len(data); k++ {
+				data[k] = ' '
+			}
+			i = end
+		}
+	}
+
+	return string(data)
+}
+
+// leadingKeyword 语句开头的关键字, 如 select(1) 返回select
+func leadingKeyword(masked string) string {
+	for i := 0; i < len(masked); i++ {
+		if c := masked[i]; (c < 'a' || c > 'z') && c != '_' {
+			return masked[:i]
+		}
+	}
+
+	return masked
+}
+
+func isWriteStatement(masked string) bool {
+	return !nonWriteStatements[leadingKeyword(masked)]
+}
+
+// isReadQuery 只有一条语句且可以在副本执行的SELECT
+func isReadQuery(query string) bool {
+	statements := SplitStatements(query)
+	if len(statements) != 1 {
+		return false
+	}
+
+	masked := maskStatement(statements[0])
+
+	return leadingKeyword(masked) == "select" && !primaryReadReg.MatchString(masked)
+}
+
+// commandLoop 代理认证 读写分离 连接池 防火墙 只读监听和结果集脱敏需要代理按命令转发, 每条命令选择主库或副本, 读完响应后再读下一条命令
+func (p *ProxyConn) commandLoop(rq *RecordQuery) error {
+	split := &readWriteSplit{
+		backend:    p.backend,
+		primary:    newBackendConn(p.backend, p.serverConn),
+		pooled:     backendPool != nil,
+		autocommit: true,
+		writeStmts: make(map[uint32]bool),
+	}
+	defer split.closeReplica()
+
+	if split.pooled {
+		// 登录后的连接直接放入连接池, 第一条命令会租用它
+		split.primary.schema = p.session.Schema
+		backendPool.adopt(split.primary, p.poolKey(p.session.Schema, nil))
+		split.primary = nil
+		defer split.closePrimary()
+	}
+
+	clientReader := bufio.NewReader(p.clientConn)
+	clientWriter := bufio.NewWriter(p.clientConn)
+	mask := newResultMask()
+
+	for {
+		packet, err := ReadMysqlPacket(clientReader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		if len(packet.Payload) == 0 {
+			return fmt.Errorf("empty command packet")
+		}
+
+		command := packet.Payload[0]
+
+		if command == ComQuit && split.pooled {
+			// 连接池中的连接不关闭
+			rq.ReadClientPacket(packet)
+			return nil
+		}
+
+		if command == ComChangeUser && p.proxyUser != nil {
+			rq.ReadClientPacket(packet)
+
+			err = p.changeUser(split, packet, clientReader, clientWriter, rq)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// 被只读监听或防火墙拒绝的命令不发往服务端
+		errPacket := p.checkReadOnly(packet.Payload)
+		if errPacket == nil {
+			errPacket = p.checkFirewall(packet.Payload)
+		}
+
+		if errPacket != nil {
+			rq.ReadClientPacket(packet)
+
+			err = p.writeClientErr(rq, clientWriter, packet, errPacket)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		server, err := p.chooseBackend(split, packet.Payload)
+
+		rq.ReadClientPacket(packet)
+
+		if err != nil {
+			zlog.Warnf("connection_id:%d lease backend conn err: %s", p.session.ConnectionId, err)
+
+			if command == ComStmtClose || command == ComStmtSendLongData {
+				continue
+			}
+
+			// 返回错误后继续读下一条命令
+			err = p.writeClientErr(rq, clientWriter, packet, NewErrPacket(ErConCount, "08004", err.Error()))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		rq.setServer(server.backend.Name)
+
+		_, err = server.conn.Write(packet.ToByte())
+		if err != nil {
+			return err
+		}
+
+		switch command {
+		case ComQuit:
+			return nil
+
+		case ComStmtClose:
+			if len(packet.Payload) >= 5 {
+				delete(split.writeStmts, ReadUint32(packet.Payload[1:5]))
+				if mask != nil {
+					mask.closeStmt(ReadUint32(packet.Payload[1:5]))
+				}
+			}
+
+		case ComStmtSendLongData:
+			// 没有响应
+
+		default:
+			cmd, err := p.forwardResponse(server, packet, clientReader, clientWriter, rq, mask)
+			if err != nil {
+				return err
+			}
+
+			if server == split.primary {
+				split.afterPrimaryResponse(cmd, packet.Payload)
+			} else {
+				// 写入后的下一条语句发往了副本, 不再需要持有主库连接
+				split.holdNext = false
+			}
+		}
+
+		if split.canRelease() {
+			p.releasePrimary(split)
+		}
+	}
+}
+
+// writeClientErr 代理自己给客户端返回ERR包, 同时记录
+func (p *ProxyConn) writeClientErr(rq *RecordQuery, clientWriter *bufio.Writer, packet *MysqlPacket, errPacket *MysqlErrPacket) error {
+	seq := packet.LastSequenceId() + 1
+	data := errPacket.ToByte(seq)
+
+	rq.ReadServerPacket(&MysqlPacket{MysqlPacketHeader: MysqlPacketHeader{SequenceId: seq}, Payload: data[4:]})
+
+	_, err := clientWriter.Write(data)
+	if err != nil {
+		return err
+	}
+
+	return clientWriter.Flush()
+}
+
+// chooseBackend 可以读副本时返回已同步会话的副本连接, 否则返回主库
+func (p *ProxyConn) chooseBackend(split *readWriteSplit, payload []byte) (*backendConn, error) {
+	if payload[0] != ComQuery || !split.canReadReplica() || !isReadQuery(string(payload[1:])) {
+		return p.primaryConn(split)
+	}
+
+	if split.replica == nil {
+		replica, err := p.connectReplica()
+		if err != nil {
+			zlog.Warnf("connection_id:%d connect replica err: %s, use primary", p.session.ConnectionId, err)
+			split.replicaFailed = true
+			return p.primaryConn(split)
+		}
+
+		split.replica = replica
+	}
+
+	err := p.syncSession(split.replica, split.sets)
+	if err != nil {
+		zlog.Warnf("connection_id:%d sync replica %s err: %s, use primary", p.session.ConnectionId, split.replica.backend.Name, err)
+		split.closeReplica()
+		split.replicaFailed = true
+		return p.primaryConn(split)
+	}
+
+	return split.replica, nil
+}
+
+// primaryConn 连接池模式下没有持有主库连接时先从连接池租用
+func (p *ProxyConn) primaryConn(split *readWriteSplit) (*backendConn, error) {
+	if split.primary == nil {
+		err := p.leasePrimary(split)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return split.primary, nil
+}
+
+// connectReplica 从当前后端的副本中轮询选择一个建立连接, 失败时尝试下一个
+func (p *ProxyConn) connectReplica() (*backendConn, error) {
+	replicas := p.backend.replicas
+	start := atomic.AddUint32(&p.backend.replicaIndex, 1)
+
+	for i := range replicas {
+		backend := replicas[(int(start)+i)%len(replicas)]
+		if !backend.Healthy() {
+			continue
+		}
+
+		conn, err := p.dialBackend(backend)
+		if err != nil {
+			zlog.Warnf("connect replica %s err: %s", backend.Name, err)
+			continue
+		}
+
+		zlog.Infof("connection_id:%d connect replica:%s", p.session.ConnectionId, backend.Name)
+
+		c := newBackendConn(backend, conn)
+		c.schema = p.session.Schema
+
+		return c, nil
+	}
+
+	return nil, fmt.Errorf("no available replica")
+}
+
+// dialBackend 用服务账号登录后端, 握手参数与主库一致, 不使用压缩
+func (p *ProxyConn) dialBackend(backend *Backend) (net.Conn, error) {
+	conn, err := dialTimeout(backend.Addr)
+	if err != nil {
+		backend.setHealth(err, 0)
+		return nil, err
+	}
+
+	backend.connected()
+
+	serverConn, err := p.loginBackend(conn, backend)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return serverConn, nil
+}
+
+func (p *ProxyConn) loginBackend(conn net.Conn, backend *Backend) (net.Conn, error) {
+	hk, err := ReadHandshakeV10(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := *p.serverResp
+	resp.ClientFlag &^= CapabilityClientSSL | CapabilityClientCanUseCompress | CapabilityClientZstdCompressionAlgorithm
+	resp.ClientFlag &^= CapabilityClientConnectWithDB
+
+	if resp.ClientFlag&hk.CapabilityFlag&replicaCapabilityMask != resp.ClientFlag&replicaCapabilityMask {
+		return nil, fmt.Errorf("capability mismatch with primary: %#x", hk.CapabilityFlag)
+	}
+	resp.ClientFlag &= hk.CapabilityFlag
+
+	resp.Database = p.session.Schema
+	if resp.Database != "" {
+		resp.ClientFlag |= CapabilityClientConnectWithDB
+	}
+
+	scramble := hk.AuthPluginData[:20]
+	resp.AuthPluginMethod = hk.AuthPluginMethod
+	resp.Password = scramblePassword(hk.AuthPluginMethod, p.proxyUser.BackendPassword, scramble)
+	resp.SequenceId = 1
+
+	conn, err = startServerTls(conn, backend.Addr, hk.CapabilityFlag, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(resp.ToByte())
+	if err != nil {
+		return nil, err
+	}
+
+	pk, err := authenticateServer(conn, p.proxyUser, scramble)
+	if err != nil {
+		return nil, err
+	}
+
+	if pk.Payload[0] == ErrPacket {
+		errPacket, err := ParseErrPacket(pk.Payload)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, errPacket
+	}
+
+	return conn, nil
+}
+
+// syncSession 使用副本或连接池中的连接前同步当前库和主库上执行过的SET语句
+func (p *ProxyConn) syncSession(c *backendConn, sets []string) error {
+	if schema := p.session.Schema; schema != "" && c.schema != schema {
+		err := p.execInternal(c, append([]byte{ComInitDB}, schema...))
+		if err != nil {
+			return err
+		}
+
+		c.schema = schema
+	}
+
+	for ; c.sets < len(sets); c.sets++ {
+		err := p.execInternal(c, append([]byte{ComQuery}, sets[c.sets]...))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// execInternal 代理自己在后端执行一条命令, 响应不转发给客户端
+func (p *ProxyConn) execInternal(c *backendConn, payload []byte) error {
+	_, err := c.conn.Write(WithHeaderPacket(payload, 0))
+	if err != nil {
+		return err
+	}
+
+	cmd := &QueryCommand{Command: payload[0], StartTime: time.Now(), Result: &QueryResult{}}
+	// 只用来判断响应结束, 不记录
+	tracker := &RecordQuery{session: p.session}
+
+	for {
+		pk, err := ReadMysqlPacket(c.reader)
+		if err != nil {
+			return err
+		}
+
+		if tracker.readResponse(cmd, pk.Payload) {
+			break
+		}
+	}
+
+	if cmd.Result.Err != nil {
+		return cmd.Result.Err
+	}
+
+	return nil
+}
+
+// forwardResponse 把服务端对一条命令的响应转发给客户端, 返回解析后的命令
+// LOAD DATA LOCAL INFILE 和 COM_CHANGE_USER 的认证过程中还要把客户端的包转发给同一个服务端
+// mask不为nil时改写结果集中需要脱敏的列, 记录的也是改写后的包
+func (p *ProxyConn) forwardResponse(server *backendConn, packet *MysqlPacket, clientReader *bufio.Reader,
+	clientWriter *bufio.Writer, rq *RecordQuery, mask *resultMask) (*QueryCommand, error) {
+	cmd := &QueryCommand{Command: packet.Payload[0], StartTime: time.Now(), Result: &QueryResult{}}
+	if cmd.Command == ComQuery || cmd.Command == ComPrepare {
+		cmd.Query = string(packet.Payload[1:])
+	}
+
+	tracker := &RecordQuery{session: p.session}
+	var infileSent bool
+
+	if mask != nil {
+		mask.begin(p.session.User, packet.Payload)
+	}
+
+	// 改写后的包超过MaxPacketSize时拆分的包数可能变化, 后续包的序列号随之调整
+	var seqOffset uint8
+
+	for {
+		pk, err := ReadMysqlPacket(server.reader)
+		if err != nil {
+			return nil, err
+		}
+
+		if mask != nil {
+			pk.SequenceId += seqOffset
+			lastSeq := pk.LastSequenceId()
+
+			pk.Payload, err = mask.rewrite(tracker.respState, cmd, pk.Payload)
+			if err != nil {
+				return nil, fmt.Errorf("mask result set err: %w", err)
+			}
+
+			pk.Length = uint32(len(pk.Payload))
+			seqOffset += pk.LastSequenceId() - lastSeq
+		}
+
+		rq.ReadServerPacket(pk)
+		done := tracker.readResponse(cmd, pk.Payload)
+
+		_, err = clientWriter.Write(pk.ToByte())
+		if err != nil {
+			return nil, err
+		}
+
+		if done {
+			return cmd, clientWriter.Flush()
+		}
+
+		switch {
+		case tracker.respState == respStateLocalInfile && !infileSent:
+			infileSent = true
+
+			err = clientWriter.Flush()
+			if err != nil {
+				return nil, err
+			}
+
+			// 文件内容以空包结束
+			for {
+				data, err := ReadMysqlPacket(clientReader)
+				if err != nil {
+					return nil, err
+				}
+
+				rq.ReadClientPacket(data)
+
+				_, err = server.conn.Write(data.ToByte())
+				if err != nil {
+					return nil, err
+				}
+
+				if len(data.Payload) == 0 {
+					break
+				}
+			}
+
+		case tracker.respState == respStateAuth:
+			// fast auth 后面直接是OK包
+			if len(pk.Payload) == 2 && pk.Payload[0] == AuthMoreDataPacket && pk.Payload[1] == CachingSha2FastAuth {
+				continue
+			}
+
+			err = clientWriter.Flush()
+			if err != nil {
+				return nil, err
+			}
+
+			data, err := ReadMysqlPacket(clientReader)
+			if err != nil {
+				return nil, err
+			}
+
+			rq.ReadClientPacket(data)
+
+			_, err = server.conn.Write(data.ToByte())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package mysqlserver
+
+import "testing"
+
+func newTestSplit() *readWriteSplit {
+	return &readWriteSplit{
+		backend:    &Backend{},
+		primary:    &backendConn{},
+		pooled:     true,
+		autocommit: true,
+		writeStmts: make(map[uint32]bool),
+	}
+}
+
+func autocommitResult(query string) *QueryCommand {
+	return &QueryCommand{
+		Command: ComQuery,
+		Query:   query,
+		Results: []*QueryResult{{HasStatus: true, StatusFlags: ServerStatusAutocommit}},
+	}
+}
+
+func TestReadWriteSplitHoldAfterWrite(t *testing.T) {
+	tests := []struct {
+		name    string
+		queries []string
+		// 每条语句执行后是否可以归还主库连接
+		want []bool
+	}{
+		{"read", []string{"select 1", "select 2"}, []bool{true, true}},
+		{"last_insert_id", []string{"insert into t values (1)", "select last_insert_id()", "select 1"}, []bool{false, true, true}},
+		{"row_count", []string{"update t set a = 1 where id = 1", "select row_count()"}, []bool{false, true}},
+		{"found_rows", []string{"select sql_calc_found_rows * from t limit 1", "select found_rows()"}, []bool{false, true}},
+		{"consecutive writes", []string{"insert into t values (1)", "delete from t where id = 2", "select 1"}, []bool{false, false, true}},
+		{"write in comment", []string{"select 1 /* insert into t values (1) */"}, []bool{true}},
+		{"write in string", []string{"select 'sql_calc_found_rows'"}, []bool{true}},
+		{"set", []string{"set names utf8mb4", "select 1"}, []bool{true, true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			split := newTestSplit()
+
+			for i, query := range tt.queries {
+				split.afterPrimaryResponse(autocommitResult(query), append([]byte{ComQuery}, query...))
+
+				if got := split.canRelease(); got != tt.want[i] {
+					t.Errorf("after %q canRelease() = %v, want %v", query, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReadWriteSplitHoldAfterStmtExecute(t *testing.T) {
+	split := newTestSplit()
+
+	prepare := &QueryCommand{Command: ComPrepare, Query: "insert into t values (?)", Stmt: &PrepareStmt{StmtId: 1}}
+	split.afterPrimaryResponse(prepare, nil)
+
+	execute := []byte{ComStmtExecute, 1, 0, 0, 0}
+	split.afterPrimaryResponse(&QueryCommand{Command: ComStmtExecute}, execute)
+
+	if !split.holdNext {
+		t.Errorf("holdNext = false after executing write statement")
+	}
+
+	split.afterPrimaryResponse(autocommitResult("select last_insert_id()"), nil)
+
+	if split.holdNext {
+		t.Errorf("holdNext = true after reading last_insert_id()")
+	}
+
+	split.reset()
+
+	if !split.canRelease() {
+		t.Errorf("canRelease() = false after reset")
+	}
+}
+
+// 无法重放的SET语句让连接池归还连接前重置会话
+func TestReadWriteSplitDirtySet(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"set names utf8mb4", false},
+		{"set session sql_mode = ''", false},
+		{"set transaction isolation level serializable", true},
+		{"select 1", false},
+	}
+
+	for _, tt := range tests {
+		split := newTestSplit()
+		split.afterPrimaryResponse(autocommitResult(tt.query), append([]byte{ComQuery}, tt.query...))
+
+		if split.dirty != tt.want {
+			t.Errorf("after %q dirty = %v, want %v", tt.query, split.dirty, tt.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package mysqlserver
+
+import (
+	"bytes"
+	"fmt"
+	"proxymysql/app/zlog"
+)
+
+// Session 一个客户端连接的会话信息
+type Session struct {
+	ConnectionId uint32
+	ClientAddr   string
+	User         string
+	Schema       string
+	// 客户端与服务端协商后的capability
+	Capability uint32
+	// 认证插件和认证方式
+	AuthPlugin string
+	AuthPath   string
+	// 代理认证时登录服务端使用的服务账号
+	BackendUser string
+	// 路由选择的后端名称
+	Backend string
+	// 握手时客户端发送的连接属性
+	ClientAttrs map[string]string
+	// 最近一次OK/EOF包中的SERVER_STATUS_IN_TRANS
+	InTransaction bool
+	// 会话中修改过的变量, 包括SET语句和服务端的session state tracking, 用户变量以@开头
+	Variables map[string]string
+}
+
+func NewSession(connectionId uint32, clientAddr string, resp *HandshakeResponse, serverCapability uint32) *Session {
+	return &Session{
+		ConnectionId: connectionId,
+		ClientAddr:   clientAddr,
+		User:         resp.Username,
+		Schema:       resp.Database,
+		Capability:   resp.ClientFlag & serverCapability,
+		AuthPlugin:   resp.AuthPluginMethod,
+		ClientAttrs:  resp.ClientAttrs,
+		Variables:    make(map[string]string),
+	}
+}
+
+// String 文本格式记录中的会话信息
+func (s *Session) String() string {
+	return fmt.Sprintf("【user:%s schema:%s in_trx:%t】", s.User, s.Schema, s.InTransaction)
+}
+
+// reset COM_CHANGE_USER和COM_RESET_CONNECTION后服务端重置了会话变量和事务
+func (s *Session) reset() {
+	s.InTransaction = false
+	s.Variables = make(map[string]string)
+}
+
+// applyStatement 语句执行成功后, 根据USE和SET语句更新会话
+func (s *Session) applyStatement(stmt string) {
+	if schema, ok := parseUseStatement(stmt); ok {
+		s.Schema = schema
+		return
+	}
+
+	for name, value := range parseSetStatement(stmt) {
+		s.Variables[name] = value
+	}
+}
+
+// applyResults 根据服务端返回的状态和session state tracking更新会话
+func (s *Session) applyResults(results []*QueryResult) {
+	for _, result := range results {
+		if result.Err != nil && result.Err.ErrCode == ErLockDeadlock {
+			// 死锁时整个事务已回滚
+			s.InTransaction = false
+			continue
+		}
+
+		if result.Err != nil || !result.HasStatus {
+			continue
+		}
+
+		s.InTransaction = result.StatusFlags&ServerStatusInTrans > 0
+
+		if len(result.SessionStateInfo) > 0 {
+			err := s.applySessionStateInfo(result.SessionStateInfo)
+			if err != nil {
+				zlog.Errorf("parse session state info err: %s", err)
+			}
+		}
+	}
+}
+
+// applySessionStateInfo 解析OK包中的session_state_info
+// 每一项为 type(1) data(lenenc)
+// SESSION_TRACK_SYSTEM_VARIABLES: name(lenenc) value(lenenc)
+// SESSION_TRACK_SCHEMA: name(lenenc)
+func (s *Session) applySessionStateInfo(data []byte) error {
+	buf := bytes.NewBuffer(data)
+
+	for buf.Len() > 0 {
+		typ, err := readBinaryN(buf, 1)
+		if err != nil {
+			return err
+		}
+
+		item, err := readBinaryLengthEncoded(buf)
+		if err != nil {
+			return err
+		}
+
+		itemBuf := bytes.NewBuffer(item)
+
+		switch typ[0] {
+		case SessionTrackSystemVariables:
+			name, err := readBinaryLengthEncoded(itemBuf)
+			if err != nil {
+				return err
+			}
+
+			value, err := readBinaryLengthEncoded(itemBuf)
+			if err != nil {
+				return err
+			}
+
+			s.Variables[string(name)] = string(value)
+
+		case SessionTrackSchema:
+			schema, err := readBinaryLengthEncoded(itemBuf)
+			if err != nil {
+				return err
+			}
+
+			s.Schema = string(schema)
+		}
+	}
+
+	return nil
+}
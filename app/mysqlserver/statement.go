@@ -0,0 +1,435 @@
+package mysqlserver
+
+import (
+	"proxymysql/app/zlog"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SplitStatements 按分号拆分多语句, 忽略字符串、标识符和注释中的分号, 不返回空语句
+func SplitStatements(query string) []string {
+	var (
+		res   []string
+		start int
+	)
+
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; c {
+		case '\'', '"', '`':
+			i = skipQuoted(query, i, c)
+
+		case '#':
+			i = skipLine(query, i)
+
+		case '-':
+			// "-- " 后面要跟空白或控制字符才是注释
+			if i+1 < len(query) && query[i+1] == '-' && (i+2 == len(query) || query[i+2] <= ' ') {
+				i = skipLine(query, i)
+			}
+
+		case '/':
+			if i+1 < len(query) && query[i+1] == '*' {
+				end := strings.Index(query[i+2:], "*/")
+				if end < 0 {
+					i = len(query)
+				} else {
+					i += 2 + end + 1
+				}
+			}
+
+		case ';':
+			if stmt := strings.TrimSpace(query[start:i]); stmt != "" {
+				res = append(res, stmt)
+			}
+			start = i + 1
+		}
+	}
+
+	if start < len(query) {
+		if stmt := strings.TrimSpace(query[start:]); stmt != "" {
+			res = append(res, stmt)
+		}
+	}
+
+	return res
+}
+
+// executableStatements 同SplitStatements, 可执行注释 /*! ... */ 中的分号同样拆分, 用于防火墙和只读检查
+func executableStatements(query string) []string {
+	var res []string
+
+	for _, stmt := range SplitStatements(query) {
+		if !strings.Contains(stmt, "/*!") {
+			res = append(res, stmt)
+			continue
+		}
+
+		res = append(res, SplitStatements(stripComments(stmt))...)
+	}
+
+	return res
+}
+
+// skipQuoted 返回与query[start]配对的引号位置, 字符串中支持反斜杠转义和连续两个引号
+func skipQuoted(query string, start int, quote byte) int {
+	for i := start + 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if quote != '`' {
+				i++
+			}
+
+		case quote:
+			if i+1 < len(query) && query[i+1] == quote {
+				i++
+				continue
+			}
+			return i
+		}
+	}
+
+	return len(query)
+}
+
+func skipLine(query string, start int) int {
+	end := strings.IndexByte(query[start:], '\n')
+	if end < 0 {
+		return len(query)
+	}
+
+	return start + end
+}
+
+// isCallStatement 是否是存储过程调用, 存储过程中的每个结果集之后还有一个表示CALL结束的OK包
+func isCallStatement(stmt string) bool {
+	stmt = trimLeadingComment(stmt)
+
+	return len(stmt) > 4 && strings.EqualFold(stmt[:4], "call") && (stmt[4] <= ' ' || stmt[4] == '(')
+}
+
+// trimLeadingComment 去掉开头的注释, 可执行注释 /*!50000 ... */ 会被服务端执行, 保留注释中的语句
+func trimLeadingComment(stmt string) string {
+	for {
+		stmt = strings.TrimSpace(stmt)
+
+		switch {
+		case strings.HasPrefix(stmt, "/*!"):
+			end := strings.Index(stmt, "*/")
+			if end < 0 {
+				return strings.TrimSpace(executableCommentBody(stmt[3:]))
+			}
+			stmt = executableCommentBody(stmt[3:end]) + " " + stmt[end+2:]
+
+		case strings.HasPrefix(stmt, "/*"):
+			end := strings.Index(stmt, "*/")
+			if end < 0 {
+				return ""
+			}
+			stmt = stmt[end+2:]
+
+		case strings.HasPrefix(stmt, "#"), strings.HasPrefix(stmt, "-- "):
+			end := strings.IndexByte(stmt, '\n')
+			if end < 0 {
+				return ""
+			}
+			stmt = stmt[end+1:]
+
+		default:
+			return stmt
+		}
+	}
+}
+
+// executableCommentBody 去掉可执行注释开头的版本号, 5位或6位数字
+func executableCommentBody(body string) string {
+	n := 0
+	for n < len(body) && n < 6 && isDigit(body[n]) {
+		n++
+	}
+
+	if n < 5 {
+		return body
+	}
+
+	return body[n:]
+}
+
+// stripComments 把注释替换为空格, 可执行注释 /*! ... */ 只去掉注释标记, 保留注释中的语句
+func stripComments(stmt string) string {
+	var buf strings.Builder
+
+	for i := 0; i < len(stmt); i++ {
+		switch c := stmt[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			end := skipQuoted(stmt, i, c)
+			if end >= len(stmt) {
+				buf.WriteString(stmt[i:])
+				return buf.String()
+			}
+
+			buf.WriteString(stmt[i : end+1])
+			i = end
+
+		case c == '#', c == '-' && i+1 < len(stmt) && stmt[i+1] == '-' && (i+2 == len(stmt) || stmt[i+2] <= ' '):
+			i = skipLine(stmt, i)
+			buf.WriteByte(' ')
+
+		case c == '/' && i+1 < len(stmt) && stmt[i+1] == '*':
+			bodyEnd, next := len(stmt), len(stmt)
+			if end := strings.Index(stmt[i+2:], "*/"); end >= 0 {
+				bodyEnd = i + 2 + end
+				next = bodyEnd + 2
+			}
+
+			buf.WriteByte(' ')
+			if i+2 < bodyEnd && stmt[i+2] == '!' {
+				buf.WriteString(stripComments(executableCommentBody(stmt[i+3 : bodyEnd])))
+				buf.WriteByte(' ')
+			}
+			i = next - 1
+
+		default:
+			buf.WriteByte(c)
+		}
+	}
+
+	return buf.String()
+}
+
+// pairStatementResults 把服务端返回的结果按顺序分配给每条语句
+// 普通语句对应一个结果, CALL对应若干结果集加最后的OK/ERR, 出错后剩下的语句没有执行
+// 结果与语句对不上时(如存储过程定义里的分号)返回false
+func pairStatementResults(statements []string, results []*QueryResult) ([][]*QueryResult, bool) {
+	groups := make([][]*QueryResult, len(statements))
+
+	i := 0
+	for k, stmt := range statements {
+		if i >= len(results) {
+			if len(results) > 0 && results[len(results)-1].Err != nil {
+				break
+			}
+			return nil, false
+		}
+
+		if !isCallStatement(stmt) {
+			groups[k] = results[i : i+1]
+			i++
+			continue
+		}
+
+		for i < len(results) {
+			result := results[i]
+			groups[k] = append(groups[k], result)
+			i++
+
+			if !result.ResultSet || result.Err != nil {
+				break
+			}
+		}
+	}
+
+	if i < len(results) {
+		return nil, false
+	}
+
+	return groups, true
+}
+
+// splitStatements 把多语句的COM_QUERY拆成每条语句一个命令, 不是多语句时原样返回
+func (r *RecordQuery) splitStatements(cmd *QueryCommand) []*QueryCommand {
+	if r.session.Capability&CapabilityClientMultiStatements == 0 {
+		return []*QueryCommand{cmd}
+	}
+
+	statements := SplitStatements(cmd.Query)
+	if len(statements) <= 1 {
+		return []*QueryCommand{cmd}
+	}
+
+	groups, ok := pairStatementResults(statements, cmd.Results)
+	if !ok {
+		zlog.Debugf("statements and results mismatch, statements:%d results:%d", len(statements), len(cmd.Results))
+		return []*QueryCommand{cmd}
+	}
+
+	res := make([]*QueryCommand, 0, len(statements))
+
+	// 每条语句的开始时间为上一条语句结束的时间
+	var elapsed time.Duration
+
+	for k, stmt := range statements {
+		stmtCmd := &QueryCommand{
+			Command:        cmd.Command,
+			Query:          stmt,
+			StartTime:      cmd.StartTime.Add(elapsed),
+			Results:        groups[k],
+			StatementIndex: k + 1,
+		}
+
+		// 出错后没有执行的语句没有结果
+		if len(groups[k]) > 0 {
+			stmtCmd.Result = mergeResults(groups[k])
+			elapsed += stmtCmd.Result.Duration
+		}
+
+		res = append(res, stmtCmd)
+	}
+
+	return res
+}
+
+var useStatementReg = regexp.MustCompile("(?is)^use\\s+(`([^`]+)`|[^\\s;`]+)\\s*;?$")
+
+// parseUseStatement 解析 USE db 语句
+func parseUseStatement(stmt string) (string, bool) {
+	match := useStatementReg.FindStringSubmatch(trimLeadingComment(stmt))
+	if match == nil {
+		return "", false
+	}
+
+	if match[2] != "" {
+		return match[2], true
+	}
+
+	return match[1], true
+}
+
+// parseSetStatement 解析SET语句中修改的会话变量, 变量名为小写, 用户变量以@开头
+// GLOBAL/PERSIST变量不属于会话, 会被忽略; 作用域关键字对后面没有关键字的赋值同样有效
+func parseSetStatement(stmt string) map[string]string {
+	stmt = strings.TrimSuffix(strings.TrimSpace(trimLeadingComment(stmt)), ";")
+	if len(stmt) < 4 || !strings.EqualFold(stmt[:3], "set") || stmt[3] > ' ' {
+		return nil
+	}
+
+	rest := strings.TrimSpace(stmt[4:])
+	lower := strings.ToLower(rest)
+
+	switch {
+	case strings.HasPrefix(lower, "names "):
+		charset := firstWord(rest[len("names "):])
+		return map[string]string{
+			"character_set_client":     charset,
+			"character_set_connection": charset,
+			"character_set_results":    charset,
+		}
+
+	case strings.HasPrefix(lower, "character set "), strings.HasPrefix(lower, "charset "):
+		charset := firstWord(rest[strings.Index(lower, "set ")+len("set "):])
+		return map[string]string{
+			"character_set_client":  charset,
+			"character_set_results": charset,
+		}
+
+	case strings.HasPrefix(lower, "transaction "):
+		// 只影响下一个事务
+		return nil
+	}
+
+	res := make(map[string]string)
+	session := true
+
+	for _, assignment := range splitTopLevel(rest, ',') {
+		name, value, ok := cutAssignment(assignment)
+		if !ok {
+			continue
+		}
+
+		name = strings.TrimSpace(name)
+		lowerName := strings.ToLower(name)
+
+		// 作用域关键字
+		for _, scope := range []string{"global ", "persist ", "persist_only ", "session ", "local "} {
+			if strings.HasPrefix(lowerName, scope) {
+				session = scope == "session " || scope == "local "
+				name = strings.TrimSpace(name[len(scope):])
+				lowerName = strings.ToLower(name)
+				break
+			}
+		}
+
+		varSession := session
+
+		switch {
+		case strings.HasPrefix(lowerName, "@@"):
+			varName := lowerName[2:]
+			varSession = true
+			if scope, rest, ok := strings.Cut(varName, "."); ok {
+				varName = rest
+				varSession = scope == "session" || scope == "local"
+			}
+			lowerName = varName
+
+		case strings.HasPrefix(lowerName, "@"):
+			// 用户变量总是属于会话
+			res[lowerName] = trimQuote(strings.TrimSpace(value))
+			continue
+		}
+
+		if !varSession {
+			continue
+		}
+
+		res[strings.Trim(lowerName, "`")] = trimQuote(strings.TrimSpace(value))
+	}
+
+	return res
+}
+
+// splitTopLevel 按sep拆分, 忽略引号和括号中的sep
+func splitTopLevel(s string, sep byte) []string {
+	var (
+		res   []string
+		start int
+		depth int
+	)
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\'', '"', '`':
+			i = skipQuoted(s, i, c)
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case sep:
+			if depth == 0 {
+				res = append(res, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(res, s[start:])
+}
+
+// cutAssignment 按第一个 = 或 := 拆分变量名和值
+func cutAssignment(s string) (string, string, bool) {
+	idx := strings.IndexByte(s, '=')
+	if idx <= 0 {
+		return "", "", false
+	}
+
+	name := s[:idx]
+	name = strings.TrimSuffix(name, ":")
+
+	return name, s[idx+1:], true
+}
+
+func firstWord(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	return trimQuote(fields[0])
+}
+
+func trimQuote(s string) string {
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"' || s[0] == '`') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+
+	return s
+}
@@ -0,0 +1,46 @@
+package mysqlserver
+
+import "testing"
+
+func TestMaskStatementComments(t *testing.T) {
+	tests := []struct {
+		stmt string
+		want string
+	}{
+		{"/* x */ SELECT 1", "select 1"},
+		{"select 1 # where", "select 1"},
+		{"select 1 -- where\n, 2", "select 1  , 2"},
+		{"select 1 --where", "select 1 --where"},
+		{"select '/* x */' /* y */", "select '       '"},
+		{"/*!DROP TABLE t*/", "drop table t"},
+		{"/*!50000 DELETE FROM t */", "delete from t"},
+		{"/*!80034 DELETE FROM t */", "delete from t"},
+		{"/*!5000 x */", "5000 x"},
+		{"select /*+ MAX_EXECUTION_TIME(10) */ 1", "select   1"},
+		{"select 1 /* unterminated", "select 1"},
+	}
+
+	for _, tt := range tests {
+		if got := maskStatement(tt.stmt); got != tt.want {
+			t.Errorf("maskStatement(%q) = %q, want %q", tt.stmt, got, tt.want)
+		}
+	}
+}
+
+func TestTrimLeadingComment(t *testing.T) {
+	tests := []struct {
+		stmt string
+		want string
+	}{
+		{"/* a */ # b\n-- c\nSET a=1", "SET a=1"},
+		{"/*!40101 SET NAMES utf8 */", "SET NAMES utf8"},
+		{"/*!DROP TABLE t*/", "DROP TABLE t"},
+		{"/* only comment */", ""},
+	}
+
+	for _, tt := range tests {
+		if got := trimLeadingComment(tt.stmt); got != tt.want {
+			t.Errorf("trimLeadingComment(%q) = %q, want %q", tt.stmt, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package mysqlserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"proxymysql/app/zlog"
+)
+
+const (
+	// ErSecureTransportRequired ER_SECURE_TRANSPORT_REQUIRED
+	ErSecureTransportRequired = 3159
+)
+
+var (
+	// 客户端连接代理使用的tls配置, 为nil时不支持ssl
+	clientTlsConfig *tls.Config
+	// 拒绝没有使用ssl的客户端
+	requireSecureTransport bool
+)
+
+// InitClientTls 加载客户端连接代理时使用的证书
+func InitClientTls(certFile string, keyFile string, requireSecure bool) error {
+	requireSecureTransport = requireSecure
+
+	if certFile == "" && keyFile == "" {
+		if requireSecure {
+			return fmt.Errorf("require_secure_transport need client tls cert and key")
+		}
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	clientTlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	return nil
+}
+
+// IsSslRequest SSLRequest 只包含HandshakeResponse的前32个字节
+// client_flag(4) max_packet_size(4) character_set(1) filler(23)
+func IsSslRequest(packet *MysqlPacket) bool {
+	return len(packet.Payload) == 32 && ReadUint32(packet.Payload[:4])&CapabilityClientSSL > 0
+}
+
+// upgradeClientTls 收到SSLRequest后把客户端连接升级为tls
+func (p *ProxyConn) upgradeClientTls() error {
+	if clientTlsConfig == nil {
+		return fmt.Errorf("client request ssl but proxy tls is not configured")
+	}
+
+	tlsConn := tls.Server(p.clientConn, clientTlsConfig)
+	err := tlsConn.Handshake()
+	if err != nil {
+		return fmt.Errorf("client tls handshake err: %w", err)
+	}
+
+	p.clientConn = tlsConn
+
+	return nil
+}
+
+// 代理连接服务端的ssl模式, 与mysql客户端的 --ssl-mode 一致
+const (
+	ServerTlsDisabled       = "disabled"
+	ServerTlsPreferred      = "preferred"
+	ServerTlsRequired       = "required"
+	ServerTlsVerifyCa       = "verify_ca"
+	ServerTlsVerifyIdentity = "verify_identity"
+)
+
+var (
+	serverTlsMode   = ServerTlsDisabled
+	serverTlsConfig *tls.Config
+)
+
+// InitServerTls 设置代理连接服务端使用的ssl, serverName为空时使用服务端地址中的host
+func InitServerTls(mode string, caFile string, certFile string, keyFile string, serverName string) error {
+	switch mode {
+	case "", ServerTlsDisabled:
+		serverTlsMode = ServerTlsDisabled
+		return nil
+	case ServerTlsPreferred, ServerTlsRequired, ServerTlsVerifyCa, ServerTlsVerifyIdentity:
+	default:
+		return fmt.Errorf("unsupported server tls mode: %s", mode)
+	}
+
+	cfg := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		caPem, err := os.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return fmt.Errorf("no valid certificate in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	switch mode {
+	case ServerTlsPreferred, ServerTlsRequired:
+		cfg.InsecureSkipVerify = true
+	case ServerTlsVerifyCa:
+		// 只校验证书链, 不校验主机名
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = verifyCertChain(cfg.RootCAs)
+	}
+
+	serverTlsMode = mode
+	serverTlsConfig = cfg
+
+	return nil
+}
+
+func verifyCertChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("server did not provide a certificate")
+		}
+
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+
+		return err
+	}
+}
+
+// upgradeServerTls 服务端支持ssl时先发送SSLRequest, 再把服务端连接升级为tls
+// 之后的HandshakeResponse序列号要加1
+func (p *ProxyConn) upgradeServerTls(addr string, serverCapability uint32, resp *HandshakeResponse) error {
+	conn, err := startServerTls(p.serverConn, addr, serverCapability, resp)
+	if err != nil {
+		return err
+	}
+
+	if conn != p.serverConn {
+		p.serverConn = conn
+		p.serverSeqOffset = 1
+	}
+
+	return nil
+}
+
+// startServerTls 按server_tls_mode升级服务端连接, 不使用ssl时返回原连接
+func startServerTls(conn net.Conn, addr string, serverCapability uint32, resp *HandshakeResponse) (net.Conn, error) {
+	if serverTlsMode == ServerTlsDisabled {
+		return conn, nil
+	}
+
+	if serverCapability&CapabilityClientSSL == 0 {
+		if serverTlsMode == ServerTlsPreferred {
+			zlog.Warnf("server %s does not support ssl, fallback to plaintext", addr)
+			return conn, nil
+		}
+
+		return nil, fmt.Errorf("server %s does not support ssl", addr)
+	}
+
+	resp.ClientFlag |= CapabilityClientSSL
+
+	data := make([]byte, 0, 32)
+	data = append(data, WriteUint32(resp.ClientFlag)...)
+	data = append(data, WriteUint32(resp.MaxPacketSize)...)
+	data = append(data, WriteByte(resp.Charset)...)
+	data = append(data, make([]byte, 23)...)
+
+	_, err := conn.Write(WithHeaderPacket(data, resp.SequenceId))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := serverTlsConfig.Clone()
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		cfg.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	err = tlsConn.Handshake()
+	if err != nil {
+		return nil, fmt.Errorf("server tls handshake err: %w", err)
+	}
+
+	resp.SequenceId++
+
+	return tlsConn, nil
+}
@@ -0,0 +1,218 @@
+package mysqlserver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 发生死锁时服务端回滚整个事务, ERR包里没有status_flags
+const ErLockDeadlock = 1213
+
+// 语句在事务中的标记
+const (
+	TrxMarkBegin            = "begin"
+	TrxMarkImplicitBegin    = "implicit_begin"
+	TrxMarkCommit           = "commit"
+	TrxMarkRollback         = "rollback"
+	TrxMarkImplicitCommit   = "implicit_commit"
+	TrxMarkImplicitRollback = "implicit_rollback"
+	// 自动提交模式下不在事务中的语句, 每条语句单独一个事务
+	TrxMarkAutocommit = "autocommit"
+	// 事务未结束时连接断开, 服务端会回滚
+	TrxMarkDisconnect = "disconnect"
+)
+
+// Transaction 一个显式或隐式开启的事务, 结束时可以记录一条汇总
+type Transaction struct {
+	Id        uint64
+	StartTime time.Time
+	EndTime   time.Time
+	// 开始和结束的方式, 取值见TrxMark
+	Begin        string
+	End          string
+	Statements   int
+	Errors       int
+	AffectedRows uint64
+}
+
+func (t *Transaction) Duration() time.Duration {
+	return t.EndTime.Sub(t.StartTime)
+}
+
+func (t *Transaction) String() string {
+	return fmt.Sprintf("begin:%s end:%s statements:%d errors:%d affected_rows:%d 【duration:%s】",
+		t.Begin, t.End, t.Statements, t.Errors, t.AffectedRows, t.Duration())
+}
+
+// add 把命令计入事务
+func (t *Transaction) add(cmd *QueryCommand) {
+	t.EndTime = commandEndTime(cmd)
+
+	if !isStatementCommand(cmd.Command) {
+		return
+	}
+
+	t.Statements++
+
+	if cmd.Result.Err != nil {
+		t.Errors++
+	}
+
+	t.AffectedRows += cmd.Result.AffectedRows
+}
+
+func commandEndTime(cmd *QueryCommand) time.Time {
+	if cmd.Result == nil {
+		return cmd.StartTime
+	}
+
+	return cmd.StartTime.Add(cmd.Result.Duration)
+}
+
+// isStatementCommand 执行sql的命令
+func isStatementCommand(command uint8) bool {
+	return command == ComQuery || command == ComStmtExecute
+}
+
+// transactionStatement 返回语句对事务的控制 begin commit rollback, 其他语句返回空
+// ROLLBACK TO SAVEPOINT 不结束事务
+func transactionStatement(stmt string) string {
+	words := strings.Fields(strings.ToLower(trimLeadingComment(stmt)))
+	if len(words) == 0 {
+		return ""
+	}
+
+	first := strings.TrimSuffix(words[0], ";")
+
+	switch first {
+	case "begin":
+		return TrxMarkBegin
+
+	case "start":
+		if len(words) > 1 && strings.HasPrefix(words[1], "transaction") {
+			return TrxMarkBegin
+		}
+
+	case "commit":
+		return TrxMarkCommit
+
+	case "rollback":
+		for _, word := range words[1:] {
+			if word == "to" {
+				return ""
+			}
+		}
+		return TrxMarkRollback
+	}
+
+	return ""
+}
+
+// trackTransaction 根据命令执行前后的事务状态给命令分配事务id和标记
+// 返回这条命令结束的事务, 没有时返回nil
+func (r *RecordQuery) trackTransaction(cmd *QueryCommand) *Transaction {
+	result := cmd.Result
+	if result == nil {
+		// 没有响应的命令
+		if r.trx != nil {
+			cmd.TrxId = r.trx.Id
+		}
+		return nil
+	}
+
+	var kind string
+	if isStatementCommand(cmd.Command) {
+		kind = transactionStatement(cmd.Query)
+	}
+
+	before := r.trx != nil
+	after := before
+
+	switch {
+	case result.HasStatus:
+		after = result.StatusFlags&ServerStatusInTrans > 0
+		r.autocommit = result.StatusFlags&ServerStatusAutocommit > 0
+
+	case result.Err != nil && result.Err.ErrCode == ErLockDeadlock:
+		after = false
+	}
+
+	// COMMIT AND CHAIN 和事务中的BEGIN 会结束当前事务并开启新事务
+	ended := before && (!after || (result.Err == nil && kind != ""))
+	started := after && (!before || ended)
+
+	var finished *Transaction
+
+	if ended {
+		finished = r.trx
+		r.trx = nil
+
+		switch {
+		case kind == TrxMarkBegin:
+			// 开启新事务前隐式提交, BEGIN属于新事务
+			finished.End = TrxMarkImplicitCommit
+
+		case kind != "":
+			finished.End = kind
+			finished.add(cmd)
+			cmd.TrxId = finished.Id
+			cmd.TrxMark = kind
+
+		case result.Err != nil:
+			finished.End = TrxMarkImplicitRollback
+			finished.add(cmd)
+			cmd.TrxId = finished.Id
+			cmd.TrxMark = TrxMarkImplicitRollback
+
+		default:
+			finished.End = TrxMarkImplicitCommit
+			finished.add(cmd)
+			cmd.TrxId = finished.Id
+			cmd.TrxMark = TrxMarkImplicitCommit
+		}
+	}
+
+	if started {
+		r.trxSeq++
+		r.trx = &Transaction{
+			Id:        r.trxSeq,
+			StartTime: cmd.StartTime,
+			Begin:     TrxMarkImplicitBegin,
+		}
+
+		switch kind {
+		case TrxMarkCommit, TrxMarkRollback:
+			// AND CHAIN, 新事务从这条命令结束后开始
+			r.trx.StartTime = commandEndTime(cmd)
+			r.trx.EndTime = r.trx.StartTime
+
+		case TrxMarkBegin:
+			r.trx.Begin = TrxMarkBegin
+			fallthrough
+
+		default:
+			r.trx.add(cmd)
+			cmd.TrxId = r.trx.Id
+			cmd.TrxMark = r.trx.Begin
+		}
+	}
+
+	if ended || started {
+		return finished
+	}
+
+	if r.trx != nil {
+		r.trx.add(cmd)
+		cmd.TrxId = r.trx.Id
+		return nil
+	}
+
+	if isStatementCommand(cmd.Command) && r.autocommit {
+		r.trxSeq++
+		cmd.TrxId = r.trxSeq
+		cmd.TrxMark = TrxMarkAutocommit
+	}
+
+	return nil
+}
@@ -5,6 +5,7 @@ go 1.20
 require (
 	github.com/huandu/go-sqlbuilder v1.25.0
 	github.com/json-iterator/go v1.1.12
+	github.com/klauspost/compress v1.17.4
 	go.uber.org/zap v1.26.0
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 	gorm.io/driver/mysql v1.5.2
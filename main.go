@@ -6,6 +6,7 @@ import (
 	"net"
 	"os"
 	"proxymysql/app/conf"
+	"proxymysql/app/db"
 	"proxymysql/app/mysqlserver"
 	"proxymysql/app/zlog"
 	"time"
@@ -14,26 +15,144 @@ import (
 func main() {
 	flag.StringVar(&conf.App.RemoteDb, "remote_db", "", "")
 	flag.StringVar(&conf.App.ListenPort, "listen_port", ":5306", "")
+	flag.StringVar(&conf.App.RouteFile, "route_file", "", "多后端路由json文件, 设置后忽略remote_db和listen_port, 每个后端记录到各自的目录")
+	flag.BoolVar(&conf.App.ReadOnly, "read_only", false, "所有监听只读, 拒绝写入 DDL LOCK SET GLOBAL CALL 等语句, 路由文件中也可以按监听设置read_only")
 	flag.StringVar(&conf.App.FilePath, "file_path", "", "")
 	flag.StringVar(&conf.App.LogLevel, "log_level", zlog.InfoLevel, "日志级别 debug info error")
+	flag.StringVar(&conf.App.RecordFormat, "record_format", mysqlserver.RecordFormatText, "记录文件格式 text jsonl")
+	flag.BoolVar(&conf.App.RecordTransaction, "record_transaction", false, "事务结束时记录事务汇总: 语句数 耗时 提交或回滚")
+	flag.StringVar(&conf.App.MaskFile, "mask_file", "", "脱敏规则json文件, 按列名 正则 语句指纹的参数位置脱敏记录文件 审计库和日志中的语句")
+	flag.BoolVar(&conf.App.RecordFingerprint, "record_fingerprint", false, "只记录语句指纹, 所有字面量替换为?")
+	flag.StringVar(&conf.App.AuditDsn, "audit_dsn", "", "审计库dsn, 为空时不入库")
+	flag.IntVar(&conf.App.AuditQueueSize, "audit_queue_size", 10000, "审计日志队列长度")
+	flag.IntVar(&conf.App.AuditBatchSize, "audit_batch_size", 200, "审计日志每批写入条数")
+	flag.DurationVar(&conf.App.AuditFlushInterval, "audit_flush_interval", time.Second, "审计日志最长写入间隔")
+	flag.StringVar(&conf.App.AuditQueuePolicy, "audit_queue_policy", db.QueuePolicyDrop, "审计日志队列满时的策略 drop block, block策略下客户端的语句最多等待audit_block_timeout后才转发给服务端")
+	flag.DurationVar(&conf.App.AuditBlockTimeout, "audit_block_timeout", 10*time.Millisecond, "block策略下最长等待时间, 必须大于0")
+	flag.StringVar(&conf.App.CommentMarker, "comment_marker", "TzAdmin", "后台sql注释标记 /* TzAdmin-{json}-TzAdmin */")
+	flag.StringVar(&conf.App.CommentRegex, "comment_regex", "", "后台sql注释正则, 第一个分组为json内容, 设置后忽略comment_marker")
+	flag.StringVar(&conf.App.ClientTlsCert, "client_tls_cert", "", "客户端连接代理使用的证书")
+	flag.StringVar(&conf.App.ClientTlsKey, "client_tls_key", "", "客户端连接代理使用的私钥")
+	flag.BoolVar(&conf.App.RequireSecureTransport, "require_secure_transport", false, "拒绝没有使用ssl的客户端")
+	flag.StringVar(&conf.App.ServerTlsMode, "server_tls_mode", mysqlserver.ServerTlsDisabled, "代理连接服务端的ssl模式 disabled preferred required verify_ca verify_identity")
+	flag.StringVar(&conf.App.ServerTlsCa, "server_tls_ca", "", "校验服务端证书的ca")
+	flag.StringVar(&conf.App.ServerTlsCert, "server_tls_cert", "", "代理连接服务端使用的客户端证书")
+	flag.StringVar(&conf.App.ServerTlsKey, "server_tls_key", "", "代理连接服务端使用的客户端私钥")
+	flag.StringVar(&conf.App.ServerTlsServerName, "server_tls_server_name", "", "校验服务端证书的主机名, 默认使用remote_db的host")
+	flag.BoolVar(&conf.App.ClientCompress, "client_compress", false, "是否允许客户端使用压缩协议")
+	flag.StringVar(&conf.App.ServerCompress, "server_compress", mysqlserver.CompressNone, "代理连接服务端使用的压缩 none zlib zstd")
+	flag.IntVar(&conf.App.ServerZstdLevel, "server_zstd_level", mysqlserver.DefaultZstdLevel, "代理连接服务端使用zstd时的压缩级别 1-22")
+	flag.StringVar(&conf.App.AuthUserFile, "auth_user_file", "", "代理用户json文件, 设置后由代理认证客户端并使用映射的服务账号登录服务端")
+	flag.StringVar(&conf.App.FirewallFile, "firewall_file", "", "防火墙规则json文件, 按用户 客户端ip 库 语句类型 表名 正则匹配, 放行 记录或拒绝")
+	flag.StringVar(&conf.App.ResultMaskFile, "result_mask_file", "", "结果集脱敏规则json文件, 按用户 库 表 列 别名匹配, 返回给客户端的值替换为mask或hash")
+	flag.DurationVar(&conf.App.HealthCheckInterval, "health_check_interval", 5*time.Second, "后端健康检查间隔, 为0或没有设置health_check_user时不检查. 只连接不登录的检查会被服务端计入max_connect_errors, 达到上限后代理所在主机被拒绝连接")
+	flag.DurationVar(&conf.App.HealthCheckTimeout, "health_check_timeout", 3*time.Second, "后端健康检查超时")
+	flag.StringVar(&conf.App.HealthCheckUser, "health_check_user", "", "健康检查账号, 每次检查登录执行SELECT 1并检查复制延迟后COM_QUIT, 为空时不检查, 连接失败的后端过几秒后重新尝试")
+	flag.StringVar(&conf.App.HealthCheckPassword, "health_check_password", "", "健康检查账号的密码")
+	flag.IntVar(&conf.App.ConnectRetries, "connect_retries", 2, "连接后端和故障转移后端都失败时的重试次数")
+	flag.DurationVar(&conf.App.ConnectBackoff, "connect_backoff", 200*time.Millisecond, "连接后端重试的首次退避时间, 之后每次翻倍")
+	flag.DurationVar(&conf.App.ConnectTimeout, "connect_timeout", 3*time.Second, "连接后端的超时")
+	flag.IntVar(&conf.App.PoolSize, "pool_size", 0, "每个后端的连接池大小, 设置后客户端在事务或单条语句期间租用服务端连接, 需要auth_user_file, 为0时不使用")
+	flag.DurationVar(&conf.App.PoolIdleTimeout, "pool_idle_timeout", time.Minute, "连接池中空闲连接的超时")
+	flag.DurationVar(&conf.App.PoolMaxLifetime, "pool_max_lifetime", 30*time.Minute, "连接池中连接的最长存活时间")
+	flag.IntVar(&conf.App.MaxAllowedPacket, "max_allowed_packet", mysqlserver.DefaultMaxAllowedPacket, "合并拆分包后逻辑包的最大字节数, 超过时断开连接, 需要不小于服务端的max_allowed_packet")
 	flag.Parse()
 
 	cfg := zlog.DefaultConfig
 	cfg.Level = conf.App.LogLevel
 	zlog.Init("app", cfg)
 
-	if conf.App.RemoteDb == "" {
-		zlog.Fatal("remote db addr not set")
+	routeConfig, err := mysqlserver.LoadRouteConfig(conf.App.RouteFile, conf.App.RemoteDb, conf.App.ListenPort)
+	if err != nil {
+		zlog.Fatalf("load route config err: %s", err)
 	}
 
-	zlog.Infof("remote db: %s", conf.App.RemoteDb)
+	if conf.App.RecordFormat != mysqlserver.RecordFormatText && conf.App.RecordFormat != mysqlserver.RecordFormatJsonl {
+		zlog.Fatalf("unsupported record format: %s", conf.App.RecordFormat)
+	}
 
-	listen, err := net.Listen("tcp", conf.App.ListenPort)
+	err = mysqlserver.InitMasking(conf.App.MaskFile, conf.App.RecordFingerprint)
 	if err != nil {
-		log.Fatal(err)
+		zlog.Fatalf("init masking err: %s", err)
+	}
+
+	err = mysqlserver.InitSqlComment(conf.App.CommentMarker, conf.App.CommentRegex)
+	if err != nil {
+		zlog.Fatalf("init sql comment err: %s", err)
+	}
+
+	err = mysqlserver.InitClientTls(conf.App.ClientTlsCert, conf.App.ClientTlsKey, conf.App.RequireSecureTransport)
+	if err != nil {
+		zlog.Fatalf("init client tls err: %s", err)
+	}
+
+	err = mysqlserver.InitServerTls(conf.App.ServerTlsMode, conf.App.ServerTlsCa,
+		conf.App.ServerTlsCert, conf.App.ServerTlsKey, conf.App.ServerTlsServerName)
+	if err != nil {
+		zlog.Fatalf("init server tls err: %s", err)
+	}
+
+	err = mysqlserver.InitCompress(conf.App.ClientCompress, conf.App.ServerCompress, conf.App.ServerZstdLevel)
+	if err != nil {
+		zlog.Fatalf("init compress err: %s", err)
+	}
+
+	err = mysqlserver.InitMaxAllowedPacket(conf.App.MaxAllowedPacket)
+	if err != nil {
+		zlog.Fatalf("init max allowed packet err: %s", err)
+	}
+
+	err = mysqlserver.InitProxyAuth(conf.App.AuthUserFile)
+	if err != nil {
+		zlog.Fatalf("init proxy auth err: %s", err)
+	}
+
+	err = mysqlserver.InitFirewall(conf.App.FirewallFile)
+	if err != nil {
+		zlog.Fatalf("init firewall err: %s", err)
+	}
+
+	err = mysqlserver.InitResultMasking(conf.App.ResultMaskFile)
+	if err != nil {
+		zlog.Fatalf("init result masking err: %s", err)
 	}
 
-	zlog.Infof("db server listen on: %s", conf.App.ListenPort)
+	err = routeConfig.CheckReadWriteSplit()
+	if err != nil {
+		zlog.Fatalf("check read write split err: %s", err)
+	}
+
+	err = mysqlserver.InitConnectRetry(conf.App.ConnectRetries, conf.App.ConnectBackoff, conf.App.ConnectTimeout)
+	if err != nil {
+		zlog.Fatalf("init connect retry err: %s", err)
+	}
+
+	err = mysqlserver.InitBackendPool(conf.App.PoolSize, conf.App.PoolIdleTimeout, conf.App.PoolMaxLifetime)
+	if err != nil {
+		zlog.Fatalf("init backend pool err: %s", err)
+	}
+
+	routeConfig.StartHealthCheck(conf.App.HealthCheckInterval, conf.App.HealthCheckTimeout,
+		conf.App.HealthCheckUser, conf.App.HealthCheckPassword)
+
+	if conf.App.AuditDsn != "" {
+		db.InitAdminDb(conf.App.AuditDsn)
+		err = db.InitQueryLogWriter(&db.QueryLogWriterConfig{
+			QueueSize:     conf.App.AuditQueueSize,
+			BatchSize:     conf.App.AuditBatchSize,
+			FlushInterval: conf.App.AuditFlushInterval,
+			QueuePolicy:   conf.App.AuditQueuePolicy,
+			BlockTimeout:  conf.App.AuditBlockTimeout,
+		})
+		if err != nil {
+			zlog.Fatalf("init query log writer err: %s", err)
+		}
+		zlog.Infof("audit db enabled")
+	}
+
+	for _, backend := range routeConfig.Backends {
+		zlog.Infof("remote db: %s %s", backend.Name, backend.Addr)
+	}
 
 	dirName := time.Now().Format("2006-01-02-15-04-05")
 
@@ -45,27 +164,45 @@ func main() {
 		dirPath = currentPath + string(os.PathSeparator) + dirName
 	}
 
-	err = os.MkdirAll(dirPath, os.ModePerm)
+	err = routeConfig.InitRecordDir(dirPath)
 	if err != nil {
 		log.Fatal(err)
 	}
 	zlog.Infof("create log path success: %s", dirPath)
 
+	for _, listener := range routeConfig.Listeners {
+		listen, err := net.Listen("tcp", listener.Listen)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if conf.App.ReadOnly {
+			listener.ReadOnly = true
+		}
+
+		zlog.Infof("db server listen on: %s backend: %s read_only: %v", listener.Listen, listener.Backend, listener.ReadOnly)
+
+		go serve(listen, listener)
+	}
+
+	select {}
+}
+
+func serve(listen net.Listener, listener *mysqlserver.Listener) {
 	for {
 		conn, err := listen.Accept()
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		go func(conn2 net.Conn, dirPath string) {
+		go func(conn2 net.Conn) {
 			defer conn2.Close()
 
-			err := mysqlserver.NewProxyConn(conn2, dirPath).Handle()
+			err := mysqlserver.NewProxyConn(conn2, listener).Handle()
 			if err != nil {
 				zlog.Errorf("proxy conn handle err: %s", err)
 			}
 
-		}(conn, dirPath)
+		}(conn)
 	}
-
 }